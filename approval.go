@@ -0,0 +1,213 @@
+package cage
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Approver decides whether to update the service after canary tasks are verified
+type Approver interface {
+	// returns nil if approved. ctx is cancelled when approval has timed out
+	WaitForApproval(ctx context.Context, request *ApprovalRequest) error
+}
+
+type ApproverFunc func(ctx context.Context, request *ApprovalRequest) error
+
+func (f ApproverFunc) WaitForApproval(ctx context.Context, request *ApprovalRequest) error {
+	return f(ctx, request)
+}
+
+type ApprovalRequest struct {
+	Cluster           string                `json:"cluster"`
+	Service           string                `json:"service"`
+	TaskDefinitionArn string                `json:"taskDefinitionArn"`
+	CanaryTasks       []*ApprovalCanaryTask `json:"canaryTasks"`
+}
+
+type ApprovalCanaryTask struct {
+	TaskArn string `json:"taskArn"`
+	// ip:port of canary task. empty if unknown
+	Address string `json:"address"`
+}
+
+var ErrApprovalRejected = errors.New("rejected")
+
+// wait for approval of the approver. if it is not given in time, rolling out fails
+func (c *cage) WaitForApproval(
+	ctx context.Context,
+	nextTaskDefinition *ecs.TaskDefinition,
+	tasks []*StartCanaryTaskOutput,
+) error {
+	request := &ApprovalRequest{
+		Cluster:           c.env.Cluster,
+		Service:           c.env.Service,
+		TaskDefinitionArn: *nextTaskDefinition.TaskDefinitionArn,
+	}
+	for _, task := range tasks {
+		request.CanaryTasks = append(request.CanaryTasks, &ApprovalCanaryTask{
+			TaskArn: *task.task.TaskArn,
+			Address: task.address(),
+		})
+	}
+	log.Infof("✋ waiting for approval to update service '%s' to '%s'...", c.env.Service, request.TaskDefinitionArn)
+	for _, v := range request.CanaryTasks {
+		log.Infof("canary task '%s' is available at '%s'", v.TaskArn, v.Address)
+	}
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	done := make(chan error, 1)
+	go func() {
+		done <- c.approver.WaitForApproval(ctx, request)
+	}()
+	var timeout <-chan time.Time
+	if c.env.ApprovalTimeout > 0 {
+		timeout = newTimer(c.env.ApprovalTimeout).C
+	}
+	// approver may not return on cancellation. it is left behind
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-done:
+		if err != nil {
+			return fmt.Errorf("rolling out was not approved: %s", err)
+		}
+		log.Infof("👍 rolling out has been approved!")
+		return nil
+	case <-timeout:
+		return fmt.Errorf("approval has timed out after %s", c.env.ApprovalTimeout)
+	}
+}
+
+// ask for confirmation interactively
+type TerminalApprover struct {
+	In  io.Reader
+	Out io.Writer
+}
+
+func NewTerminalApprover() *TerminalApprover {
+	return &TerminalApprover{In: os.Stdin, Out: os.Stderr}
+}
+
+// whether stdin is a terminal
+func IsTerminal() bool {
+	if o, err := os.Stdin.Stat(); err != nil {
+		return false
+	} else {
+		return o.Mode()&os.ModeCharDevice != 0
+	}
+}
+
+func (a *TerminalApprover) WaitForApproval(ctx context.Context, request *ApprovalRequest) error {
+	fmt.Fprintf(a.Out, "service: %s/%s\n", request.Cluster, request.Service)
+	fmt.Fprintf(a.Out, "next task definition: %s\n", request.TaskDefinitionArn)
+	for _, v := range request.CanaryTasks {
+		fmt.Fprintf(a.Out, "canary task: %s (%s)\n", v.TaskArn, v.Address)
+	}
+	fmt.Fprintf(a.Out, "update service? [y/N]: ")
+	// reading stdin can't be interrupted. the reader is left behind on cancellation
+	result := make(chan error, 1)
+	go func() {
+		line, err := bufio.NewReader(a.In).ReadString('\n')
+		if err != nil && err != io.EOF {
+			result <- err
+			return
+		}
+		switch strings.ToLower(strings.TrimSpace(line)) {
+		case "y", "yes":
+			result <- nil
+			return
+		}
+		result <- ErrApprovalRejected
+	}()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-result:
+		return err
+	}
+}
+
+// wait for the file to be created. rolling out is rejected if its content is 'reject'.
+// the file left by former rolling out is removed when waiting starts
+type FileApprover struct {
+	Path string
+}
+
+func (a *FileApprover) WaitForApproval(ctx context.Context, request *ApprovalRequest) error {
+	if err := os.Remove(a.Path); err == nil {
+		log.Warnf("'%s' left by former rolling out was removed", a.Path)
+	} else if !os.IsNotExist(err) {
+		return err
+	}
+	log.Infof("create '%s' to approve, or write 'reject' to it to reject", a.Path)
+	for {
+		if d, err := ioutil.ReadFile(a.Path); err == nil {
+			if strings.TrimSpace(string(d)) == "reject" {
+				return ErrApprovalRejected
+			}
+			return nil
+		} else if !os.IsNotExist(err) {
+			return err
+		}
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-newTimer(time.Duration(5) * time.Second).C:
+		}
+	}
+}
+
+// wait for POST /approve or POST /reject. GET / returns the request as json
+type HTTPApprover struct {
+	Addr string
+}
+
+func (a *HTTPApprover) WaitForApproval(ctx context.Context, request *ApprovalRequest) error {
+	listener, err := net.Listen("tcp", a.Addr)
+	if err != nil {
+		return err
+	}
+	result := make(chan error, 1)
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(writer http.ResponseWriter, req *http.Request) {
+		writer.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(writer).Encode(request)
+	})
+	respond := func(err error) http.HandlerFunc {
+		return func(writer http.ResponseWriter, req *http.Request) {
+			if req.Method != http.MethodPost {
+				writer.WriteHeader(http.StatusMethodNotAllowed)
+				return
+			}
+			select {
+			case result <- err:
+			default:
+			}
+			writer.WriteHeader(http.StatusOK)
+		}
+	}
+	mux.HandleFunc("/approve", respond(nil))
+	mux.HandleFunc("/reject", respond(ErrApprovalRejected))
+	server := &http.Server{Handler: mux}
+	go server.Serve(listener)
+	defer server.Close()
+	log.Infof("POST http://%s/approve to approve, or POST http://%s/reject to reject", listener.Addr(), listener.Addr())
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case err := <-result:
+		return err
+	}
+}
@@ -0,0 +1,212 @@
+package cage
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+var approvalRequest = &ApprovalRequest{
+	Cluster:           "cage-test",
+	Service:           "service",
+	TaskDefinitionArn: "arn://td:2",
+	CanaryTasks:       []*ApprovalCanaryTask{{TaskArn: "arn://task", Address: "127.0.0.1:80"}},
+}
+
+func TestTerminalApprover(t *testing.T) {
+	for _, v := range []struct {
+		input    string
+		approved bool
+	}{
+		{input: "y\n", approved: true},
+		{input: "Yes\n", approved: true},
+		{input: "n\n", approved: false},
+		{input: "\n", approved: false},
+		{input: "", approved: false},
+	} {
+		out := &bytes.Buffer{}
+		approver := &TerminalApprover{In: strings.NewReader(v.input), Out: out}
+		err := approver.WaitForApproval(context.Background(), approvalRequest)
+		if v.approved {
+			assert.Nil(t, err)
+		} else {
+			assert.Equal(t, ErrApprovalRejected, err)
+		}
+		assert.Contains(t, out.String(), "arn://task (127.0.0.1:80)")
+	}
+	// 入力を待たずにキャンセルできる
+	in, _ := io.Pipe()
+	defer in.Close()
+	approver := &TerminalApprover{In: in, Out: &bytes.Buffer{}}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, approver.WaitForApproval(ctx, approvalRequest))
+}
+
+func TestFileApprover(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	dir, _ := ioutil.TempDir("", "cage")
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "approval")
+	approver := &FileApprover{Path: path}
+	// ファイルが作られるまで待つ
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	assert.Equal(t, context.Canceled, approver.WaitForApproval(ctx, approvalRequest))
+	for _, v := range []struct {
+		content string
+		err     error
+	}{
+		{content: "", err: nil},
+		{content: "reject\n", err: ErrApprovalRejected},
+	} {
+		// 前回のファイルは消してから待つ
+		ioutil.WriteFile(path, []byte(""), 0644)
+		done := make(chan error, 1)
+		go func() {
+			done <- approver.WaitForApproval(context.Background(), approvalRequest)
+		}()
+		for {
+			if _, err := os.Stat(path); os.IsNotExist(err) {
+				break
+			}
+			time.Sleep(time.Duration(1) * time.Millisecond)
+		}
+		ioutil.WriteFile(path, []byte(v.content), 0644)
+		assert.Equal(t, v.err, <-done)
+	}
+}
+
+func TestHTTPApprover(t *testing.T) {
+	for _, v := range []struct {
+		path string
+		err  error
+	}{
+		{path: "/approve", err: nil},
+		{path: "/reject", err: ErrApprovalRejected},
+	} {
+		l, _ := net.Listen("tcp", "127.0.0.1:0")
+		addr := l.Addr().String()
+		l.Close()
+		approver := &HTTPApprover{Addr: addr}
+		done := make(chan error, 1)
+		go func() {
+			done <- approver.WaitForApproval(context.Background(), approvalRequest)
+		}()
+		for {
+			if res, err := http.Post("http://"+addr+v.path, "text/plain", nil); err == nil {
+				res.Body.Close()
+				break
+			}
+			time.Sleep(time.Duration(10) * time.Millisecond)
+		}
+		assert.Equal(t, v.err, <-done)
+	}
+}
+
+func TestCage_RollOut_Approval(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	for _, v := range []struct {
+		approver Approver
+		ok       bool
+	}{
+		{approver: ApproverFunc(func(ctx context.Context, request *ApprovalRequest) error {
+			assert.Equal(t, 1, len(request.CanaryTasks))
+			assert.Equal(t, "127.0.0.1:8000", request.CanaryTasks[0].Address)
+			return nil
+		}), ok: true},
+		{approver: ApproverFunc(func(ctx context.Context, request *ApprovalRequest) error {
+			return ErrApprovalRejected
+		}), ok: false},
+	} {
+		envars := DefaultEnvars()
+		ctrl := gomock.NewController(t)
+		mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+		cagecli := NewCage(&Input{
+			Env:      envars,
+			ECS:      ecsMock,
+			ALB:      albMock,
+			EC2:      ec2Mock,
+			Approver: v.approver,
+		})
+		result, err := cagecli.RollOut(context.Background())
+		if v.ok {
+			assert.Nil(t, err)
+			assert.False(t, result.ServiceIntact)
+		} else {
+			assert.NotNil(t, err)
+			assert.True(t, result.ServiceIntact)
+		}
+		assert.Equal(t, int64(2), mctx.TaskSize())
+		ctrl.Finish()
+	}
+}
+
+func TestCage_RollOut_ApprovalTimeout(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.ApprovalTimeout = time.Hour
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	cancelled := make(chan struct{})
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+		Approver: ApproverFunc(func(ctx context.Context, request *ApprovalRequest) error {
+			<-ctx.Done()
+			close(cancelled)
+			return ctx.Err()
+		}),
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.NotNil(t, err)
+	assert.True(t, result.ServiceIntact)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+	// approverはキャンセルされる
+	<-cancelled
+}
+
+func TestCage_RollOut_ApprovalCancelled(t *testing.T) {
+	// approverが戻らなくてもキャンセルできる
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	ctx, cancel := context.WithCancel(context.Background())
+	blocked := make(chan struct{})
+	defer close(blocked)
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+		Approver: ApproverFunc(func(_ context.Context, request *ApprovalRequest) error {
+			cancel()
+			<-blocked
+			return nil
+		}),
+	})
+	result, err := cagecli.RollOut(ctx)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.True(t, result.ServiceIntact)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
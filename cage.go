@@ -2,9 +2,12 @@ package cage
 
 import (
 	"context"
+	"github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/aws/aws-sdk-go/service/codedeploy/codedeployiface"
 	"github.com/aws/aws-sdk-go/service/ec2/ec2iface"
 	"github.com/aws/aws-sdk-go/service/ecs/ecsiface"
 	"github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/aws/aws-sdk-go/service/servicediscovery/servicediscoveryiface"
 )
 
 type Cage interface {
@@ -17,6 +20,12 @@ type cage struct {
 	ecs ecsiface.ECSAPI
 	alb elbv2iface.ELBV2API
 	ec2 ec2iface.EC2API
+	cw  cloudwatchiface.CloudWatchAPI
+	cd  codedeployiface.CodeDeployAPI
+	sd  servicediscoveryiface.ServiceDiscoveryAPI
+	// optional
+	approver Approver
+	observer Observer
 }
 
 type Input struct {
@@ -24,12 +33,27 @@ type Input struct {
 	ECS ecsiface.ECSAPI
 	ALB elbv2iface.ELBV2API
 	EC2 ec2iface.EC2API
+	// optional. required only when metric thresholds are specified
+	CW cloudwatchiface.CloudWatchAPI
+	// optional. required only when the service uses CODE_DEPLOY deployment controller
+	CodeDeploy codedeployiface.CodeDeployAPI
+	// optional. required only when the service has service registries of Cloud Map
+	ServiceDiscovery servicediscoveryiface.ServiceDiscoveryAPI
+	// optional. if specified, service is updated only after approved
+	Approver Approver
+	// optional. receives lifecycle events of rolling out
+	Observer Observer
 }
 
 func NewCage(input *Input) Cage {
 	return &cage{
-		env: input.Env,
-		ecs: input.ECS,
-		alb: input.ALB,
-		ec2: input.EC2}
+		env:      input.Env,
+		ecs:      input.ECS,
+		alb:      input.ALB,
+		ec2:      input.EC2,
+		cw:       input.CW,
+		cd:       input.CodeDeploy,
+		sd:       input.ServiceDiscovery,
+		approver: input.Approver,
+		observer: input.Observer}
 }
@@ -0,0 +1,55 @@
+package commands
+
+import (
+	"errors"
+	"github.com/loilo-inc/canarycage"
+)
+
+// exit codes of the cage process. see README for details
+const (
+	ExitCodeOK = 0
+	// errors not classified, e.g. failure of AWS session or unknown flags
+	ExitCodeUnknown      = 1
+	ExitCodeInvalidInput = 2
+	ExitCodePreflight    = 3
+	// canary tasks failed and the service was not changed
+	ExitCodeCanary = 4
+	// the service might be changed. check it in console
+	ExitCodeServiceUpdate = 5
+	// the service failed to update but was rolled back to previous task definition
+	ExitCodeRolledBack = 6
+	// canary tasks may be left running
+	ExitCodeCleanup = 7
+)
+
+// service was rolled back after failing to update
+type rolledBackError struct {
+	error
+}
+
+func (e *rolledBackError) Unwrap() error {
+	return e.error
+}
+
+func ExitCode(err error) int {
+	if err == nil {
+		return ExitCodeOK
+	}
+	switch cage.KindOf(err) {
+	case cage.ErrorKindInvalidInput:
+		return ExitCodeInvalidInput
+	case cage.ErrorKindPreflight:
+		return ExitCodePreflight
+	case cage.ErrorKindCanary:
+		return ExitCodeCanary
+	case cage.ErrorKindServiceUpdate:
+		var rolledBack *rolledBackError
+		if errors.As(err, &rolledBack) {
+			return ExitCodeRolledBack
+		}
+		return ExitCodeServiceUpdate
+	case cage.ErrorKindCleanup:
+		return ExitCodeCleanup
+	}
+	return ExitCodeUnknown
+}
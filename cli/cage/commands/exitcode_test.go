@@ -0,0 +1,28 @@
+package commands
+
+import (
+	"errors"
+	"github.com/loilo-inc/canarycage"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestExitCode(t *testing.T) {
+	assert.Equal(t, ExitCodeOK, ExitCode(nil))
+	assert.Equal(t, ExitCodeUnknown, ExitCode(errors.New("unknown")))
+	assert.Equal(t, ExitCodeInvalidInput, ExitCode(cage.NewErrorf("invalid")))
+	for kind, code := range map[cage.ErrorKind]int{
+		cage.ErrorKindPreflight:     ExitCodePreflight,
+		cage.ErrorKindCanary:        ExitCodeCanary,
+		cage.ErrorKindServiceUpdate: ExitCodeServiceUpdate,
+		cage.ErrorKindCleanup:       ExitCodeCleanup,
+	} {
+		assert.Equal(t, code, ExitCode(&cage.Error{Kind: kind, Err: errors.New("failed")}))
+	}
+	// ロールバックできた場合は区別する
+	err := &cage.Error{Kind: cage.ErrorKindServiceUpdate, Err: errors.New("failed")}
+	assert.Equal(t, ExitCodeRolledBack, ExitCode(&rolledBackError{err}))
+	// 掃除の失敗を優先する
+	err = &cage.Error{Kind: cage.ErrorKindCleanup, Err: errors.New("failed")}
+	assert.Equal(t, ExitCodeCleanup, ExitCode(&rolledBackError{err}))
+}
@@ -43,11 +43,11 @@ func TaskDefinitionArnFlag(dest *string) cli.Flag {
 func (c *cageCommands) aggregateEnvars(
 	ctx *cli.Context,
 	envars *cage.Envars,
-) {
+) error {
 	var _region string
 	ses, err := session.NewSession()
 	if err != nil {
-		log.Fatalf(err.Error())
+		return err
 	}
 	if envars.Region != "" {
 		_region = envars.Region
@@ -56,22 +56,25 @@ func (c *cageCommands) aggregateEnvars(
 		_region = *ses.Config.Region
 		log.Infof("🗺 region was loaded from sessions: %s", _region)
 	} else {
-		log.Fatalf("🙄 region must specified by --region flag or aws session")
+		return cage.NewErrorf("🙄 region must specified by --region flag or aws session")
 	}
 	if ctx.NArg() > 0 {
 		dir := ctx.Args().Get(0)
 		td, svc, err := cage.LoadDefinitionsFromFiles(dir);
 		if err != nil {
-			log.Fatalf(err.Error())
+			return err
+		}
+		probes, err := cage.LoadProbesFromFile(dir)
+		if err != nil {
+			return err
 		}
 		cage.MergeEnvars(envars, &cage.Envars{
 			Cluster:                *svc.Cluster,
 			Service:                *svc.ServiceName,
 			TaskDefinitionInput:    td,
 			ServiceDefinitionInput: svc,
+			Probes:                 probes,
 		})
 	}
-	if err := cage.EnsureEnvars(envars); err != nil {
-		log.Fatalf(err.Error())
-	}
+	return cage.EnsureEnvars(envars)
 }
@@ -0,0 +1,58 @@
+package commands
+
+import (
+	"encoding/json"
+	"github.com/loilo-inc/canarycage"
+	"github.com/urfave/cli"
+	"io"
+)
+
+const (
+	OutputText = "text"
+	OutputJSON = "json"
+)
+
+func OutputFlag(dest *string) cli.Flag {
+	return cli.StringFlag{
+		Name:        "output",
+		EnvVar:      cage.OutputKey,
+		Usage:       "format of the result printed on stdout. 'text' or 'json'. logs are always printed on stderr",
+		Value:       OutputText,
+		Destination: dest,
+	}
+}
+
+func ValidateOutput(output string) error {
+	if output != OutputText && output != OutputJSON {
+		return cage.NewErrorf("--output must be '%s' or '%s' but got '%s'", OutputText, OutputJSON, output)
+	}
+	return nil
+}
+
+type errorOutput struct {
+	Kind    cage.ErrorKind `json:"kind"`
+	Message string         `json:"message"`
+	// error occurred while rolling back the service, if any
+	RollBackError string `json:"rollBackError,omitempty"`
+}
+
+// single JSON document printed with --output json
+type resultOutput struct {
+	// nil if the command failed before starting
+	Result interface{}  `json:"result"`
+	Error  *errorOutput `json:"error,omitempty"`
+}
+
+func newResultOutput(result interface{}, err error) *resultOutput {
+	ret := &resultOutput{Result: result}
+	if err != nil {
+		ret.Error = &errorOutput{Kind: cage.KindOf(err), Message: err.Error()}
+	}
+	return ret
+}
+
+func (o *resultOutput) Print(w io.Writer) error {
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	return enc.Encode(o)
+}
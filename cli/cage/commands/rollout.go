@@ -4,15 +4,25 @@ import (
 	"github.com/apex/log"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/servicediscovery"
 	"github.com/loilo-inc/canarycage"
 	"github.com/urfave/cli"
+	"os"
+	"time"
 )
 
 func (c *cageCommands) RollOut() cli.Command {
 	var envars = cage.Envars{}
+	var trafficShiftSteps string
+	var approve bool
+	var approvalFile string
+	var approvalAddr string
+	var output string
 	return cli.Command{
 		Name:        "rollout",
 		Usage:       "roll out ECS service to next task definition",
@@ -23,33 +33,162 @@ func (c *cageCommands) RollOut() cli.Command {
 			ClusterFlag(&envars.Cluster),
 			ServiceFlag(&envars.Service),
 			TaskDefinitionArnFlag(&envars.TaskDefinitionArn),
+			OutputFlag(&output),
 			cli.StringFlag{
 				Name:        "canaryInstanceArn",
 				EnvVar:      cage.CanaryInstanceArnKey,
-				Usage:       "EC2 instance ARN for placing canary task. required only when LaunchType is EC2",
+				Usage:       "container instance ARN or EC2 instance ID for placing canary task on EC2. if not specified, suitable instance is selected from the cluster",
 				Destination: &envars.CanaryInstanceArn,
 			},
+			cli.Float64Flag{
+				Name:        "availabilityThreshold",
+				EnvVar:      cage.AvailabilityThresholdKey,
+				Usage:       "minimum ratio of non-5xx responses in target group while canary task is running (e.g. 0.9999). if not specified, skip checking",
+				Destination: &envars.AvailabilityThreshold,
+			},
+			cli.Float64Flag{
+				Name:        "responseTimeThreshold",
+				EnvVar:      cage.ResponseTimeThresholdKey,
+				Usage:       "maximum average response time in seconds of target group while canary task is running. if not specified, skip checking",
+				Destination: &envars.ResponseTimeThreshold,
+			},
+			cli.Int64Flag{
+				Name:        "analysisPeriod",
+				EnvVar:      cage.AnalysisPeriodKey,
+				Usage:       "period in seconds for collecting metrics of target group. must be a multiple of 60",
+				Value:       cage.DefaultAnalysisPeriod,
+				Destination: &envars.AnalysisPeriod,
+			},
+			cli.Int64Flag{
+				Name:        "canaryCount",
+				EnvVar:      cage.CanaryCountKey,
+				Usage:       "number of canary tasks. canary tasks are spread across availability zones of the service's subnets (default: 1)",
+				Destination: &envars.CanaryCount,
+			},
+			cli.Int64Flag{
+				Name:        "canaryPercentage",
+				EnvVar:      cage.CanaryPercentageKey,
+				Usage:       "number of canary tasks as a percentage of the service's desired count. exclusive with --canaryCount",
+				Destination: &envars.CanaryPercentage,
+			},
+			cli.DurationFlag{
+				Name:        "canarySoakDuration",
+				EnvVar:      cage.CanarySoakDurationKey,
+				Usage:       "duration to keep canary tasks serving live traffic after they become healthy (e.g. 5m). rolling out is aborted if canary tasks stop or become unhealthy during the period",
+				Destination: &envars.CanarySoakDuration,
+			},
+			cli.DurationFlag{
+				Name:        "canaryMinUptime",
+				EnvVar:      cage.CanaryMinUptimeKey,
+				Usage:       "duration canary tasks must keep running after they become healthy (e.g. 3m). rolling out is aborted if canary tasks stop during the period",
+				Destination: &envars.CanaryMinUptime,
+			},
+			cli.StringFlag{
+				Name:        "trafficShiftSteps",
+				EnvVar:      cage.TrafficShiftStepsKey,
+				Usage:       "comma separated percentages of traffic shifted to next tasks step by step (e.g. 5,25,50,100). if specified, shift traffic with weighted target groups of ALB before updating service",
+				Destination: &trafficShiftSteps,
+			},
+			cli.DurationFlag{
+				Name:        "trafficShiftBakeTime",
+				EnvVar:      cage.TrafficShiftBakeTimeKey,
+				Usage:       "duration to wait between each traffic shift step",
+				Value:       time.Minute,
+				Destination: &envars.TrafficShiftBakeTime,
+			},
+			cli.StringFlag{
+				Name:        "canaryTargetGroupArn",
+				EnvVar:      cage.CanaryTargetGroupArnKey,
+				Usage:       "target group for next tasks while shifting traffic. if not specified, create a temporary one identical to the service's target group",
+				Destination: &envars.CanaryTargetGroupArn,
+			},
+			cli.StringFlag{
+				Name:        "codeDeployApplication",
+				EnvVar:      cage.CodeDeployApplicationKey,
+				Usage:       "CodeDeploy application for service with CODE_DEPLOY deployment controller (default: AppECS-{cluster}-{service})",
+				Destination: &envars.CodeDeployApplication,
+			},
+			cli.StringFlag{
+				Name:        "codeDeployDeploymentGroup",
+				EnvVar:      cage.CodeDeployDeploymentGroupKey,
+				Usage:       "CodeDeploy deployment group for service with CODE_DEPLOY deployment controller (default: DgpECS-{cluster}-{service})",
+				Destination: &envars.CodeDeployDeploymentGroup,
+			},
+			cli.DurationFlag{
+				Name:        "codeDeployTimeout",
+				EnvVar:      cage.CodeDeployTimeoutKey,
+				Usage:       "timeout for each of CodeDeploy deployment and its rollback to complete",
+				Value:       cage.DefaultCodeDeployTimeout,
+				Destination: &envars.CodeDeployTimeout,
+			},
+			cli.BoolFlag{
+				Name:        "approve",
+				EnvVar:      cage.ApproveKey,
+				Usage:       "wait for approval before updating service. asks interactively on terminal, otherwise waits for --approvalFile or HTTP callback on --approvalAddr",
+				Destination: &approve,
+			},
+			cli.StringFlag{
+				Name:        "approvalFile",
+				EnvVar:      cage.ApprovalFileKey,
+				Usage:       "file to be created for approval in non-interactive mode. write 'reject' to it to reject",
+				Destination: &approvalFile,
+			},
+			cli.StringFlag{
+				Name:        "approvalAddr",
+				EnvVar:      cage.ApprovalAddrKey,
+				Usage:       "address to listen for POST /approve or POST /reject in non-interactive mode",
+				Value:       "127.0.0.1:9000",
+				Destination: &approvalAddr,
+			},
+			cli.DurationFlag{
+				Name:        "approvalTimeout",
+				EnvVar:      cage.ApprovalTimeoutKey,
+				Usage:       "rolling out fails if approval is not given in time",
+				Value:       time.Hour,
+				Destination: &envars.ApprovalTimeout,
+			},
+			cli.DurationFlag{
+				Name:        "containerHealthCheckTimeout",
+				EnvVar:      cage.ContainerHealthCheckTimeoutKey,
+				Usage:       "timeout for canary tasks of service without load balancer to become healthy by container health checks",
+				Value:       cage.DefaultContainerHealthCheckTimeout,
+				Destination: &envars.ContainerHealthCheckTimeout,
+			},
+			cli.DurationFlag{
+				Name:        "targetHealthCheckInterval",
+				EnvVar:      cage.TargetHealthCheckIntervalKey,
+				Usage:       "interval of polling health state of canary tasks in target groups. health check interval of the target group is used by default",
+				Destination: &envars.TargetHealthCheckInterval,
+			},
+			cli.DurationFlag{
+				Name:        "targetHealthCheckTimeout",
+				EnvVar:      cage.TargetHealthCheckTimeoutKey,
+				Usage:       "timeout for canary tasks to become healthy in target groups. by default, derived from health check interval and healthy threshold count of the target group, and health check grace period of the service",
+				Destination: &envars.TargetHealthCheckTimeout,
+			},
 		},
 		Action: func(ctx *cli.Context) error {
-			c.aggregateEnvars(ctx, &envars)
-			var ses *session.Session
-			if o, err := session.NewSession(&aws.Config{
-				Region: &envars.Region,
-			}); err != nil {
+			if err := ValidateOutput(output); err != nil {
 				return err
-			} else {
-				ses = o
 			}
-			cagecli := cage.NewCage(&cage.Input{
-				Env: &envars,
-				ECS: ecs.New(ses),
-				EC2: ec2.New(ses),
-				ALB: elbv2.New(ses),
-			})
-			result, err := cagecli.RollOut(c.ctx)
+			result, err := c.rollOut(ctx, &envars, trafficShiftSteps, approve, approvalFile, approvalAddr)
+			if output == OutputJSON {
+				o := newResultOutput(result, err)
+				if o.Error != nil && result != nil && result.RollBackError != nil {
+					o.Error.RollBackError = result.RollBackError.Error()
+				}
+				if err := o.Print(os.Stdout); err != nil {
+					log.Errorf("failed to print result: %s", err)
+				}
+			}
 			if err != nil {
-				if result.ServiceIntact {
+				if result == nil {
+					log.Errorf("😭 %s", err)
+				} else if result.ServiceIntact {
 					log.Errorf("🤕 failed to roll out new tasks but service '%s' is not changed. error: %s", envars.Service, err)
+				} else if result.RolledBack {
+					log.Errorf("🤕 failed to roll out new tasks but service '%s' has been rolled back to previous task definition. error: %s", envars.Service, err)
+					return &rolledBackError{err}
 				} else {
 					log.Errorf("😭 failed to roll out new tasks and service '%s' might be changed. check in console!!. error: %s", envars.Service, err)
 				}
@@ -60,3 +199,51 @@ func (c *cageCommands) RollOut() cli.Command {
 		},
 	}
 }
+
+// result is nil if it failed before rolling out
+func (c *cageCommands) rollOut(
+	ctx *cli.Context,
+	envars *cage.Envars,
+	trafficShiftSteps string,
+	approve bool,
+	approvalFile string,
+	approvalAddr string,
+) (*cage.RollOutResult, error) {
+	if steps, err := cage.ParseTrafficShiftSteps(trafficShiftSteps); err != nil {
+		return nil, err
+	} else {
+		envars.TrafficShiftSteps = steps
+	}
+	if err := c.aggregateEnvars(ctx, envars); err != nil {
+		return nil, err
+	}
+	var ses *session.Session
+	if o, err := session.NewSession(&aws.Config{
+		Region: &envars.Region,
+	}); err != nil {
+		return nil, err
+	} else {
+		ses = o
+	}
+	var approver cage.Approver
+	if approve {
+		if cage.IsTerminal() {
+			approver = cage.NewTerminalApprover()
+		} else if approvalFile != "" {
+			approver = &cage.FileApprover{Path: approvalFile}
+		} else {
+			approver = &cage.HTTPApprover{Addr: approvalAddr}
+		}
+	}
+	cagecli := cage.NewCage(&cage.Input{
+		Env:              envars,
+		ECS:              ecs.New(ses),
+		EC2:              ec2.New(ses),
+		ALB:              elbv2.New(ses),
+		CW:               cloudwatch.New(ses),
+		CodeDeploy:       codedeploy.New(ses),
+		ServiceDiscovery: servicediscovery.New(ses),
+		Approver:         approver,
+	})
+	return cagecli.RollOut(c.ctx)
+}
@@ -1,7 +1,8 @@
 package commands
 
 import (
-	"context"
+	"errors"
+	"github.com/apex/log"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
@@ -9,10 +10,12 @@ import (
 	"github.com/aws/aws-sdk-go/service/elbv2"
 	"github.com/loilo-inc/canarycage"
 	"github.com/urfave/cli"
+	"os"
 )
 
 func (c *cageCommands) Up() cli.Command {
 	envars := cage.Envars{}
+	var output string
 	return cli.Command{
 		Name: "up",
 		Usage: "create new ECS service with specified task definition",
@@ -23,26 +26,52 @@ func (c *cageCommands) Up() cli.Command {
 			ClusterFlag(&envars.Cluster),
 			ServiceFlag(&envars.Service),
 			TaskDefinitionArnFlag(&envars.TaskDefinitionArn),
+			OutputFlag(&output),
 		},
 		Action: func(ctx *cli.Context) error {
-			c.aggregateEnvars(ctx, &envars)
-			var ses *session.Session
-			if o, err := session.NewSession(&aws.Config{
-				Region: &envars.Region,
-			}); err != nil {
+			if err := ValidateOutput(output); err != nil {
 				return err
-			} else {
-				ses = o
 			}
-			cagecli := cage.NewCage(&cage.Input{
-				Env: &envars,
-				ECS: ecs.New(ses),
-				ALB: elbv2.New(ses),
-				EC2: ec2.New(ses),
-			})
-			_, err := cagecli.Up(context.Background())
-			return err
+			result, err := c.up(ctx, &envars)
+			if output == OutputJSON {
+				if err := newResultOutput(result, err).Print(os.Stdout); err != nil {
+					log.Errorf("failed to print result: %s", err)
+				}
+			}
+			if err != nil {
+				var e *cage.Error
+				if !errors.As(err, &e) {
+					log.Errorf("😭 %s", err)
+				} else if e.ServiceIntact {
+					log.Errorf("🤕 failed to bring up service '%s' but it is not created. error: %s", envars.Service, err)
+				} else {
+					log.Errorf("😭 failed to bring up service '%s' and it might be created. check in console!!. error: %s", envars.Service, err)
+				}
+				return err
+			}
+			return nil
 		},
 	}
 }
 
+// result is nil if it failed before creating the service
+func (c *cageCommands) up(ctx *cli.Context, envars *cage.Envars) (*cage.UpResult, error) {
+	if err := c.aggregateEnvars(ctx, envars); err != nil {
+		return nil, err
+	}
+	var ses *session.Session
+	if o, err := session.NewSession(&aws.Config{
+		Region: &envars.Region,
+	}); err != nil {
+		return nil, err
+	} else {
+		ses = o
+	}
+	cagecli := cage.NewCage(&cage.Input{
+		Env: envars,
+		ECS: ecs.New(ses),
+		ALB: elbv2.New(ses),
+		EC2: ec2.New(ses),
+	})
+	return cagecli.Up(c.ctx)
+}
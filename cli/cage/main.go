@@ -2,9 +2,12 @@ package main
 
 import (
 	"context"
+	"github.com/apex/log"
 	"github.com/loilo-inc/canarycage/cli/cage/commands"
 	"github.com/urfave/cli"
 	"os"
+	"os/signal"
+	"syscall"
 )
 
 func main() {
@@ -12,15 +15,23 @@ func main() {
 	app.Name = "canarycage"
 	app.Version = "3.0.1"
 	app.Description = "A gradual roll-out deployment tool for AWS ECS"
-	ctx := context.Background()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	// cancel the command on Ctrl-C or termination of CI job. rollout cleans up canary tasks before exit
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Warnf("received %s. cancelling...", sig)
+		cancel()
+		// second signal terminates immediately
+		signal.Reset(syscall.SIGINT, syscall.SIGTERM)
+	}()
 	cmds := commands.NewCageCommands(ctx)
 	app.Commands = cli.Commands{
 		cmds.RollOut(),
 		cmds.Up(),
 	}
 	err := app.Run(os.Args)
-	if err != nil {
-		os.Exit(1)
-	}
-	os.Exit(0)
+	os.Exit(commands.ExitCode(err))
 }
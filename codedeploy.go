@@ -0,0 +1,262 @@
+package cage
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"math"
+	"regexp"
+	"time"
+)
+
+// default timeout for CodeDeploy deployment and its rollback to complete
+const DefaultCodeDeployTimeout = time.Duration(1) * time.Hour
+
+type appSpec struct {
+	Version   string             `json:"version"`
+	Resources []*appSpecResource `json:"Resources"`
+}
+
+type appSpecResource struct {
+	TargetService *appSpecTargetService `json:"TargetService"`
+}
+
+type appSpecTargetService struct {
+	Type       string                    `json:"Type"`
+	Properties *appSpecServiceProperties `json:"Properties"`
+}
+
+type appSpecServiceProperties struct {
+	TaskDefinition   string                   `json:"TaskDefinition"`
+	LoadBalancerInfo *appSpecLoadBalancerInfo `json:"LoadBalancerInfo,omitempty"`
+	PlatformVersion  string                   `json:"PlatformVersion,omitempty"`
+}
+
+type appSpecLoadBalancerInfo struct {
+	ContainerName string `json:"ContainerName"`
+	ContainerPort int64  `json:"ContainerPort"`
+}
+
+func IsCodeDeployService(service *ecs.Service) bool {
+	return service.DeploymentController != nil &&
+		aws.StringValue(service.DeploymentController.Type) == ecs.DeploymentControllerTypeCodeDeploy
+}
+
+// application name of CodeDeploy. defaults to the one created by ECS console
+func (c *cage) CodeDeployApplication() string {
+	if c.env.CodeDeployApplication != "" {
+		return c.env.CodeDeployApplication
+	}
+	return fmt.Sprintf("AppECS-%s-%s", c.env.Cluster, c.env.Service)
+}
+
+// deployment group name of CodeDeploy. defaults to the one created by ECS console
+func (c *cage) CodeDeployDeploymentGroup() string {
+	if c.env.CodeDeployDeploymentGroup != "" {
+		return c.env.CodeDeployDeploymentGroup
+	}
+	return fmt.Sprintf("DgpECS-%s-%s", c.env.Cluster, c.env.Service)
+}
+
+var targetGroupNamePattern = regexp.MustCompile("targetgroup/([^/]+)/")
+
+// target group which production listener of the deployment group forwards requests to.
+// target group of the service may be idle one after blue/green deployments
+func (c *cage) LiveTargetGroupArn() (*string, error) {
+	app := c.CodeDeployApplication()
+	group := c.CodeDeployDeploymentGroup()
+	var pair *codedeploy.TargetGroupPairInfo
+	if o, err := c.cd.GetDeploymentGroup(&codedeploy.GetDeploymentGroupInput{
+		ApplicationName:     &app,
+		DeploymentGroupName: &group,
+	}); err != nil {
+		return nil, err
+	} else if info := o.DeploymentGroupInfo.LoadBalancerInfo; info == nil || len(info.TargetGroupPairInfoList) == 0 {
+		return nil, fmt.Errorf("deployment group '%s' has no target group pair", group)
+	} else {
+		pair = info.TargetGroupPairInfoList[0]
+	}
+	if pair.ProdTrafficRoute == nil || len(pair.ProdTrafficRoute.ListenerArns) == 0 {
+		return nil, fmt.Errorf("deployment group '%s' has no production listener", group)
+	}
+	names := make(map[string]bool)
+	for _, tg := range pair.TargetGroups {
+		names[aws.StringValue(tg.Name)] = true
+	}
+	o, err := c.alb.DescribeListeners(&elbv2.DescribeListenersInput{
+		ListenerArns: pair.ProdTrafficRoute.ListenerArns,
+	})
+	if err != nil {
+		return nil, err
+	}
+	// the one with larger weight is live while traffic is being shifted
+	var live *string
+	liveWeight := int64(-1)
+	for _, listener := range o.Listeners {
+		for _, action := range listener.DefaultActions {
+			if *action.Type != elbv2.ActionTypeEnumForward {
+				continue
+			}
+			tuples := []*elbv2.TargetGroupTuple{{TargetGroupArn: action.TargetGroupArn, Weight: aws.Int64(1)}}
+			if action.ForwardConfig != nil {
+				tuples = action.ForwardConfig.TargetGroups
+			}
+			for _, tg := range tuples {
+				m := targetGroupNamePattern.FindStringSubmatch(aws.StringValue(tg.TargetGroupArn))
+				if m == nil || !names[m[1]] {
+					continue
+				}
+				if weight := aws.Int64Value(tg.Weight); weight > liveWeight {
+					live, liveWeight = tg.TargetGroupArn, weight
+				}
+			}
+		}
+	}
+	if live == nil {
+		return nil, fmt.Errorf("production listener of deployment group '%s' doesn't forward requests to its target groups", group)
+	}
+	return live, nil
+}
+
+func GenerateAppSpec(service *ecs.Service, nextTaskDefinition *ecs.TaskDefinition) (string, error) {
+	props := &appSpecServiceProperties{
+		TaskDefinition:  *nextTaskDefinition.TaskDefinitionArn,
+		PlatformVersion: aws.StringValue(service.PlatformVersion),
+	}
+	if len(service.LoadBalancers) > 0 {
+		props.LoadBalancerInfo = &appSpecLoadBalancerInfo{
+			ContainerName: *service.LoadBalancers[0].ContainerName,
+			ContainerPort: *service.LoadBalancers[0].ContainerPort,
+		}
+	}
+	d, err := json.Marshal(&appSpec{
+		Version: "0.0",
+		Resources: []*appSpecResource{{
+			TargetService: &appSpecTargetService{
+				Type:       "AWS::ECS::Service",
+				Properties: props,
+			},
+		}},
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(d), nil
+}
+
+// create CodeDeploy deployment for the service with next task definition and wait for it to complete
+func (c *cage) RollOutWithCodeDeploy(
+	ctx context.Context,
+	service *ecs.Service,
+	nextTaskDefinition *ecs.TaskDefinition,
+	result *RollOutResult,
+) error {
+	appSpec, err := GenerateAppSpec(service, nextTaskDefinition)
+	if err != nil {
+		return err
+	}
+	app := c.CodeDeployApplication()
+	group := c.CodeDeployDeploymentGroup()
+	log.Infof("creating deployment of '%s' in CodeDeploy application '%s'...", group, app)
+	log.Debugf("appspec: %s", appSpec)
+	c.emit(&Event{Type: EventServiceUpdateStarted, TaskDefinitionArn: *nextTaskDefinition.TaskDefinitionArn})
+	result.ServiceIntact = false
+	var deploymentId *string
+	if o, err := c.cd.CreateDeployment(&codedeploy.CreateDeploymentInput{
+		ApplicationName:     &app,
+		DeploymentGroupName: &group,
+		Revision: &codedeploy.RevisionLocation{
+			RevisionType: aws.String(codedeploy.RevisionLocationTypeAppSpecContent),
+			AppSpecContent: &codedeploy.AppSpecContent{
+				Content: &appSpec,
+			},
+		},
+	}); err != nil {
+		// deployment was not created
+		result.ServiceIntact = true
+		return err
+	} else {
+		deploymentId = o.DeploymentId
+	}
+	result.CodeDeployDeploymentId = *deploymentId
+	log.Infof("waiting for deployment '%s' to complete...", *deploymentId)
+	info, err := c.WaitUntilDeploymentCompleted(ctx, *deploymentId)
+	if info != nil {
+		result.CodeDeployStatus = aws.StringValue(info.Status)
+	}
+	if err != nil {
+		log.Warnf("stopping deployment '%s' to roll back...", *deploymentId)
+		if _, stopErr := c.cd.StopDeployment(&codedeploy.StopDeploymentInput{
+			DeploymentId:        deploymentId,
+			AutoRollbackEnabled: aws.Bool(true),
+		}); stopErr != nil {
+			log.Errorf("😱 failed to stop deployment '%s': %s", *deploymentId, stopErr)
+			return fmt.Errorf("%s (failed to stop deployment '%s': %s)", err, *deploymentId, stopErr)
+		}
+		return err
+	}
+	status := aws.StringValue(info.Status)
+	if status == codedeploy.DeploymentStatusSucceeded {
+		log.Infof("🥴 deployment '%s' has succeeded!", *deploymentId)
+		c.emit(&Event{Type: EventServiceStable, TaskDefinitionArn: *nextTaskDefinition.TaskDefinitionArn})
+		return nil
+	}
+	var message string
+	if info.ErrorInformation != nil {
+		message = aws.StringValue(info.ErrorInformation.Message)
+	}
+	err = fmt.Errorf("deployment '%s' has %s: %s", *deploymentId, status, message)
+	if info.RollbackInfo == nil || info.RollbackInfo.RollbackDeploymentId == nil {
+		return err
+	}
+	// the service is rolled back only if the rollback deployment succeeds
+	rollbackId := *info.RollbackInfo.RollbackDeploymentId
+	log.Infof("waiting for rollback deployment '%s' to complete...", rollbackId)
+	if rollback, rollbackErr := c.WaitUntilDeploymentCompleted(ctx, rollbackId); rollbackErr != nil {
+		log.Errorf("😱 failed to wait for rollback deployment '%s': %s", rollbackId, rollbackErr)
+		return fmt.Errorf("%s (failed to wait for rollback deployment '%s': %s)", err, rollbackId, rollbackErr)
+	} else if status := aws.StringValue(rollback.Status); status != codedeploy.DeploymentStatusSucceeded {
+		log.Errorf("😱 rollback deployment '%s' has %s", rollbackId, status)
+		return fmt.Errorf("%s (rollback deployment '%s' has %s)", err, rollbackId, status)
+	}
+	log.Infof("deployment '%s' has been rolled back by '%s'", *deploymentId, rollbackId)
+	result.RolledBack = true
+	return err
+}
+
+// poll the deployment until it succeeds, fails or is stopped.
+// it fails if the deployment doesn't complete within --codeDeployTimeout. the recent state is returned in any case
+func (c *cage) WaitUntilDeploymentCompleted(ctx context.Context, deploymentId string) (*codedeploy.DeploymentInfo, error) {
+	interval := time.Duration(15) * time.Second
+	timeout := c.env.CodeDeployTimeout
+	if timeout == 0 {
+		timeout = DefaultCodeDeployTimeout
+	}
+	var info *codedeploy.DeploymentInfo
+	for count := 0; count < int(math.Ceil(float64(timeout)/float64(interval))); count++ {
+		if err := sleep(ctx, interval); err != nil {
+			return info, err
+		}
+		o, err := c.cd.GetDeployment(&codedeploy.GetDeploymentInput{
+			DeploymentId: &deploymentId,
+		})
+		if err != nil {
+			return info, err
+		}
+		status := aws.StringValue(o.DeploymentInfo.Status)
+		if info == nil || status != aws.StringValue(info.Status) {
+			log.Infof("deployment '%s' status is: %s", deploymentId, status)
+		}
+		info = o.DeploymentInfo
+		switch status {
+		case codedeploy.DeploymentStatusSucceeded, codedeploy.DeploymentStatusFailed, codedeploy.DeploymentStatusStopped:
+			return info, nil
+		}
+	}
+	return info, fmt.Errorf("deployment '%s' didn't complete in %s", deploymentId, timeout)
+}
@@ -0,0 +1,328 @@
+package cage
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/codedeploy"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/golang/mock/gomock"
+	"github.com/loilo-inc/canarycage/mocks/github.com/aws/aws-sdk-go/service/codedeploy/codedeployiface"
+	"github.com/loilo-inc/canarycage/mocks/github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestGenerateAppSpec(t *testing.T) {
+	envars := DefaultEnvars()
+	service := &ecs.Service{
+		LoadBalancers: envars.ServiceDefinitionInput.LoadBalancers,
+	}
+	spec, err := GenerateAppSpec(service, &ecs.TaskDefinition{TaskDefinitionArn: aws.String("arn://td:2")})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var o appSpec
+	if err := json.Unmarshal([]byte(spec), &o); err != nil {
+		t.Fatalf(err.Error())
+	}
+	props := o.Resources[0].TargetService.Properties
+	assert.Equal(t, "arn://td:2", props.TaskDefinition)
+	assert.Equal(t, *envars.ServiceDefinitionInput.LoadBalancers[0].ContainerName, props.LoadBalancerInfo.ContainerName)
+	assert.Equal(t, *envars.ServiceDefinitionInput.LoadBalancers[0].ContainerPort, props.LoadBalancerInfo.ContainerPort)
+}
+
+func setupCodeDeploy(t *testing.T, ctrl *gomock.Controller, envars *Envars, statuses ...string) *mock_codedeployiface.MockCodeDeployAPI {
+	cdMock := mock_codedeployiface.NewMockCodeDeployAPI(ctrl)
+	cdMock.EXPECT().CreateDeployment(gomock.Any()).DoAndReturn(func(input *codedeploy.CreateDeploymentInput) (*codedeploy.CreateDeploymentOutput, error) {
+		assert.Equal(t, "AppECS-"+envars.Cluster+"-"+envars.Service, *input.ApplicationName)
+		assert.Equal(t, "DgpECS-"+envars.Cluster+"-"+envars.Service, *input.DeploymentGroupName)
+		return &codedeploy.CreateDeploymentOutput{DeploymentId: aws.String("d-1")}, nil
+	})
+	expectGetDeployment(cdMock, "d-1", statuses...)
+	return cdMock
+}
+
+// failed deployment 'd-1' is rolled back by 'd-2'
+func expectGetDeployment(cdMock *mock_codedeployiface.MockCodeDeployAPI, deploymentId string, statuses ...string) {
+	for _, status := range statuses {
+		info := &codedeploy.DeploymentInfo{
+			DeploymentId: aws.String(deploymentId),
+			Status:       aws.String(status),
+		}
+		if status == codedeploy.DeploymentStatusFailed {
+			info.ErrorInformation = &codedeploy.ErrorInformation{Message: aws.String("alarm")}
+			if deploymentId == "d-1" {
+				info.RollbackInfo = &codedeploy.RollbackInfo{RollbackDeploymentId: aws.String("d-2")}
+			}
+		}
+		cdMock.EXPECT().GetDeployment(&codedeploy.GetDeploymentInput{DeploymentId: aws.String(deploymentId)}).
+			Return(&codedeploy.GetDeploymentOutput{DeploymentInfo: info}, nil)
+	}
+}
+
+// production listener of the deployment group forwards requests to the live target group
+func setupDeploymentGroup(cdMock *mock_codedeployiface.MockCodeDeployAPI, albMock *mock_elbv2iface.MockELBV2API, liveTargetGroupArn *string) {
+	cdMock.EXPECT().GetDeploymentGroup(gomock.Any()).Return(&codedeploy.GetDeploymentGroupOutput{
+		DeploymentGroupInfo: &codedeploy.DeploymentGroupInfo{
+			LoadBalancerInfo: &codedeploy.LoadBalancerInfo{
+				TargetGroupPairInfoList: []*codedeploy.TargetGroupPairInfo{{
+					TargetGroups: []*codedeploy.TargetGroupInfo{
+						{Name: aws.String("aaa")},
+						{Name: aws.String("aaa-green")},
+					},
+					ProdTrafficRoute: &codedeploy.TrafficRoute{ListenerArns: []*string{aws.String("arn://listener")}},
+				}},
+			},
+		},
+	}, nil)
+	albMock.EXPECT().DescribeListeners(gomock.Any()).Return(&elbv2.DescribeListenersOutput{
+		Listeners: []*elbv2.Listener{{
+			ListenerArn: aws.String("arn://listener"),
+			DefaultActions: []*elbv2.Action{{
+				Type:           aws.String("forward"),
+				TargetGroupArn: liveTargetGroupArn,
+			}},
+		}},
+	}, nil)
+}
+
+func TestCage_RollOut_CodeDeploy(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	service, _ := mctx.GetService(envars.Service)
+	service.DeploymentController = &ecs.DeploymentController{Type: aws.String(ecs.DeploymentControllerTypeCodeDeploy)}
+	cdMock := setupCodeDeploy(t, ctrl, envars,
+		codedeploy.DeploymentStatusCreated,
+		codedeploy.DeploymentStatusInProgress,
+		codedeploy.DeploymentStatusSucceeded,
+	)
+	setupDeploymentGroup(cdMock, albMock, envars.ServiceDefinitionInput.LoadBalancers[0].TargetGroupArn)
+	cagecli := NewCage(&Input{
+		Env:        envars,
+		ECS:        ecsMock,
+		ALB:        albMock,
+		EC2:        ec2Mock,
+		CodeDeploy: cdMock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.False(t, result.ServiceIntact)
+	assert.False(t, result.RolledBack)
+	assert.Equal(t, "d-1", result.CodeDeployDeploymentId)
+	assert.Equal(t, codedeploy.DeploymentStatusSucceeded, result.CodeDeployStatus)
+	// サービスはCodeDeployが更新するのでcageは更新しない
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
+
+func TestCage_RollOut_CodeDeployFailed(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	service, _ := mctx.GetService(envars.Service)
+	service.DeploymentController = &ecs.DeploymentController{Type: aws.String(ecs.DeploymentControllerTypeCodeDeploy)}
+	cdMock := setupCodeDeploy(t, ctrl, envars,
+		codedeploy.DeploymentStatusInProgress,
+		codedeploy.DeploymentStatusFailed,
+	)
+	setupDeploymentGroup(cdMock, albMock, envars.ServiceDefinitionInput.LoadBalancers[0].TargetGroupArn)
+	expectGetDeployment(cdMock, "d-2", codedeploy.DeploymentStatusInProgress, codedeploy.DeploymentStatusSucceeded)
+	cagecli := NewCage(&Input{
+		Env:        envars,
+		ECS:        ecsMock,
+		ALB:        albMock,
+		EC2:        ec2Mock,
+		CodeDeploy: cdMock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.NotNil(t, err)
+	assert.False(t, result.ServiceIntact)
+	assert.True(t, result.RolledBack)
+	assert.Equal(t, codedeploy.DeploymentStatusFailed, result.CodeDeployStatus)
+}
+
+func TestCage_RollOut_CodeDeployRollbackFailed(t *testing.T) {
+	// ロールバックのデプロイが成功しなければロールバックされたことにしない
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	service, _ := mctx.GetService(envars.Service)
+	service.DeploymentController = &ecs.DeploymentController{Type: aws.String(ecs.DeploymentControllerTypeCodeDeploy)}
+	cdMock := setupCodeDeploy(t, ctrl, envars, codedeploy.DeploymentStatusFailed)
+	setupDeploymentGroup(cdMock, albMock, envars.ServiceDefinitionInput.LoadBalancers[0].TargetGroupArn)
+	expectGetDeployment(cdMock, "d-2", codedeploy.DeploymentStatusInProgress, codedeploy.DeploymentStatusFailed)
+	cagecli := NewCage(&Input{
+		Env:        envars,
+		ECS:        ecsMock,
+		ALB:        albMock,
+		EC2:        ec2Mock,
+		CodeDeploy: cdMock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.Contains(t, err.Error(), "rollback deployment 'd-2' has Failed")
+	assert.Equal(t, ErrorKindServiceUpdate, KindOf(err))
+	assert.False(t, result.RolledBack)
+	assert.Equal(t, codedeploy.DeploymentStatusFailed, result.CodeDeployStatus)
+}
+
+func TestCage_RollOut_CodeDeployTimeout(t *testing.T) {
+	// 時間内に終わらなければデプロイを止めてロールバックする
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.CodeDeployTimeout = time.Minute
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	service, _ := mctx.GetService(envars.Service)
+	service.DeploymentController = &ecs.DeploymentController{Type: aws.String(ecs.DeploymentControllerTypeCodeDeploy)}
+	cdMock := setupCodeDeploy(t, ctrl, envars,
+		codedeploy.DeploymentStatusInProgress,
+		codedeploy.DeploymentStatusInProgress,
+		codedeploy.DeploymentStatusInProgress,
+		codedeploy.DeploymentStatusInProgress,
+	)
+	setupDeploymentGroup(cdMock, albMock, envars.ServiceDefinitionInput.LoadBalancers[0].TargetGroupArn)
+	cdMock.EXPECT().StopDeployment(gomock.Any()).DoAndReturn(func(input *codedeploy.StopDeploymentInput) (*codedeploy.StopDeploymentOutput, error) {
+		assert.Equal(t, "d-1", *input.DeploymentId)
+		assert.True(t, *input.AutoRollbackEnabled)
+		return &codedeploy.StopDeploymentOutput{Status: aws.String(codedeploy.StopStatusPending)}, nil
+	})
+	cagecli := NewCage(&Input{
+		Env:        envars,
+		ECS:        ecsMock,
+		ALB:        albMock,
+		EC2:        ec2Mock,
+		CodeDeploy: cdMock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.Contains(t, err.Error(), "deployment 'd-1' didn't complete in 1m0s")
+	assert.False(t, result.ServiceIntact)
+	assert.False(t, result.RolledBack)
+	assert.Equal(t, codedeploy.DeploymentStatusInProgress, result.CodeDeployStatus)
+}
+
+func TestCage_RollOut_CodeDeployGreenTargetGroup(t *testing.T) {
+	// サービスのターゲットグループが待機中の場合は本番のターゲットグループに登録する
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	service, _ := mctx.GetService(envars.Service)
+	service.DeploymentController = &ecs.DeploymentController{Type: aws.String(ecs.DeploymentControllerTypeCodeDeploy)}
+	cdMock := setupCodeDeploy(t, ctrl, envars, codedeploy.DeploymentStatusSucceeded)
+	setupDeploymentGroup(cdMock, albMock, aws.String("aaaa/targetgroup/aaa-green/ccc"))
+	cagecli := NewCage(&Input{
+		Env:        envars,
+		ECS:        ecsMock,
+		ALB:        albMock,
+		EC2:        ec2Mock,
+		CodeDeploy: cdMock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(t, "aaaa/targetgroup/aaa-green/ccc", result.CanaryTasks[0].Targets[0].TargetGroupArn)
+}
+
+func TestCage_RollOut_CodeDeployCancelled(t *testing.T) {
+	// キャンセルされたらデプロイを止めてロールバックする
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	service, _ := mctx.GetService(envars.Service)
+	service.DeploymentController = &ecs.DeploymentController{Type: aws.String(ecs.DeploymentControllerTypeCodeDeploy)}
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	cdMock := mock_codedeployiface.NewMockCodeDeployAPI(ctrl)
+	setupDeploymentGroup(cdMock, albMock, envars.ServiceDefinitionInput.LoadBalancers[0].TargetGroupArn)
+	cdMock.EXPECT().CreateDeployment(gomock.Any()).Return(&codedeploy.CreateDeploymentOutput{DeploymentId: aws.String("d-1")}, nil)
+	cdMock.EXPECT().GetDeployment(gomock.Any()).DoAndReturn(func(input *codedeploy.GetDeploymentInput) (*codedeploy.GetDeploymentOutput, error) {
+		cancel()
+		return &codedeploy.GetDeploymentOutput{DeploymentInfo: &codedeploy.DeploymentInfo{
+			DeploymentId: aws.String("d-1"),
+			Status:       aws.String(codedeploy.DeploymentStatusInProgress),
+		}}, nil
+	})
+	cdMock.EXPECT().StopDeployment(gomock.Any()).DoAndReturn(func(input *codedeploy.StopDeploymentInput) (*codedeploy.StopDeploymentOutput, error) {
+		assert.Equal(t, "d-1", *input.DeploymentId)
+		assert.True(t, *input.AutoRollbackEnabled)
+		return &codedeploy.StopDeploymentOutput{Status: aws.String(codedeploy.StopStatusPending)}, nil
+	})
+	cagecli := NewCage(&Input{
+		Env:        envars,
+		ECS:        ecsMock,
+		ALB:        albMock,
+		EC2:        ec2Mock,
+		CodeDeploy: cdMock,
+	})
+	result, err := cagecli.RollOut(ctx)
+	assert.NotNil(t, err)
+	assert.False(t, result.ServiceIntact)
+}
+
+func TestCage_RollOut_CodeDeployCreateFailed(t *testing.T) {
+	// デプロイが作られなかった場合はサービスは変わっていない
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	service, _ := mctx.GetService(envars.Service)
+	service.DeploymentController = &ecs.DeploymentController{Type: aws.String(ecs.DeploymentControllerTypeCodeDeploy)}
+	cdMock := mock_codedeployiface.NewMockCodeDeployAPI(ctrl)
+	setupDeploymentGroup(cdMock, albMock, envars.ServiceDefinitionInput.LoadBalancers[0].TargetGroupArn)
+	cdMock.EXPECT().CreateDeployment(gomock.Any()).Return(nil, errors.New("DeploymentLimitExceededException"))
+	cagecli := NewCage(&Input{
+		Env:        envars,
+		ECS:        ecsMock,
+		ALB:        albMock,
+		EC2:        ec2Mock,
+		CodeDeploy: cdMock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.Equal(t, ErrorKindCanary, KindOf(err))
+	assert.True(t, result.ServiceIntact)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
+
+func TestCage_RollOut_CodeDeployWithoutClient(t *testing.T) {
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 1, "FARGATE")
+	service, _ := mctx.GetService(envars.Service)
+	service.DeploymentController = &ecs.DeploymentController{Type: aws.String(ecs.DeploymentControllerTypeCodeDeploy)}
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.NotNil(t, err)
+	assert.True(t, result.ServiceIntact)
+	assert.Equal(t, int64(1), mctx.TaskSize())
+}
@@ -2,11 +2,10 @@ package cage
 
 import (
 	"encoding/json"
-	"fmt"
-	"github.com/apex/log"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"os"
 	"path/filepath"
+	"time"
 )
 
 type Envars struct {
@@ -18,6 +17,33 @@ type Envars struct {
 	TaskDefinitionArn      string `json:"nextTaskDefinitionArn" type:"string"`
 	TaskDefinitionInput    *ecs.RegisterTaskDefinitionInput
 	ServiceDefinitionInput *ecs.CreateServiceInput
+	AvailabilityThreshold  float64       `json:"availabilityThreshold" type:"double"`
+	ResponseTimeThreshold  float64       `json:"responseTimeThreshold" type:"double"`
+	AnalysisPeriod         int64         `json:"analysisPeriod" type:"integer"`
+	CanaryCount            int64         `json:"canaryCount" type:"integer"`
+	CanaryPercentage       int64         `json:"canaryPercentage" type:"integer"`
+	CanarySoakDuration     time.Duration `json:"canarySoakDuration" type:"integer"`
+	// canary tasks must keep running for the duration after they become healthy
+	CanaryMinUptime      time.Duration `json:"canaryMinUptime" type:"integer"`
+	TrafficShiftSteps    []int64       `json:"trafficShiftSteps" type:"list"`
+	TrafficShiftBakeTime time.Duration `json:"trafficShiftBakeTime" type:"integer"`
+	CanaryTargetGroupArn string        `json:"canaryTargetGroupArn" type:"string"`
+	// CodeDeploy application and deployment group for services with CODE_DEPLOY deployment controller
+	CodeDeployApplication     string `json:"codeDeployApplication" type:"string"`
+	CodeDeployDeploymentGroup string `json:"codeDeployDeploymentGroup" type:"string"`
+	// timeout for each of the deployment and its rollback to complete. default: 1h
+	CodeDeployTimeout time.Duration `json:"codeDeployTimeout" type:"integer"`
+	// HTTP requests sent directly to canary tasks. loaded from probes.json
+	Probes []*Probe `json:"probes" type:"list"`
+	// rolling out fails if approval is not given in time. 0 means no timeout
+	ApprovalTimeout time.Duration `json:"approvalTimeout" type:"integer"`
+	// timeout for canary tasks without load balancer to become healthy by container health checks. default: 5m
+	ContainerHealthCheckTimeout time.Duration `json:"containerHealthCheckTimeout" type:"integer"`
+	// interval of polling health state of canary tasks in target groups. default: health check interval of the target group
+	TargetHealthCheckInterval time.Duration `json:"targetHealthCheckInterval" type:"integer"`
+	// timeout for canary tasks to become healthy in target groups.
+	// default: health check interval × healthy threshold count of the target group plus health check grace period of the service
+	TargetHealthCheckTimeout time.Duration `json:"targetHealthCheckTimeout" type:"integer"`
 }
 
 // required
@@ -30,6 +56,30 @@ const TaskDefinitionArnKey = "CAGE_TASK_DEFINITION_ARN"
 // optional
 const CanaryInstanceArnKey = "CAGE_CANARY_INSTANCE_ARN"
 const RegionKey = "CAGE_REGION"
+const AvailabilityThresholdKey = "CAGE_AVAILABILITY_THRESHOLD"
+const ResponseTimeThresholdKey = "CAGE_RESPONSE_TIME_THRESHOLD"
+const AnalysisPeriodKey = "CAGE_ANALYSIS_PERIOD"
+const CanaryCountKey = "CAGE_CANARY_COUNT"
+const CanaryPercentageKey = "CAGE_CANARY_PERCENTAGE"
+const CanarySoakDurationKey = "CAGE_CANARY_SOAK_DURATION"
+const CanaryMinUptimeKey = "CAGE_CANARY_MIN_UPTIME"
+const TrafficShiftStepsKey = "CAGE_TRAFFIC_SHIFT_STEPS"
+const TrafficShiftBakeTimeKey = "CAGE_TRAFFIC_SHIFT_BAKE_TIME"
+const CanaryTargetGroupArnKey = "CAGE_CANARY_TARGET_GROUP_ARN"
+const CodeDeployApplicationKey = "CAGE_CODE_DEPLOY_APPLICATION"
+const CodeDeployDeploymentGroupKey = "CAGE_CODE_DEPLOY_DEPLOYMENT_GROUP"
+const CodeDeployTimeoutKey = "CAGE_CODE_DEPLOY_TIMEOUT"
+const ApproveKey = "CAGE_APPROVE"
+const ApprovalFileKey = "CAGE_APPROVAL_FILE"
+const ApprovalAddrKey = "CAGE_APPROVAL_ADDR"
+const ApprovalTimeoutKey = "CAGE_APPROVAL_TIMEOUT"
+const ContainerHealthCheckTimeoutKey = "CAGE_CONTAINER_HEALTH_CHECK_TIMEOUT"
+const TargetHealthCheckIntervalKey = "CAGE_TARGET_HEALTH_CHECK_INTERVAL"
+const TargetHealthCheckTimeoutKey = "CAGE_TARGET_HEALTH_CHECK_TIMEOUT"
+const OutputKey = "CAGE_OUTPUT"
+
+// default period in seconds for analyzing metrics of canary task
+const DefaultAnalysisPeriod = 60
 
 func EnsureEnvars(
 	dest *Envars,
@@ -43,8 +93,60 @@ func EnsureEnvars(
 	if dest.TaskDefinitionArn == "" && dest.TaskDefinitionInput == nil {
 		return NewErrorf("--nextTaskDefinitionArn or deploy context must be provided")
 	}
+	if dest.AvailabilityThreshold < 0 || dest.AvailabilityThreshold > 1 {
+		return NewErrorf("--availabilityThreshold [%s] must be between 0 and 1", AvailabilityThresholdKey)
+	}
+	if dest.ResponseTimeThreshold < 0 {
+		return NewErrorf("--responseTimeThreshold [%s] must not be negative", ResponseTimeThresholdKey)
+	}
+	if dest.AnalysisPeriod < 0 || dest.AnalysisPeriod%60 != 0 {
+		return NewErrorf("--analysisPeriod [%s] must be a multiple of 60", AnalysisPeriodKey)
+	}
+	if dest.CanaryCount < 0 {
+		return NewErrorf("--canaryCount [%s] must not be negative", CanaryCountKey)
+	}
+	if dest.CanaryPercentage < 0 || dest.CanaryPercentage > 100 {
+		return NewErrorf("--canaryPercentage [%s] must be between 0 and 100", CanaryPercentageKey)
+	}
+	if dest.CanaryCount > 0 && dest.CanaryPercentage > 0 {
+		return NewErrorf("--canaryCount and --canaryPercentage can't be specified at once")
+	}
+	if dest.CanarySoakDuration < 0 {
+		return NewErrorf("--canarySoakDuration [%s] must not be negative", CanarySoakDurationKey)
+	}
+	if dest.CanaryMinUptime < 0 {
+		return NewErrorf("--canaryMinUptime [%s] must not be negative", CanaryMinUptimeKey)
+	}
+	for i, step := range dest.TrafficShiftSteps {
+		if step <= 0 || step > 100 {
+			return NewErrorf("--trafficShiftSteps [%s] must be percentages between 1 and 100", TrafficShiftStepsKey)
+		} else if i > 0 && step <= dest.TrafficShiftSteps[i-1] {
+			return NewErrorf("--trafficShiftSteps [%s] must be in ascending order", TrafficShiftStepsKey)
+		}
+	}
+	if dest.TrafficShiftBakeTime < 0 {
+		return NewErrorf("--trafficShiftBakeTime [%s] must not be negative", TrafficShiftBakeTimeKey)
+	}
+	if dest.CodeDeployTimeout < 0 {
+		return NewErrorf("--codeDeployTimeout [%s] must not be negative", CodeDeployTimeoutKey)
+	}
+	if dest.ApprovalTimeout < 0 {
+		return NewErrorf("--approvalTimeout [%s] must not be negative", ApprovalTimeoutKey)
+	}
+	if dest.ContainerHealthCheckTimeout < 0 {
+		return NewErrorf("--containerHealthCheckTimeout [%s] must not be negative", ContainerHealthCheckTimeoutKey)
+	}
+	if dest.TargetHealthCheckInterval < 0 {
+		return NewErrorf("--targetHealthCheckInterval [%s] must not be negative", TargetHealthCheckIntervalKey)
+	}
+	if dest.TargetHealthCheckTimeout < 0 {
+		return NewErrorf("--targetHealthCheckTimeout [%s] must not be negative", TargetHealthCheckTimeoutKey)
+	}
+	if err := ValidateProbes(dest.Probes); err != nil {
+		return err
+	}
 	if dest.Region == "" {
-		log.Fatalf("region must be specified. set --region flag or see also https://docs.aws.amazon.com/sdk-for-go/v1/developer-guide/configuring-sdk.html")
+		return NewErrorf("region must be specified. set --region flag or see also https://docs.aws.amazon.com/sdk-for-go/v1/developer-guide/configuring-sdk.html")
 	}
 	return nil
 }
@@ -61,13 +163,13 @@ func LoadDefinitionsFromFiles(dir string) (
 	var service ecs.CreateServiceInput
 	var td ecs.RegisterTaskDefinitionInput
 	if noSvc != nil || noTd != nil {
-		return nil, nil, fmt.Errorf("roll out context specified at '%s' but no 'service.json' or 'task-definition.json'", dir)
+		return nil, nil, NewErrorf("roll out context specified at '%s' but no 'service.json' or 'task-definition.json'", dir)
 	}
 	if _, err := ReadAndUnmarshalJson(svcPath, &service); err != nil {
-		return nil, nil, fmt.Errorf("failed to read and unmarshal service.json: %s", err)
+		return nil, nil, NewErrorf("failed to read and unmarshal service.json: %s", err)
 	}
 	if _, err := ReadAndUnmarshalJson(tdPath, &td); err != nil {
-		return nil, nil, fmt.Errorf("failed to read and unmarshal task-definition.json: %s", err)
+		return nil, nil, NewErrorf("failed to read and unmarshal task-definition.json: %s", err)
 	}
 	return &td, &service, nil
 }
@@ -94,6 +196,60 @@ func MergeEnvars(dest *Envars, src *Envars) {
 	if src.ServiceDefinitionInput != nil {
 		dest.ServiceDefinitionInput = src.ServiceDefinitionInput
 	}
+	if src.AvailabilityThreshold != 0 {
+		dest.AvailabilityThreshold = src.AvailabilityThreshold
+	}
+	if src.ResponseTimeThreshold != 0 {
+		dest.ResponseTimeThreshold = src.ResponseTimeThreshold
+	}
+	if src.AnalysisPeriod != 0 {
+		dest.AnalysisPeriod = src.AnalysisPeriod
+	}
+	if src.CanaryCount != 0 {
+		dest.CanaryCount = src.CanaryCount
+	}
+	if src.CanaryPercentage != 0 {
+		dest.CanaryPercentage = src.CanaryPercentage
+	}
+	if src.CanarySoakDuration != 0 {
+		dest.CanarySoakDuration = src.CanarySoakDuration
+	}
+	if src.CanaryMinUptime != 0 {
+		dest.CanaryMinUptime = src.CanaryMinUptime
+	}
+	if src.TrafficShiftSteps != nil {
+		dest.TrafficShiftSteps = src.TrafficShiftSteps
+	}
+	if src.TrafficShiftBakeTime != 0 {
+		dest.TrafficShiftBakeTime = src.TrafficShiftBakeTime
+	}
+	if src.CanaryTargetGroupArn != "" {
+		dest.CanaryTargetGroupArn = src.CanaryTargetGroupArn
+	}
+	if src.CodeDeployApplication != "" {
+		dest.CodeDeployApplication = src.CodeDeployApplication
+	}
+	if src.CodeDeployDeploymentGroup != "" {
+		dest.CodeDeployDeploymentGroup = src.CodeDeployDeploymentGroup
+	}
+	if src.CodeDeployTimeout != 0 {
+		dest.CodeDeployTimeout = src.CodeDeployTimeout
+	}
+	if src.Probes != nil {
+		dest.Probes = src.Probes
+	}
+	if src.ApprovalTimeout != 0 {
+		dest.ApprovalTimeout = src.ApprovalTimeout
+	}
+	if src.ContainerHealthCheckTimeout != 0 {
+		dest.ContainerHealthCheckTimeout = src.ContainerHealthCheckTimeout
+	}
+	if src.TargetHealthCheckInterval != 0 {
+		dest.TargetHealthCheckInterval = src.TargetHealthCheckInterval
+	}
+	if src.TargetHealthCheckTimeout != 0 {
+		dest.TargetHealthCheckTimeout = src.TargetHealthCheckTimeout
+	}
 }
 
 func ReadAndUnmarshalJson(path string, dest interface{}) ([]byte, error) {
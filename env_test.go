@@ -39,6 +39,37 @@ func TestEnsureEnvars(t *testing.T) {
 			t.Fatalf(err.Error())
 		}
 	})
+	t.Run("should return err if options are invalid", func(t *testing.T) {
+		for _, e := range []*Envars{
+			{AvailabilityThreshold: 1.1},
+			{ResponseTimeThreshold: -1},
+			{AnalysisPeriod: 90},
+			{CanaryCount: 2, CanaryPercentage: 10},
+			{TrafficShiftSteps: []int64{0, 50}},
+			{TrafficShiftSteps: []int64{50, 25}},
+			{TrafficShiftSteps: []int64{50, 150}},
+			{Probes: []*Probe{{Path: "health_check"}}},
+			{Probes: []*Probe{{Path: "/", BodyRegex: "("}}},
+		} {
+			e.Region = "us-west-2"
+			e.Cluster = "cluster"
+			e.Service = "next"
+			e.TaskDefinitionArn = "arn://aaa"
+			if err := EnsureEnvars(e); err == nil {
+				t.Fatalf("should return error for %+v", e)
+			}
+		}
+	})
+	t.Run("should return err if region is not defined", func(t *testing.T) {
+		e := &Envars{
+			Cluster:           "cluster",
+			Service:           "next",
+			TaskDefinitionArn: "arn://aaa",
+		}
+		err := EnsureEnvars(e)
+		assert.NotNil(t, err)
+		assert.Equal(t, ErrorKindInvalidInput, KindOf(err))
+	})
 	t.Run("should return err if required props are not defined", func(t *testing.T) {
 		dummy := "aaa"
 		arr := []string{
@@ -0,0 +1,57 @@
+package cage
+
+import (
+	"errors"
+)
+
+// class of failure that tells how far rolling out proceeded
+type ErrorKind string
+
+const (
+	// invalid envars, flags or definition files. nothing was changed
+	ErrorKindInvalidInput ErrorKind = "invalid_input"
+	// failed before starting canary tasks or creating the service,
+	// e.g. describing the service, registering next task definition or creating the service
+	ErrorKindPreflight ErrorKind = "preflight"
+	// canary tasks failed to start or to be verified, or updating the service failed before changing it.
+	// the service was not updated
+	ErrorKindCanary ErrorKind = "canary"
+	// failed while or after updating the service. it may have been rolled back
+	ErrorKindServiceUpdate ErrorKind = "service_update"
+	// failed to stop canary tasks. they may be left running
+	ErrorKindCleanup ErrorKind = "cleanup"
+)
+
+// error returned from the cage library instead of exiting the process
+type Error struct {
+	Kind ErrorKind
+	// whether the service was left as it was before rolling out
+	ServiceIntact bool
+	Err           error
+}
+
+func (e *Error) Error() string {
+	return e.Err.Error()
+}
+
+func (e *Error) Unwrap() error {
+	return e.Err
+}
+
+// wrap err unless it is already classified
+func newError(kind ErrorKind, serviceIntact bool, err error) *Error {
+	var ret *Error
+	if errors.As(err, &ret) {
+		return ret
+	}
+	return &Error{Kind: kind, ServiceIntact: serviceIntact, Err: err}
+}
+
+// kind of the error. empty if it is not returned from the cage library
+func KindOf(err error) ErrorKind {
+	var e *Error
+	if errors.As(err, &e) {
+		return e.Kind
+	}
+	return ""
+}
@@ -0,0 +1,18 @@
+package cage
+
+import (
+	"errors"
+	"fmt"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestNewError(t *testing.T) {
+	err := newError(ErrorKindCanary, true, errors.New("canary task is unhealthy"))
+	assert.Equal(t, ErrorKindCanary, KindOf(err))
+	assert.Equal(t, "canary task is unhealthy", err.Error())
+	// 分類済みのエラーはそのまま
+	assert.Equal(t, ErrorKindInvalidInput, KindOf(newError(ErrorKindPreflight, true, NewErrorf("invalid"))))
+	assert.Equal(t, ErrorKindCanary, KindOf(fmt.Errorf("wrapped: %w", err)))
+	assert.Equal(t, ErrorKind(""), KindOf(errors.New("unknown")))
+}
@@ -0,0 +1,87 @@
+package cage
+
+import (
+	"context"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"math"
+	"time"
+)
+
+// default timeout for canary task to become healthy by container health checks
+const DefaultContainerHealthCheckTimeout = time.Duration(5) * time.Minute
+
+// essential containers of the task definition with health check
+func HealthCheckedContainers(taskDefinition *ecs.TaskDefinition) []string {
+	var ret []string
+	for _, container := range taskDefinition.ContainerDefinitions {
+		if container.HealthCheck == nil || len(container.HealthCheck.Command) == 0 {
+			continue
+		}
+		// containers are essential by default
+		if container.Essential != nil && !*container.Essential {
+			continue
+		}
+		ret = append(ret, *container.Name)
+	}
+	return ret
+}
+
+// wait until health status of the task and its essential containers with health check become HEALTHY.
+// it fails immediately if any of them becomes UNHEALTHY or the task stops
+func (c *cage) EnsureContainersHealthy(ctx context.Context, canaryTask *StartCanaryTaskOutput, containers []string) error {
+	taskArn := canaryTask.task.TaskArn
+	interval := time.Duration(10) * time.Second
+	timeout := c.env.ContainerHealthCheckTimeout
+	if timeout == 0 {
+		timeout = DefaultContainerHealthCheckTimeout
+	}
+	var previousStatus string
+	for count := 0; count < int(math.Ceil(float64(timeout)/float64(interval))); count++ {
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+		var task *ecs.Task
+		if o, err := c.ecs.DescribeTasks(&ecs.DescribeTasksInput{
+			Cluster: &c.env.Cluster,
+			Tasks:   []*string{taskArn},
+		}); err != nil {
+			return err
+		} else if len(o.Tasks) == 0 {
+			return fmt.Errorf("canary task '%s' was not found", *taskArn)
+		} else {
+			task = o.Tasks[0]
+		}
+		if aws.StringValue(task.LastStatus) == ecs.DesiredStatusStopped {
+			return fmt.Errorf("canary task '%s' has stopped: %s", *taskArn, StoppedReason(task))
+		}
+		log.Infof("canary task '%s' health status is: %s", *taskArn, aws.StringValue(task.HealthStatus))
+		canaryTask.healthStatus = aws.StringValue(task.HealthStatus)
+		if status := aws.StringValue(task.HealthStatus); status != previousStatus {
+			c.emit(&Event{Type: EventCanaryTaskHealthStateChanged, TaskArn: *taskArn, HealthState: status})
+			previousStatus = status
+		}
+		healthy := aws.StringValue(task.HealthStatus) == ecs.HealthStatusHealthy
+		for _, name := range containers {
+			status := ecs.HealthStatusUnknown
+			for _, container := range task.Containers {
+				if aws.StringValue(container.Name) == name && container.HealthStatus != nil {
+					status = *container.HealthStatus
+				}
+			}
+			if status == ecs.HealthStatusUnhealthy {
+				return fmt.Errorf("container '%s' of canary task '%s' is unhealthy", name, *taskArn)
+			} else if status != ecs.HealthStatusHealthy {
+				healthy = false
+			}
+		}
+		if aws.StringValue(task.HealthStatus) == ecs.HealthStatusUnhealthy {
+			return fmt.Errorf("canary task '%s' is unhealthy", *taskArn)
+		} else if healthy {
+			return nil
+		}
+	}
+	return fmt.Errorf("canary task '%s' didn't become healthy in %s", *taskArn, timeout)
+}
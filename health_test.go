@@ -0,0 +1,82 @@
+package cage
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/golang/mock/gomock"
+	"github.com/loilo-inc/canarycage/mocks/github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/stretchr/testify/assert"
+	"regexp"
+	"testing"
+	"time"
+)
+
+func TestHealthCheckedContainers(t *testing.T) {
+	healthCheck := &ecs.HealthCheck{Command: aws.StringSlice([]string{"CMD-SHELL", "exit 0"})}
+	td := &ecs.TaskDefinition{
+		ContainerDefinitions: []*ecs.ContainerDefinition{
+			{Name: aws.String("app"), HealthCheck: healthCheck},
+			{Name: aws.String("essential"), Essential: aws.Bool(true), HealthCheck: healthCheck},
+			{Name: aws.String("sidecar"), Essential: aws.Bool(false), HealthCheck: healthCheck},
+			{Name: aws.String("log-router")},
+		},
+	}
+	assert.Equal(t, []string{"app", "essential"}, HealthCheckedContainers(td))
+}
+
+func TestCage_RollOut_ContainerHealthCheck(t *testing.T) {
+	// lbがない場合はコンテナのhealth checkを待つ
+	newTimer = fakeTimer
+	defer recoverTimer()
+	for _, v := range []struct {
+		status string
+		err    string
+	}{
+		{status: "HEALTHY"},
+		{status: "UNHEALTHY", err: "is unhealthy"},
+		{status: "UNKNOWN", err: "didn't become healthy in 1m0s"},
+	} {
+		envars := DefaultEnvars()
+		envars.ServiceDefinitionInput.LoadBalancers = nil
+		envars.ContainerHealthCheckTimeout = time.Minute
+		ctrl := gomock.NewController(t)
+		mocker, ecsMock, _, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+		mocker.ContainerHealthStatus = v.status
+		cagecli := NewCage(&Input{
+			Env: envars,
+			ECS: ecsMock,
+			ALB: mock_elbv2iface.NewMockELBV2API(ctrl),
+			EC2: ec2Mock,
+		})
+		result, err := cagecli.RollOut(context.Background())
+		if v.err == "" {
+			assert.Nil(t, err)
+			assert.False(t, result.ServiceIntact)
+		} else {
+			assert.NotNil(t, err)
+			assert.True(t, regexp.MustCompile(v.err).MatchString(err.Error()), err.Error())
+			assert.True(t, result.ServiceIntact)
+		}
+		assert.Equal(t, int64(2), mocker.TaskSize())
+		ctrl.Finish()
+	}
+}
+
+func TestCage_EnsureContainersHealthy_Stopped(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mocker, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 1, "FARGATE")
+	mocker.ContainerHealthStatus = "UNKNOWN"
+	cagecli := &cage{env: envars, ecs: ecsMock, alb: albMock, ec2: ec2Mock}
+	for _, task := range mocker.Tasks {
+		task.LastStatus = aws.String("STOPPED")
+		task.StoppedReason = aws.String("Essential container in task exited")
+		err := cagecli.EnsureContainersHealthy(context.Background(), &StartCanaryTaskOutput{task: task}, []string{"container"})
+		assert.NotNil(t, err)
+		assert.True(t, regexp.MustCompile("Essential container in task exited").MatchString(err.Error()))
+	}
+}
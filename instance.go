@@ -0,0 +1,440 @@
+package cage
+
+import (
+	"fmt"
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// where a canary task is placed
+type canaryPlacement struct {
+	// container instance to start canary task on. empty for Fargate and capacity providers
+	instanceArn          string
+	networkConfiguration *ecs.NetworkConfiguration
+}
+
+// decide network configuration and container instance of each canary task before starting them.
+// container instances are resolved for EC2 launch type or if --canaryInstanceArn is specified.
+// auto selected instances are not written back to envars so that they are selected again on next rolling out
+func (c *cage) PlanCanaryPlacements(
+	service *ecs.Service,
+	nextTaskDefinition *ecs.TaskDefinition,
+	count int64,
+) ([]*canaryPlacement, error) {
+	networkConfigurations, err := c.SpreadNetworkConfiguration(service.NetworkConfiguration, count)
+	if err != nil {
+		return nil, err
+	}
+	ret := make([]*canaryPlacement, count)
+	for i := range ret {
+		ret[i] = &canaryPlacement{networkConfiguration: networkConfigurations[i]}
+	}
+	if aws.StringValue(service.LaunchType) != ecs.LaunchTypeEc2 && c.env.CanaryInstanceArn == "" {
+		return ret, nil
+	}
+	// subnets of awsvpc configuration must be in the same availability zone as the instance
+	var subnets *subnetZones
+	if base := service.NetworkConfiguration; base != nil && base.AwsvpcConfiguration != nil && len(base.AwsvpcConfiguration.Subnets) > 0 {
+		if subnets, err = c.DescribeSubnetZones(base.AwsvpcConfiguration.Subnets); err != nil {
+			return nil, err
+		}
+	}
+	if c.env.CanaryInstanceArn != "" {
+		err = c.placeOnCanaryInstance(service, nextTaskDefinition, ret, subnets)
+	} else {
+		err = c.SelectCanaryInstances(service, nextTaskDefinition, ret, subnets)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+// resolve container instance specified by --canaryInstanceArn, which may be EC2 instance ID
+func (c *cage) ResolveCanaryInstance() (string, error) {
+	if strings.HasPrefix(c.env.CanaryInstanceArn, "i-") {
+		return c.ResolveContainerInstanceArn(c.env.CanaryInstanceArn)
+	}
+	return c.env.CanaryInstanceArn, nil
+}
+
+// all canary tasks are placed on the instance specified by --canaryInstanceArn
+func (c *cage) placeOnCanaryInstance(
+	service *ecs.Service,
+	nextTaskDefinition *ecs.TaskDefinition,
+	placements []*canaryPlacement,
+	subnets *subnetZones,
+) error {
+	arn, err := c.ResolveCanaryInstance()
+	if err != nil {
+		return err
+	}
+	required, err := taskResources(nextTaskDefinition)
+	if err != nil {
+		return err
+	}
+	if len(placements) > 1 && (len(required.ports) > 0 || len(required.udpPorts) > 0) {
+		return fmt.Errorf(
+			"🥺 %d canary tasks can't be placed on container instance '%s' as they use static host ports %v",
+			len(placements), arn, append(required.ports, required.udpPorts...),
+		)
+	}
+	zone := ""
+	if subnets != nil {
+		if o, err := c.ecs.DescribeContainerInstances(&ecs.DescribeContainerInstancesInput{
+			Cluster:            &c.env.Cluster,
+			ContainerInstances: []*string{&arn},
+		}); err != nil {
+			return err
+		} else if len(o.ContainerInstances) > 0 {
+			zone = instanceAttribute(o.ContainerInstances[0], "ecs.availability-zone")
+		}
+	}
+	for i, v := range placements {
+		v.instanceArn = arn
+		if zone != "" {
+			if v.networkConfiguration, err = subnets.networkConfiguration(service.NetworkConfiguration, zone, i); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// find container instance of the EC2 instance in the cluster
+func (c *cage) ResolveContainerInstanceArn(instanceId string) (string, error) {
+	if o, err := c.ecs.ListContainerInstances(&ecs.ListContainerInstancesInput{
+		Cluster: &c.env.Cluster,
+		Filter:  aws.String(fmt.Sprintf("ec2InstanceId == %s", instanceId)),
+	}); err != nil {
+		return "", err
+	} else if len(o.ContainerInstanceArns) == 0 {
+		return "", fmt.Errorf("🥺 EC2 instance '%s' is not registered to cluster '%s'", instanceId, c.env.Cluster)
+	} else {
+		return *o.ContainerInstanceArns[0], nil
+	}
+}
+
+// select ACTIVE container instance for each canary task that has enough resources left by former canary tasks
+// and satisfies placement constraints.
+// instances in availability zones where tasks of the service are running are preferred, and canary tasks are
+// spread across availability zones. for awsvpc, instances are selected in the availability zone of the subnet
+// assigned to the canary task if possible, otherwise the subnet is replaced with one in the zone of the instance
+func (c *cage) SelectCanaryInstances(
+	service *ecs.Service,
+	nextTaskDefinition *ecs.TaskDefinition,
+	placements []*canaryPlacement,
+	subnets *subnetZones,
+) error {
+	var arns []*string
+	input := &ecs.ListContainerInstancesInput{
+		Cluster: &c.env.Cluster,
+		Status:  aws.String(ecs.ContainerInstanceStatusActive),
+	}
+	if filter := PlacementConstraintsFilter(service, nextTaskDefinition); filter != "" {
+		input.Filter = &filter
+	}
+	for {
+		o, err := c.ecs.ListContainerInstances(input)
+		if err != nil {
+			return err
+		}
+		arns = append(arns, o.ContainerInstanceArns...)
+		if o.NextToken == nil {
+			break
+		}
+		input.NextToken = o.NextToken
+	}
+	if len(arns) == 0 {
+		return fmt.Errorf("🥺 no ACTIVE container instance satisfies placement constraints in cluster '%s'", c.env.Cluster)
+	}
+	var instances []*ecs.ContainerInstance
+	for i := 0; i < len(arns); i += 100 {
+		end := i + 100
+		if end > len(arns) {
+			end = len(arns)
+		}
+		if o, err := c.ecs.DescribeContainerInstances(&ecs.DescribeContainerInstancesInput{
+			Cluster:            &c.env.Cluster,
+			ContainerInstances: arns[i:end],
+		}); err != nil {
+			return err
+		} else {
+			instances = append(instances, o.ContainerInstances...)
+		}
+	}
+	zones := make(map[string]bool)
+	occupied := make(map[string]bool)
+	if o, err := c.ecs.ListTasks(&ecs.ListTasksInput{
+		Cluster:     &c.env.Cluster,
+		ServiceName: service.ServiceName,
+	}); err != nil {
+		return err
+	} else if len(o.TaskArns) > 0 {
+		if o, err := c.ecs.DescribeTasks(&ecs.DescribeTasksInput{
+			Cluster: &c.env.Cluster,
+			Tasks:   o.TaskArns,
+		}); err != nil {
+			return err
+		} else {
+			for _, task := range o.Tasks {
+				if task.AvailabilityZone != nil {
+					zones[*task.AvailabilityZone] = true
+				}
+				if task.ContainerInstanceArn != nil {
+					occupied[*task.ContainerInstanceArn] = true
+				}
+			}
+		}
+	}
+	distinctInstance := false
+	for _, v := range service.PlacementConstraints {
+		if aws.StringValue(v.Type) == ecs.PlacementConstraintTypeDistinctInstance {
+			distinctInstance = true
+		}
+	}
+	required, err := taskResources(nextTaskDefinition)
+	if err != nil {
+		return err
+	}
+	var capacities []*instanceCapacity
+	for _, instance := range instances {
+		if distinctInstance && occupied[*instance.ContainerInstanceArn] {
+			continue
+		}
+		capacities = append(capacities, newInstanceCapacity(instance))
+	}
+	canariesInZone := make(map[string]int)
+	for i, placement := range placements {
+		// zone of the subnet assigned to the canary task
+		subnetZone := ""
+		if subnets != nil {
+			subnetZone = subnets.zoneOf(placement.networkConfiguration)
+		}
+		var candidates []*instanceCapacity
+		for _, v := range capacities {
+			if !required.fitIn(v) {
+				continue
+			}
+			if distinctInstance && v.canaries > 0 {
+				continue
+			}
+			if subnets != nil && v.zone != "" && !subnets.has(v.zone) {
+				// no subnet of the service in the zone
+				continue
+			}
+			candidates = append(candidates, v)
+		}
+		if len(candidates) == 0 {
+			return fmt.Errorf(
+				"🥺 no container instance in cluster '%s' has enough resources for canary task (%d/%d) (cpu = %d, memory = %d, ports = %v)",
+				c.env.Cluster, i+1, len(placements), required.cpu, required.memory, append(required.ports, required.udpPorts...),
+			)
+		}
+		sort.SliceStable(candidates, func(i, j int) bool {
+			a, b := candidates[i], candidates[j]
+			if x, y := a.zone == subnetZone, b.zone == subnetZone; subnetZone != "" && x != y {
+				return x
+			}
+			if zones[a.zone] != zones[b.zone] {
+				return zones[a.zone]
+			}
+			if canariesInZone[a.zone] != canariesInZone[b.zone] {
+				return canariesInZone[a.zone] < canariesInZone[b.zone]
+			}
+			return a.memory > b.memory
+		})
+		selected := candidates[0]
+		selected.take(required)
+		canariesInZone[selected.zone]++
+		placement.instanceArn = *selected.instance.ContainerInstanceArn
+		if subnets != nil && selected.zone != "" && selected.zone != subnetZone {
+			if placement.networkConfiguration, err = subnets.networkConfiguration(service.NetworkConfiguration, selected.zone, i); err != nil {
+				return err
+			}
+		}
+		log.Infof(
+			"container instance '%s' (%s) was selected for canary task (%d/%d)",
+			*selected.instance.ContainerInstanceArn, aws.StringValue(selected.instance.Ec2InstanceId), i+1, len(placements),
+		)
+	}
+	return nil
+}
+
+// cluster query language expression of memberOf constraints of the service and the task definition,
+// and cpu architecture of the task definition
+func PlacementConstraintsFilter(service *ecs.Service, taskDefinition *ecs.TaskDefinition) string {
+	var expressions []string
+	for _, v := range service.PlacementConstraints {
+		if aws.StringValue(v.Type) == ecs.PlacementConstraintTypeMemberOf && aws.StringValue(v.Expression) != "" {
+			expressions = append(expressions, *v.Expression)
+		}
+	}
+	for _, v := range taskDefinition.PlacementConstraints {
+		if aws.StringValue(v.Type) == ecs.TaskDefinitionPlacementConstraintTypeMemberOf && aws.StringValue(v.Expression) != "" {
+			expressions = append(expressions, *v.Expression)
+		}
+	}
+	if taskDefinition.RuntimePlatform != nil && taskDefinition.RuntimePlatform.CpuArchitecture != nil {
+		// ARM64 or X86_64
+		expressions = append(expressions, fmt.Sprintf("attribute:ecs.cpu-architecture == %s", strings.ToLower(*taskDefinition.RuntimePlatform.CpuArchitecture)))
+	}
+	if len(expressions) == 1 {
+		return expressions[0]
+	}
+	for i, v := range expressions {
+		expressions[i] = fmt.Sprintf("(%s)", v)
+	}
+	return strings.Join(expressions, " and ")
+}
+
+// resources required to run a task
+type requiredResources struct {
+	cpu      int64
+	memory   int64
+	ports    []string
+	udpPorts []string
+}
+
+func taskResources(taskDefinition *ecs.TaskDefinition) (*requiredResources, error) {
+	ret := &requiredResources{}
+	for _, container := range taskDefinition.ContainerDefinitions {
+		ret.cpu += aws.Int64Value(container.Cpu)
+		if container.Memory != nil {
+			ret.memory += *container.Memory
+		} else {
+			ret.memory += aws.Int64Value(container.MemoryReservation)
+		}
+		if aws.StringValue(taskDefinition.NetworkMode) == ecs.NetworkModeAwsvpc {
+			// each task has its own network interface
+			continue
+		}
+		for _, mapping := range container.PortMappings {
+			port := aws.Int64Value(mapping.HostPort)
+			if port == 0 && aws.StringValue(taskDefinition.NetworkMode) == ecs.NetworkModeHost {
+				port = aws.Int64Value(mapping.ContainerPort)
+			}
+			if port == 0 {
+				// dynamic port
+				continue
+			}
+			if aws.StringValue(mapping.Protocol) == ecs.TransportProtocolUdp {
+				ret.udpPorts = append(ret.udpPorts, strconv.FormatInt(port, 10))
+			} else {
+				ret.ports = append(ret.ports, strconv.FormatInt(port, 10))
+			}
+		}
+	}
+	// task level cpu and memory take precedence over the sum of containers
+	if cpu := aws.StringValue(taskDefinition.Cpu); cpu != "" {
+		if v, err := parseTaskSize(cpu, "vcpu", 1024); err != nil {
+			return nil, fmt.Errorf("invalid cpu of task definition: '%s'", cpu)
+		} else {
+			ret.cpu = v
+		}
+	}
+	if memory := aws.StringValue(taskDefinition.Memory); memory != "" {
+		if v, err := parseTaskSize(memory, "gb", 1024); err != nil {
+			return nil, fmt.Errorf("invalid memory of task definition: '%s'", memory)
+		} else {
+			ret.memory = v
+		}
+	}
+	return ret, nil
+}
+
+// '512', '1 vCPU' or '2GB'
+func parseTaskSize(s string, unit string, scale float64) (int64, error) {
+	s = strings.ToLower(strings.TrimSpace(s))
+	if strings.HasSuffix(s, unit) {
+		v, err := strconv.ParseFloat(strings.TrimSpace(strings.TrimSuffix(s, unit)), 64)
+		if err != nil {
+			return 0, err
+		}
+		return int64(v * scale), nil
+	}
+	return strconv.ParseInt(s, 10, 64)
+}
+
+// resources of container instance left for canary tasks
+type instanceCapacity struct {
+	instance *ecs.ContainerInstance
+	zone     string
+	cpu      int64
+	memory   int64
+	// static host ports in use. e.g. 'PORTS:80' or 'PORTS_UDP:53'
+	ports    map[string]bool
+	canaries int
+}
+
+func newInstanceCapacity(instance *ecs.ContainerInstance) *instanceCapacity {
+	ret := &instanceCapacity{
+		instance: instance,
+		zone:     instanceAttribute(instance, "ecs.availability-zone"),
+		cpu:      remainingResource(instance.RemainingResources, "CPU"),
+		memory:   remainingResource(instance.RemainingResources, "MEMORY"),
+		ports:    make(map[string]bool),
+	}
+	for _, resource := range instance.RemainingResources {
+		for _, used := range resource.StringSetValue {
+			ret.ports[fmt.Sprintf("%s:%s", aws.StringValue(resource.Name), aws.StringValue(used))] = true
+		}
+	}
+	return ret
+}
+
+func (r *requiredResources) portKeys() []string {
+	var ret []string
+	for _, port := range r.ports {
+		ret = append(ret, fmt.Sprintf("PORTS:%s", port))
+	}
+	for _, port := range r.udpPorts {
+		ret = append(ret, fmt.Sprintf("PORTS_UDP:%s", port))
+	}
+	return ret
+}
+
+// whether a task can be placed on the instance with remaining resources
+func (r *requiredResources) fitIn(capacity *instanceCapacity) bool {
+	if capacity.cpu < r.cpu || capacity.memory < r.memory {
+		return false
+	}
+	for _, port := range r.portKeys() {
+		if capacity.ports[port] {
+			return false
+		}
+	}
+	return true
+}
+
+// reserve resources for a canary task
+func (capacity *instanceCapacity) take(r *requiredResources) {
+	capacity.cpu -= r.cpu
+	capacity.memory -= r.memory
+	for _, port := range r.portKeys() {
+		capacity.ports[port] = true
+	}
+	capacity.canaries++
+}
+
+func remainingResource(resources []*ecs.Resource, name string) int64 {
+	for _, v := range resources {
+		if aws.StringValue(v.Name) == name {
+			return aws.Int64Value(v.IntegerValue)
+		}
+	}
+	return 0
+}
+
+func instanceAttribute(instance *ecs.ContainerInstance, name string) string {
+	for _, v := range instance.Attributes {
+		if aws.StringValue(v.Name) == name {
+			return aws.StringValue(v.Value)
+		}
+	}
+	return ""
+}
@@ -0,0 +1,254 @@
+package cage
+
+import (
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/golang/mock/gomock"
+	"github.com/loilo-inc/canarycage/mocks/github.com/aws/aws-sdk-go/service/ec2/ec2iface"
+	"github.com/loilo-inc/canarycage/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func newContainerInstance(arn string, instanceId string, az string, cpu int64, memory int64, ports ...string) *ecs.ContainerInstance {
+	return &ecs.ContainerInstance{
+		ContainerInstanceArn: aws.String(arn),
+		Ec2InstanceId:        aws.String(instanceId),
+		Status:               aws.String("ACTIVE"),
+		Attributes: []*ecs.Attribute{{
+			Name:  aws.String("ecs.availability-zone"),
+			Value: aws.String(az),
+		}},
+		RemainingResources: []*ecs.Resource{
+			{Name: aws.String("CPU"), IntegerValue: aws.Int64(cpu)},
+			{Name: aws.String("MEMORY"), IntegerValue: aws.Int64(memory)},
+			{Name: aws.String("PORTS"), StringSetValue: aws.StringSlice(ports)},
+		},
+	}
+}
+
+func setupInstances(t *testing.T, envars *Envars, instances ...*ecs.ContainerInstance) (*gomock.Controller, *test.MockContext, *cage) {
+	ctrl := gomock.NewController(t)
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 1, "EC2")
+	for _, v := range instances {
+		mctx.PutContainerInstance(v)
+	}
+	return ctrl, mctx, &cage{env: envars, ecs: ecsMock, alb: albMock, ec2: ec2Mock}
+}
+
+func TestCage_ResolveCanaryInstance(t *testing.T) {
+	envars := DefaultEnvars()
+	ctrl, _, cagecli := setupInstances(t, envars,
+		newContainerInstance("arn://ci/1", "i-1", "us-west-2a", 1024, 1024),
+		newContainerInstance("arn://ci/2", "i-2", "us-west-2a", 1024, 1024),
+	)
+	defer ctrl.Finish()
+	// EC2インスタンスIDはcontainer instanceのarnに変換する
+	envars.CanaryInstanceArn = "i-2"
+	arn, err := cagecli.ResolveCanaryInstance()
+	assert.Nil(t, err)
+	assert.Equal(t, "arn://ci/2", arn)
+	envars.CanaryInstanceArn = "i-3"
+	_, err = cagecli.ResolveCanaryInstance()
+	assert.NotNil(t, err)
+	envars.CanaryInstanceArn = "arn://ci/3"
+	arn, err = cagecli.ResolveCanaryInstance()
+	assert.Nil(t, err)
+	assert.Equal(t, "arn://ci/3", arn)
+}
+
+func instanceArns(placements []*canaryPlacement) []string {
+	var ret []string
+	for _, v := range placements {
+		ret = append(ret, v.instanceArn)
+	}
+	return ret
+}
+
+func TestCage_SelectCanaryInstances(t *testing.T) {
+	envars := DefaultEnvars()
+	envars.TaskDefinitionInput.NetworkMode = aws.String("bridge")
+	envars.TaskDefinitionInput.Cpu = aws.String("256")
+	envars.TaskDefinitionInput.Memory = aws.String("0.5GB")
+	drained := newContainerInstance("arn://ci/drained", "i-0", "us-west-2a", 1024, 1024)
+	drained.Status = aws.String("DRAINING")
+	ctrl, mctx, cagecli := setupInstances(t, envars,
+		drained,
+		// メモリ不足
+		newContainerInstance("arn://ci/1", "i-1", "us-west-2a", 1024, 256),
+		// ポートが使われている
+		newContainerInstance("arn://ci/2", "i-2", "us-west-2a", 1024, 1024, "22", "80"),
+		newContainerInstance("arn://ci/3", "i-3", "us-west-2b", 1024, 1024, "22"),
+		newContainerInstance("arn://ci/4", "i-4", "us-west-2c", 1024, 2048, "22"),
+	)
+	defer ctrl.Finish()
+	service, _ := mctx.GetService(envars.Service)
+	service.LaunchType = aws.String("EC2")
+	service.NetworkConfiguration = nil
+	td, _ := cagecli.CreateNextTaskDefinition()
+	// 空きメモリの多いインスタンスを選ぶ
+	o, err := cagecli.PlanCanaryPlacements(service, td, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"arn://ci/4"}, instanceArns(o))
+	// 固定のhostPortは一つのインスタンスに一つしか載らない
+	o, err = cagecli.PlanCanaryPlacements(service, td, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"arn://ci/4", "arn://ci/3"}, instanceArns(o))
+	_, err = cagecli.PlanCanaryPlacements(service, td, 3)
+	assert.NotNil(t, err)
+	// サービスのタスクがあるAZを優先する
+	for _, task := range mctx.Tasks {
+		task.AvailabilityZone = aws.String("us-west-2b")
+		task.ContainerInstanceArn = aws.String("arn://ci/3")
+	}
+	o, err = cagecli.PlanCanaryPlacements(service, td, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"arn://ci/3"}, instanceArns(o))
+	// distinctInstanceならサービスのタスクがあるインスタンスは避ける
+	service.PlacementConstraints = []*ecs.PlacementConstraint{{Type: aws.String("distinctInstance")}}
+	o, err = cagecli.PlanCanaryPlacements(service, td, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"arn://ci/4"}, instanceArns(o))
+	// 選んだインスタンスは書き戻さない
+	assert.Equal(t, "", envars.CanaryInstanceArn)
+}
+
+func TestCage_SelectCanaryInstances_DynamicPort(t *testing.T) {
+	// 残りのリソースを減らしながらAZに分散させる
+	envars := DefaultEnvars()
+	envars.TaskDefinitionInput.NetworkMode = aws.String("bridge")
+	envars.TaskDefinitionInput.Cpu = aws.String("256")
+	envars.TaskDefinitionInput.Memory = aws.String("0.5GB")
+	for _, container := range envars.TaskDefinitionInput.ContainerDefinitions {
+		for _, mapping := range container.PortMappings {
+			mapping.HostPort = aws.Int64(0)
+		}
+	}
+	ctrl, mctx, cagecli := setupInstances(t, envars,
+		newContainerInstance("arn://ci/1", "i-1", "us-west-2a", 1024, 1024),
+		newContainerInstance("arn://ci/2", "i-2", "us-west-2b", 1024, 1536),
+		newContainerInstance("arn://ci/3", "i-3", "us-west-2b", 1024, 4096),
+	)
+	defer ctrl.Finish()
+	service, _ := mctx.GetService(envars.Service)
+	service.LaunchType = aws.String("EC2")
+	service.NetworkConfiguration = nil
+	td, _ := cagecli.CreateNextTaskDefinition()
+	o, err := cagecli.PlanCanaryPlacements(service, td, 4)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"arn://ci/3", "arn://ci/1", "arn://ci/3", "arn://ci/1"}, instanceArns(o))
+	// cpuとメモリの残りから全部で9つまで
+	_, err = cagecli.PlanCanaryPlacements(service, td, 9)
+	assert.Nil(t, err)
+	_, err = cagecli.PlanCanaryPlacements(service, td, 10)
+	assert.NotNil(t, err)
+}
+
+func TestCage_SelectCanaryInstances_Awsvpc(t *testing.T) {
+	// サブネットと同じAZのインスタンスを選ぶ
+	envars := DefaultEnvars()
+	envars.TaskDefinitionInput.Cpu = aws.String("256")
+	envars.TaskDefinitionInput.Memory = aws.String("0.5GB")
+	ctrl, mctx, cagecli := setupInstances(t, envars,
+		newContainerInstance("arn://ci/a", "i-a", "us-west-2a", 1024, 1024),
+		newContainerInstance("arn://ci/b", "i-b", "us-west-2b", 1024, 1024),
+		// サービスのサブネットがないAZ
+		newContainerInstance("arn://ci/c", "i-c", "us-west-2c", 1024, 4096),
+	)
+	defer ctrl.Finish()
+	ec2Mock := mock_ec2iface.NewMockEC2API(ctrl)
+	ec2Mock.EXPECT().DescribeSubnets(gomock.Any()).Return(&ec2.DescribeSubnetsOutput{
+		Subnets: []*ec2.Subnet{
+			{SubnetId: aws.String("subnet-a"), AvailabilityZone: aws.String("us-west-2a")},
+			{SubnetId: aws.String("subnet-b"), AvailabilityZone: aws.String("us-west-2b")},
+		},
+	}, nil).AnyTimes()
+	cagecli.ec2 = ec2Mock
+	service, _ := mctx.GetService(envars.Service)
+	service.LaunchType = aws.String("EC2")
+	service.NetworkConfiguration = &ecs.NetworkConfiguration{
+		AwsvpcConfiguration: &ecs.AwsVpcConfiguration{Subnets: aws.StringSlice([]string{"subnet-a", "subnet-b"})},
+	}
+	td, _ := cagecli.CreateNextTaskDefinition()
+	o, err := cagecli.PlanCanaryPlacements(service, td, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"arn://ci/a", "arn://ci/b"}, instanceArns(o))
+	assert.Equal(t, "subnet-a", *o[0].networkConfiguration.AwsvpcConfiguration.Subnets[0])
+	assert.Equal(t, "subnet-b", *o[1].networkConfiguration.AwsvpcConfiguration.Subnets[0])
+	// 割り当てたAZに空きがなければサブネットをインスタンスのAZに合わせる
+	o, err = cagecli.PlanCanaryPlacements(service, td, 4)
+	assert.Nil(t, err)
+	for _, v := range o {
+		zone := map[string]string{"arn://ci/a": "subnet-a", "arn://ci/b": "subnet-b"}[v.instanceArn]
+		assert.Equal(t, zone, *v.networkConfiguration.AwsvpcConfiguration.Subnets[0])
+	}
+	// 一つのインスタンスを指定した場合はそのAZのサブネットを使う
+	envars.CanaryInstanceArn = "arn://ci/b"
+	o, err = cagecli.PlanCanaryPlacements(service, td, 2)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"arn://ci/b", "arn://ci/b"}, instanceArns(o))
+	assert.Equal(t, "subnet-b", *o[0].networkConfiguration.AwsvpcConfiguration.Subnets[0])
+	assert.Equal(t, "subnet-b", *o[1].networkConfiguration.AwsvpcConfiguration.Subnets[0])
+}
+
+func TestCage_PlanCanaryPlacements_StaticPortOnCanaryInstance(t *testing.T) {
+	// 固定のhostPortで複数のcanaryを一つのインスタンスには載せられない
+	envars := DefaultEnvars()
+	envars.TaskDefinitionInput.NetworkMode = aws.String("bridge")
+	envars.CanaryInstanceArn = "arn://ci/1"
+	ctrl, mctx, cagecli := setupInstances(t, envars, newContainerInstance("arn://ci/1", "i-1", "us-west-2a", 1024, 1024))
+	defer ctrl.Finish()
+	service, _ := mctx.GetService(envars.Service)
+	service.NetworkConfiguration = nil
+	td, _ := cagecli.CreateNextTaskDefinition()
+	_, err := cagecli.PlanCanaryPlacements(service, td, 2)
+	assert.NotNil(t, err)
+	o, err := cagecli.PlanCanaryPlacements(service, td, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, []string{"arn://ci/1"}, instanceArns(o))
+}
+
+func TestPlacementConstraintsFilter(t *testing.T) {
+	service := &ecs.Service{}
+	td := &ecs.TaskDefinition{}
+	assert.Equal(t, "", PlacementConstraintsFilter(service, td))
+	service.PlacementConstraints = []*ecs.PlacementConstraint{
+		{Type: aws.String("distinctInstance")},
+		{Type: aws.String("memberOf"), Expression: aws.String("attribute:ecs.instance-type =~ t2.*")},
+	}
+	assert.Equal(t, "attribute:ecs.instance-type =~ t2.*", PlacementConstraintsFilter(service, td))
+	td.PlacementConstraints = []*ecs.TaskDefinitionPlacementConstraint{
+		{Type: aws.String("memberOf"), Expression: aws.String("attribute:ecs.os-type == linux")},
+	}
+	assert.Equal(t, "(attribute:ecs.instance-type =~ t2.*) and (attribute:ecs.os-type == linux)", PlacementConstraintsFilter(service, td))
+	td.RuntimePlatform = &ecs.RuntimePlatform{CpuArchitecture: aws.String("ARM64")}
+	assert.Equal(t, "(attribute:ecs.instance-type =~ t2.*) and (attribute:ecs.os-type == linux) and (attribute:ecs.cpu-architecture == arm64)", PlacementConstraintsFilter(service, td))
+}
+
+func TestTaskResources(t *testing.T) {
+	td := &ecs.TaskDefinition{
+		NetworkMode: aws.String("bridge"),
+		ContainerDefinitions: []*ecs.ContainerDefinition{
+			{Cpu: aws.Int64(128), Memory: aws.Int64(256), PortMappings: []*ecs.PortMapping{
+				{ContainerPort: aws.Int64(80), HostPort: aws.Int64(0)},
+				{ContainerPort: aws.Int64(9090), HostPort: aws.Int64(9090)},
+			}},
+			{Cpu: aws.Int64(64), MemoryReservation: aws.Int64(128), PortMappings: []*ecs.PortMapping{
+				{ContainerPort: aws.Int64(53), HostPort: aws.Int64(53), Protocol: aws.String("udp")},
+			}},
+		},
+	}
+	o, err := taskResources(td)
+	assert.Nil(t, err)
+	assert.Equal(t, &requiredResources{cpu: 192, memory: 384, ports: []string{"9090"}, udpPorts: []string{"53"}}, o)
+	td.Cpu = aws.String("1 vCPU")
+	td.Memory = aws.String("2GB")
+	o, err = taskResources(td)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(1024), o.cpu)
+	assert.Equal(t, int64(2048), o.memory)
+	td.Memory = aws.String("hoge")
+	_, err = taskResources(td)
+	assert.NotNil(t, err)
+}
@@ -0,0 +1,186 @@
+package cage
+
+import (
+	"context"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"regexp"
+	"time"
+)
+
+type CanaryMetrics struct {
+	RequestCount float64
+	// count of 5xx responses returned from targets
+	ErrorCount float64
+	// ratio of non-5xx responses to all requests
+	Availability float64
+	// average of TargetResponseTime in seconds weighted by request count
+	ResponseTime float64
+	// whether datapoints of the last minute of the period are available
+	complete bool
+}
+
+// CloudWatch metrics of ALB are available about a minute later
+var metricsIngestionDelay = time.Duration(1) * time.Minute
+
+// datapoints are queried until those of the last minute are available or this many times
+const metricsQueryAttempts = 5
+
+var loadBalancerDimensionPattern = regexp.MustCompile("(app|net)/[^/]+/[^/]+$")
+var targetGroupDimensionPattern = regexp.MustCompile("targetgroup/[^/]+/[^/]+$")
+
+func (c *cage) MetricsAnalysisEnabled() bool {
+	return c.env.AvailabilityThreshold > 0 || c.env.ResponseTimeThreshold > 0
+}
+
+// wait for analysis period and then ensure that metrics of target groups canary tasks are registered to satisfy thresholds
+func (c *cage) AnalyzeCanaryMetrics(ctx context.Context, targetGroupArns []*string) ([]*CanaryMetrics, error) {
+	if c.cw == nil {
+		return nil, fmt.Errorf("cloudwatch client is required to analyze metrics")
+	}
+	period := c.env.AnalysisPeriod
+	if period == 0 {
+		period = DefaultAnalysisPeriod
+	}
+	startTime := now()
+	log.Infof("📈 collecting metrics of %d target groups for %d seconds...", len(targetGroupArns), period)
+	if err := sleep(ctx, time.Duration(period)*time.Second); err != nil {
+		return nil, err
+	}
+	endTime := now()
+	log.Infof("waiting %s for metrics to be available...", metricsIngestionDelay)
+	if err := sleep(ctx, metricsIngestionDelay); err != nil {
+		return nil, err
+	}
+	var ret []*CanaryMetrics
+	for _, targetGroupArn := range targetGroupArns {
+		metrics, err := c.analyzeTargetGroupMetrics(ctx, targetGroupArn, startTime, endTime)
+		if metrics != nil {
+			ret = append(ret, metrics)
+		}
+		if err != nil {
+			return ret, err
+		}
+	}
+	return ret, nil
+}
+
+func (c *cage) analyzeTargetGroupMetrics(
+	ctx context.Context,
+	targetGroupArn *string,
+	startTime time.Time,
+	endTime time.Time,
+) (*CanaryMetrics, error) {
+	var metrics *CanaryMetrics
+	for i := 1; ; i++ {
+		var err error
+		if metrics, err = c.GetTargetGroupMetrics(targetGroupArn, startTime, endTime); err != nil {
+			return nil, err
+		}
+		if metrics.complete || i >= metricsQueryAttempts {
+			break
+		}
+		log.Infof("metrics of target group '%s' are not available yet. retrying after %s...", *targetGroupArn, metricsIngestionDelay)
+		if err := sleep(ctx, metricsIngestionDelay); err != nil {
+			return nil, err
+		}
+	}
+	log.Infof(
+		"metrics of target group '%s': requests = %.0f, errors = %.0f, availability = %f, responseTime = %fs",
+		*targetGroupArn, metrics.RequestCount, metrics.ErrorCount, metrics.Availability, metrics.ResponseTime,
+	)
+	if metrics.RequestCount == 0 {
+		return metrics, fmt.Errorf("no requests reached target group '%s' during analysis period", *targetGroupArn)
+	}
+	if c.env.AvailabilityThreshold > 0 && metrics.Availability < c.env.AvailabilityThreshold {
+		return metrics, fmt.Errorf(
+			"availability of target group '%s' fell below the threshold: %f < %f",
+			*targetGroupArn, metrics.Availability, c.env.AvailabilityThreshold,
+		)
+	}
+	if c.env.ResponseTimeThreshold > 0 && metrics.ResponseTime > c.env.ResponseTimeThreshold {
+		return metrics, fmt.Errorf(
+			"response time of target group '%s' exceeded the threshold: %fs > %fs",
+			*targetGroupArn, metrics.ResponseTime, c.env.ResponseTimeThreshold,
+		)
+	}
+	return metrics, nil
+}
+
+// get per-minute metrics of the target group and sum them up
+func (c *cage) GetTargetGroupMetrics(
+	targetGroupArn *string,
+	startTime time.Time,
+	endTime time.Time,
+) (*CanaryMetrics, error) {
+	var loadBalancerArn *string
+	if o, err := c.alb.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{
+		TargetGroupArns: []*string{targetGroupArn},
+	}); err != nil {
+		return nil, err
+	} else if len(o.TargetGroups) == 0 || len(o.TargetGroups[0].LoadBalancerArns) == 0 {
+		return nil, fmt.Errorf("target group '%s' is not attached to any load balancer", *targetGroupArn)
+	} else {
+		loadBalancerArn = o.TargetGroups[0].LoadBalancerArns[0]
+	}
+	lb := loadBalancerDimensionPattern.FindString(*loadBalancerArn)
+	tg := targetGroupDimensionPattern.FindString(*targetGroupArn)
+	if lb == "" || tg == "" {
+		return nil, fmt.Errorf("failed to parse load balancer '%s' or target group '%s'", *loadBalancerArn, *targetGroupArn)
+	}
+	getStatistics := func(metricName string, stat string) ([]*cloudwatch.Datapoint, error) {
+		o, err := c.cw.GetMetricStatistics(&cloudwatch.GetMetricStatisticsInput{
+			Namespace:  aws.String("AWS/ApplicationELB"),
+			MetricName: aws.String(metricName),
+			Dimensions: []*cloudwatch.Dimension{
+				{Name: aws.String("LoadBalancer"), Value: aws.String(lb)},
+				{Name: aws.String("TargetGroup"), Value: aws.String(tg)},
+			},
+			StartTime:  aws.Time(startTime),
+			EndTime:    aws.Time(endTime),
+			Period:     aws.Int64(60),
+			Statistics: []*string{aws.String(stat)},
+		})
+		if err != nil {
+			return nil, err
+		}
+		return o.Datapoints, nil
+	}
+	ret := &CanaryMetrics{}
+	lastMinute := endTime.Add(-time.Nanosecond).Truncate(time.Minute)
+	// request count of each minute to weight response time
+	requests := make(map[int64]float64)
+	if points, err := getStatistics("RequestCount", "Sum"); err != nil {
+		return nil, err
+	} else {
+		for _, p := range points {
+			ret.RequestCount += *p.Sum
+			requests[p.Timestamp.Unix()] += *p.Sum
+			if !p.Timestamp.Before(lastMinute) {
+				ret.complete = true
+			}
+		}
+	}
+	if points, err := getStatistics("HTTPCode_Target_5XX_Count", "Sum"); err != nil {
+		return nil, err
+	} else {
+		for _, p := range points {
+			ret.ErrorCount += *p.Sum
+		}
+	}
+	if points, err := getStatistics("TargetResponseTime", "Average"); err != nil {
+		return nil, err
+	} else {
+		for _, p := range points {
+			ret.ResponseTime += *p.Average * requests[p.Timestamp.Unix()]
+		}
+	}
+	if ret.RequestCount > 0 {
+		ret.Availability = (ret.RequestCount - ret.ErrorCount) / ret.RequestCount
+		ret.ResponseTime /= ret.RequestCount
+	}
+	return ret, nil
+}
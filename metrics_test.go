@@ -0,0 +1,167 @@
+package cage
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/cloudwatch"
+	"github.com/golang/mock/gomock"
+	"github.com/loilo-inc/canarycage/mocks/github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestCage_RollOut_MetricsAnalysis(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	// mocked target group has 100000 requests, 1 target 5xx and 0.1s response time per minute
+	for _, v := range []struct {
+		availability float64
+		responseTime float64
+		ok           bool
+	}{
+		{availability: 0.9999, responseTime: 1.2, ok: true},
+		{availability: 0.9999, ok: true},
+		{responseTime: 0.2, ok: true},
+		{availability: 0.999999, responseTime: 1.2, ok: false},
+		{availability: 0.9999, responseTime: 0.05, ok: false},
+	} {
+		envars := DefaultEnvars()
+		envars.AvailabilityThreshold = v.availability
+		envars.ResponseTimeThreshold = v.responseTime
+		ctrl := gomock.NewController(t)
+		mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+		cwMock := mock_cloudwatchiface.NewMockCloudWatchAPI(ctrl)
+		cwMock.EXPECT().GetMetricStatistics(gomock.Any()).DoAndReturn(mctx.GetMetricStatics).Times(3)
+		cagecli := NewCage(&Input{
+			Env: envars,
+			ECS: ecsMock,
+			ALB: albMock,
+			EC2: ec2Mock,
+			CW:  cwMock,
+		})
+		result, err := cagecli.RollOut(context.Background())
+		if v.ok {
+			assert.Nil(t, err)
+			assert.False(t, result.ServiceIntact)
+		} else {
+			assert.NotNil(t, err)
+			assert.True(t, result.ServiceIntact)
+		}
+		assert.Equal(t, int64(2), mctx.TaskSize())
+		ctrl.Finish()
+	}
+}
+
+func TestCage_GetTargetGroupMetrics(t *testing.T) {
+	// 応答時間はリクエスト数で重み付けする
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	envars := DefaultEnvars()
+	_, _, albMock, _ := Setup(ctrl, envars, 1, "FARGATE")
+	cwMock := mock_cloudwatchiface.NewMockCloudWatchAPI(ctrl)
+	startTime := time.Date(2019, 1, 1, 0, 0, 0, 0, time.UTC)
+	endTime := startTime.Add(time.Duration(2) * time.Minute)
+	cwMock.EXPECT().GetMetricStatistics(gomock.Any()).DoAndReturn(func(input *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
+		var points []*cloudwatch.Datapoint
+		switch *input.MetricName {
+		case "RequestCount":
+			points = []*cloudwatch.Datapoint{
+				{Timestamp: aws.Time(startTime), Sum: aws.Float64(100)},
+				{Timestamp: aws.Time(startTime.Add(time.Minute)), Sum: aws.Float64(300)},
+			}
+		case "HTTPCode_Target_5XX_Count":
+			points = []*cloudwatch.Datapoint{{Timestamp: aws.Time(startTime), Sum: aws.Float64(4)}}
+		case "TargetResponseTime":
+			points = []*cloudwatch.Datapoint{
+				{Timestamp: aws.Time(startTime), Average: aws.Float64(0.4)},
+				{Timestamp: aws.Time(startTime.Add(time.Minute)), Average: aws.Float64(0.2)},
+			}
+		}
+		return &cloudwatch.GetMetricStatisticsOutput{Datapoints: points}, nil
+	}).Times(3)
+	cagecli := &cage{env: envars, alb: albMock, cw: cwMock}
+	metrics, err := cagecli.GetTargetGroupMetrics(envars.ServiceDefinitionInput.LoadBalancers[0].TargetGroupArn, startTime, endTime)
+	assert.Nil(t, err)
+	assert.Equal(t, float64(400), metrics.RequestCount)
+	assert.Equal(t, 0.99, metrics.Availability)
+	assert.InDelta(t, 0.25, metrics.ResponseTime, 1e-9)
+	assert.True(t, metrics.complete)
+}
+
+func TestCage_RollOut_MetricsAnalysisDelayed(t *testing.T) {
+	// 最後の1分のデータが揃うまで再取得する
+	newTimer = fakeTimer
+	now = fakeNow
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.AvailabilityThreshold = 0.9999
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	cwMock := mock_cloudwatchiface.NewMockCloudWatchAPI(ctrl)
+	queried := 0
+	cwMock.EXPECT().GetMetricStatistics(gomock.Any()).DoAndReturn(func(input *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
+		if *input.MetricName == "RequestCount" {
+			queried++
+			if queried == 1 {
+				return &cloudwatch.GetMetricStatisticsOutput{}, nil
+			}
+		}
+		return mctx.GetMetricStatics(input)
+	}).Times(6)
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+		CW:  cwMock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, result.ServiceIntact)
+	assert.Equal(t, 2, queried)
+}
+
+func TestCage_RollOut_MetricsAnalysisNoRequests(t *testing.T) {
+	// リクエストが来なかった場合は失敗する
+	newTimer = fakeTimer
+	now = fakeNow
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.ResponseTimeThreshold = 1.2
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	cwMock := mock_cloudwatchiface.NewMockCloudWatchAPI(ctrl)
+	cwMock.EXPECT().GetMetricStatistics(gomock.Any()).Return(&cloudwatch.GetMetricStatisticsOutput{}, nil).Times(3 * metricsQueryAttempts)
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+		CW:  cwMock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.NotNil(t, err)
+	assert.True(t, result.ServiceIntact)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
+
+func TestCage_RollOut_MetricsAnalysisWithoutCloudWatch(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.AvailabilityThreshold = 0.9999
+	ctrl := gomock.NewController(t)
+	_, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 1, "FARGATE")
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.NotNil(t, err)
+	assert.True(t, result.ServiceIntact)
+}
@@ -0,0 +1,59 @@
+package cage
+
+import (
+	"time"
+)
+
+type EventType string
+
+const (
+	EventTaskDefinitionRegistered EventType = "TaskDefinitionRegistered"
+	EventCanaryTaskStarted        EventType = "CanaryTaskStarted"
+	EventCanaryTaskRunning        EventType = "CanaryTaskRunning"
+	// canary task was registered to a target group or a Cloud Map service
+	EventCanaryTaskRegistered EventType = "CanaryTaskRegistered"
+	// health state of canary task in a target group, a Cloud Map service or by container health checks has changed
+	EventCanaryTaskHealthStateChanged EventType = "CanaryTaskHealthStateChanged"
+	EventServiceUpdateStarted         EventType = "ServiceUpdateStarted"
+	EventServiceStable                EventType = "ServiceStable"
+	EventCanaryTaskStopped            EventType = "CanaryTaskStopped"
+	EventRollOutFailed                EventType = "RollOutFailed"
+)
+
+// lifecycle event of rolling out. fields irrelevant to the type are empty
+type Event struct {
+	Type              EventType `json:"type"`
+	Time              time.Time `json:"time"`
+	Cluster           string    `json:"cluster"`
+	Service           string    `json:"service"`
+	TaskDefinitionArn string    `json:"taskDefinitionArn,omitempty"`
+	TaskArn           string    `json:"taskArn,omitempty"`
+	TargetGroupArn    string    `json:"targetGroupArn,omitempty"`
+	RegistryArn       string    `json:"registryArn,omitempty"`
+	// id:port of the target, or instance id in Cloud Map service
+	Target      string `json:"target,omitempty"`
+	HealthState string `json:"healthState,omitempty"`
+	Err         error  `json:"-"`
+}
+
+// Observer receives lifecycle events of rolling out in order.
+// it is called synchronously, so it should return quickly
+type Observer interface {
+	OnEvent(event *Event)
+}
+
+type ObserverFunc func(event *Event)
+
+func (f ObserverFunc) OnEvent(event *Event) {
+	f(event)
+}
+
+func (c *cage) emit(event *Event) {
+	if c.observer == nil {
+		return
+	}
+	event.Time = now()
+	event.Cluster = c.env.Cluster
+	event.Service = c.env.Service
+	c.observer.OnEvent(event)
+}
@@ -0,0 +1,142 @@
+package cage
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func TestCage_RollOut_Observer(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	var events []*Event
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+		Observer: ObserverFunc(func(event *Event) {
+			events = append(events, event)
+		}),
+	})
+	_, err := cagecli.RollOut(context.Background())
+	assert.Nil(t, err)
+	var types []EventType
+	for _, v := range events {
+		types = append(types, v.Type)
+		assert.Equal(t, envars.Service, v.Service)
+	}
+	assert.Equal(t, []EventType{
+		EventTaskDefinitionRegistered,
+		EventCanaryTaskStarted,
+		EventCanaryTaskRunning,
+		EventCanaryTaskRegistered,
+		// コンテナのhealth checkの後にtarget group
+		EventCanaryTaskHealthStateChanged,
+		EventCanaryTaskHealthStateChanged,
+		EventServiceUpdateStarted,
+		EventServiceStable,
+		EventCanaryTaskStopped,
+	}, types)
+	assert.Equal(t, "HEALTHY", events[4].HealthState)
+	assert.Equal(t, "", events[4].Target)
+	assert.Equal(t, "healthy", events[5].HealthState)
+	assert.Equal(t, "127.0.0.1:8000", events[5].Target)
+	assert.Equal(t, events[1].TaskArn, events[8].TaskArn)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
+
+func TestCage_RollOut_ObserverFailed(t *testing.T) {
+	// 失敗したらcanaryを止めた後にRollOutFailedを1度だけ通知する
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, _, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	var events []*Event
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: setupTargetGroup(ctrl, mctx, &elbv2.TargetGroup{
+			Protocol:         aws.String("HTTP"),
+			LoadBalancerArns: []*string{aws.String("arn://hoge/app/aa/bb")},
+		}, "unhealthy", 1),
+		EC2: ec2Mock,
+		Observer: ObserverFunc(func(event *Event) {
+			events = append(events, event)
+		}),
+	})
+	_, err := cagecli.RollOut(context.Background())
+	assert.NotNil(t, err)
+	n := len(events)
+	assert.Equal(t, EventCanaryTaskHealthStateChanged, events[n-3].Type)
+	assert.Equal(t, "unhealthy", events[n-3].HealthState)
+	assert.Equal(t, EventCanaryTaskStopped, events[n-2].Type)
+	assert.Equal(t, EventRollOutFailed, events[n-1].Type)
+	assert.Equal(t, ErrorKindCanary, KindOf(events[n-1].Err))
+	failed := 0
+	for _, v := range events {
+		if v.Type == EventRollOutFailed {
+			failed++
+		}
+	}
+	assert.Equal(t, 1, failed)
+}
+
+func TestCage_RollOut_ObserverCleanupFailed(t *testing.T) {
+	// canaryの停止に失敗してもRollOutFailedは1度だけ
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	_, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	var failed []*Event
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: &faultyECS{ECSAPI: ecsMock, stopFails: true},
+		ALB: albMock,
+		EC2: ec2Mock,
+		Observer: ObserverFunc(func(event *Event) {
+			if event.Type == EventRollOutFailed {
+				failed = append(failed, event)
+			}
+		}),
+	})
+	_, err := cagecli.RollOut(context.Background())
+	assert.NotNil(t, err)
+	assert.Equal(t, 1, len(failed))
+	assert.Equal(t, ErrorKindCleanup, KindOf(failed[0].Err))
+}
+
+func TestCage_RollOut_ObserverTaskSet(t *testing.T) {
+	// task setのタスクも通知する
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 0, "FARGATE")
+	setupTaskSet(t, mctx, envars, 4)
+	var types []EventType
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+		Observer: ObserverFunc(func(event *Event) {
+			types = append(types, event.Type)
+		}),
+	})
+	_, err := cagecli.RollOut(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []EventType{EventCanaryTaskStarted, EventCanaryTaskRunning}, types[1:3])
+}
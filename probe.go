@@ -0,0 +1,134 @@
+package cage
+
+import (
+	"context"
+	"fmt"
+	"github.com/apex/log"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// HTTP request sent directly to canary task, in addition to health check of target group
+type Probe struct {
+	Path    string            `json:"path"`
+	Method  string            `json:"method"`
+	Headers map[string]string `json:"headers"`
+	Body    string            `json:"body"`
+	// default: 200
+	ExpectedStatus int `json:"expectedStatus"`
+	// if specified, response body must match
+	BodyRegex string `json:"bodyRegex"`
+	// default: 10
+	TimeoutSeconds int64 `json:"timeoutSeconds"`
+	// number of times to send the request. every response must satisfy expectations. default: 1
+	Count int `json:"count"`
+}
+
+const DefaultProbeTimeoutSeconds = 10
+
+// load probes from 'probes.json' in the directory. it is optional and returns nil if not exists
+func LoadProbesFromFile(dir string) ([]*Probe, error) {
+	path := filepath.Join(dir, "probes.json")
+	if _, err := os.Stat(path); err != nil {
+		return nil, nil
+	}
+	var probes []*Probe
+	if _, err := ReadAndUnmarshalJson(path, &probes); err != nil {
+		return nil, NewErrorf("failed to read and unmarshal probes.json: %s", err)
+	}
+	return probes, nil
+}
+
+func ValidateProbes(probes []*Probe) error {
+	for i, probe := range probes {
+		if !strings.HasPrefix(probe.Path, "/") {
+			return NewErrorf("path of probe[%d] must start with '/': '%s'", i, probe.Path)
+		}
+		if probe.BodyRegex != "" {
+			if _, err := regexp.Compile(probe.BodyRegex); err != nil {
+				return NewErrorf("bodyRegex of probe[%d] is invalid: %s", i, err)
+			}
+		}
+		if probe.TimeoutSeconds < 0 || probe.Count < 0 {
+			return NewErrorf("timeoutSeconds and count of probe[%d] must not be negative", i)
+		}
+	}
+	return nil
+}
+
+// send all probes to each canary task
+func (c *cage) ProbeCanaryTasks(ctx context.Context, tasks []*StartCanaryTaskOutput) error {
+	for _, task := range tasks {
+		host := task.address()
+		if host == "" {
+			return fmt.Errorf("address of canary task '%s' is unknown. probes require load balancer attached to service", *task.task.TaskArn)
+		}
+		for _, probe := range c.env.Probes {
+			if err := SendProbe(ctx, host, probe); err != nil {
+				return fmt.Errorf("canary task '%s' failed probe: %s", *task.task.TaskArn, err)
+			}
+		}
+		log.Infof("canary task '%s' (%s) passed all probes", *task.task.TaskArn, host)
+	}
+	return nil
+}
+
+func SendProbe(ctx context.Context, host string, probe *Probe) error {
+	method := probe.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+	expectedStatus := probe.ExpectedStatus
+	if expectedStatus == 0 {
+		expectedStatus = http.StatusOK
+	}
+	timeout := probe.TimeoutSeconds
+	if timeout == 0 {
+		timeout = DefaultProbeTimeoutSeconds
+	}
+	count := probe.Count
+	if count == 0 {
+		count = 1
+	}
+	var bodyRegex *regexp.Regexp
+	if probe.BodyRegex != "" {
+		if o, err := regexp.Compile(probe.BodyRegex); err != nil {
+			return err
+		} else {
+			bodyRegex = o
+		}
+	}
+	client := &http.Client{Timeout: time.Duration(timeout) * time.Second}
+	url := fmt.Sprintf("http://%s%s", host, probe.Path)
+	for i := 0; i < count; i++ {
+		req, err := http.NewRequestWithContext(ctx, method, url, strings.NewReader(probe.Body))
+		if err != nil {
+			return err
+		}
+		for k, v := range probe.Headers {
+			req.Header.Set(k, v)
+		}
+		log.Debugf("probe: %s %s", method, url)
+		res, err := client.Do(req)
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", method, probe.Path, err)
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		if err != nil {
+			return fmt.Errorf("%s %s: %s", method, probe.Path, err)
+		}
+		if res.StatusCode != expectedStatus {
+			return fmt.Errorf("%s %s: expected status %d but got %d", method, probe.Path, expectedStatus, res.StatusCode)
+		}
+		if bodyRegex != nil && !bodyRegex.Match(body) {
+			return fmt.Errorf("%s %s: response body doesn't match '%s'", method, probe.Path, probe.BodyRegex)
+		}
+	}
+	return nil
+}
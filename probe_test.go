@@ -0,0 +1,121 @@
+package cage
+
+import (
+	"context"
+	"fmt"
+	"github.com/golang/mock/gomock"
+	"github.com/stretchr/testify/assert"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+)
+
+// server behaves like test-container in healthy, up-but-buggy and up-but-slow modes
+func newProbeServer() *httptest.Server {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", func(writer http.ResponseWriter, request *http.Request) {
+		fmt.Fprintf(writer, "🐤")
+	})
+	i := 0
+	mux.HandleFunc("/buggy", func(writer http.ResponseWriter, request *http.Request) {
+		if i++; i%2 == 0 {
+			writer.WriteHeader(500)
+		} else {
+			fmt.Fprintf(writer, "🐤")
+		}
+	})
+	mux.HandleFunc("/users", func(writer http.ResponseWriter, request *http.Request) {
+		if request.Method != http.MethodPost || request.Header.Get("Content-Type") != "application/json" {
+			writer.WriteHeader(400)
+			return
+		}
+		writer.WriteHeader(201)
+		fmt.Fprintf(writer, `{"id": 1}`)
+	})
+	return httptest.NewServer(mux)
+}
+
+func TestLoadProbesFromFile(t *testing.T) {
+	probes, err := LoadProbesFromFile("fixtures")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(t, 2, len(probes))
+	assert.Equal(t, "POST", probes[1].Method)
+	assert.Equal(t, "application/json", probes[1].Headers["Content-Type"])
+	assert.Equal(t, 201, probes[1].ExpectedStatus)
+	assert.Equal(t, 10, probes[1].Count)
+	// probes.json is optional
+	probes, err = LoadProbesFromFile("test")
+	assert.Nil(t, err)
+	assert.Nil(t, probes)
+}
+
+func TestSendProbe(t *testing.T) {
+	server := newProbeServer()
+	defer server.Close()
+	host := server.Listener.Addr().String()
+	for _, v := range []struct {
+		probe *Probe
+		ok    bool
+	}{
+		{probe: &Probe{Path: "/"}, ok: true},
+		{probe: &Probe{Path: "/", BodyRegex: "🐤"}, ok: true},
+		{probe: &Probe{Path: "/", BodyRegex: "🐔"}, ok: false},
+		{probe: &Probe{Path: "/", ExpectedStatus: 201}, ok: false},
+		{probe: &Probe{Path: "/users", Method: "POST", Headers: map[string]string{"Content-Type": "application/json"}, ExpectedStatus: 201}, ok: true},
+		{probe: &Probe{Path: "/users", Method: "POST", ExpectedStatus: 201}, ok: false},
+		{probe: &Probe{Path: "/buggy"}, ok: true},
+		{probe: &Probe{Path: "/buggy", Count: 2}, ok: false},
+	} {
+		err := SendProbe(context.Background(), host, v.probe)
+		if v.ok {
+			assert.Nil(t, err, "%+v", v.probe)
+		} else {
+			assert.NotNil(t, err, "%+v", v.probe)
+		}
+	}
+}
+
+func TestCage_RollOut_Probes(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	server := newProbeServer()
+	defer server.Close()
+	_, port, _ := net.SplitHostPort(server.Listener.Addr().String())
+	hostPort, _ := strconv.ParseInt(port, 10, 64)
+	for _, v := range []struct {
+		probes []*Probe
+		ok     bool
+	}{
+		{probes: []*Probe{{Path: "/", BodyRegex: "🐤"}}, ok: true},
+		{probes: []*Probe{{Path: "/"}, {Path: "/buggy", Count: 10}}, ok: false},
+	} {
+		envars := DefaultEnvars()
+		envars.Probes = v.probes
+		// canary task listens on 127.0.0.1:hostPort
+		envars.TaskDefinitionInput.ContainerDefinitions[0].PortMappings[0].ContainerPort = &hostPort
+		envars.TaskDefinitionInput.ContainerDefinitions[0].PortMappings[0].HostPort = &hostPort
+		envars.ServiceDefinitionInput.LoadBalancers[0].ContainerPort = &hostPort
+		ctrl := gomock.NewController(t)
+		mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+		cagecli := NewCage(&Input{
+			Env: envars,
+			ECS: ecsMock,
+			ALB: albMock,
+			EC2: ec2Mock,
+		})
+		result, err := cagecli.RollOut(context.Background())
+		if v.ok {
+			assert.Nil(t, err)
+			assert.False(t, result.ServiceIntact)
+		} else {
+			assert.NotNil(t, err)
+			assert.True(t, result.ServiceIntact)
+		}
+		assert.Equal(t, int64(2), mctx.TaskSize())
+		ctrl.Finish()
+	}
+}
@@ -0,0 +1,89 @@
+package cage
+
+import (
+	"fmt"
+	"time"
+)
+
+type Phase string
+
+const (
+	// describe the service, register next task definition and check its settings
+	PhasePreflight     Phase = "preflight"
+	PhaseStartCanary   Phase = "start_canary"
+	PhaseVerifyCanary  Phase = "verify_canary"
+	PhaseApproval      Phase = "approval"
+	PhaseUpdateService Phase = "update_service"
+	PhaseStopCanary    Phase = "stop_canary"
+	// create the service and wait for it to be stable in `up`
+	PhaseCreateService Phase = "create_service"
+)
+
+type PhaseResult struct {
+	Name      Phase     `json:"name"`
+	StartTime time.Time `json:"startTime"`
+	// zero while the phase is in progress
+	EndTime time.Time `json:"endTime"`
+}
+
+type CanaryTaskResult struct {
+	TaskArn string `json:"taskArn"`
+	// health status of the task by container health checks. empty if not checked
+	HealthStatus string                `json:"healthStatus,omitempty"`
+	Targets      []*CanaryTargetResult `json:"targets"`
+}
+
+// canary task in a target group or a Cloud Map service
+type CanaryTargetResult struct {
+	TargetGroupArn string `json:"targetGroupArn,omitempty"`
+	RegistryArn    string `json:"registryArn,omitempty"`
+	// id:port in the target group, or instance id in the Cloud Map service
+	TargetId string `json:"targetId"`
+	// the final health state seen. empty if not checked
+	HealthState string `json:"healthState,omitempty"`
+}
+
+// end the current phase and start the next one
+func beginPhase(phases *[]*PhaseResult, name Phase) {
+	endPhase(*phases)
+	*phases = append(*phases, &PhaseResult{Name: name, StartTime: now()})
+}
+
+func endPhase(phases []*PhaseResult) {
+	if current := currentPhase(phases); current != nil && current.EndTime.IsZero() {
+		current.EndTime = now()
+	}
+}
+
+func currentPhase(phases []*PhaseResult) *PhaseResult {
+	if len(phases) == 0 {
+		return nil
+	}
+	return phases[len(phases)-1]
+}
+
+func canaryTaskResults(tasks []*StartCanaryTaskOutput) []*CanaryTaskResult {
+	var ret []*CanaryTaskResult
+	for _, task := range tasks {
+		v := &CanaryTaskResult{
+			TaskArn:      *task.task.TaskArn,
+			HealthStatus: task.healthStatus,
+		}
+		for _, target := range task.targets {
+			v.Targets = append(v.Targets, &CanaryTargetResult{
+				TargetGroupArn: *target.targetGroupArn,
+				TargetId:       fmt.Sprintf("%s:%d", *target.targetId, *target.targetPort),
+				HealthState:    target.healthState,
+			})
+		}
+		for _, registration := range task.registrations {
+			v.Targets = append(v.Targets, &CanaryTargetResult{
+				RegistryArn: *registration.registryArn,
+				TargetId:    *registration.instanceId,
+				HealthState: registration.healthState,
+			})
+		}
+		ret = append(ret, v)
+	}
+	return ret
+}
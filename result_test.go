@@ -0,0 +1,157 @@
+package cage
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/golang/mock/gomock"
+	"github.com/loilo-inc/canarycage/mocks/github.com/aws/aws-sdk-go/service/ecs/ecsiface"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+func phaseNames(phases []*PhaseResult) []Phase {
+	var ret []Phase
+	for _, v := range phases {
+		ret = append(ret, v.Name)
+	}
+	return ret
+}
+
+func TestCage_RollOut_Result(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	_, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	cagecli := NewCage(&Input{Env: envars, ECS: ecsMock, ALB: albMock, EC2: ec2Mock})
+	result, err := cagecli.RollOut(context.Background())
+	assert.Nil(t, err)
+	assert.NotEmpty(t, result.NextTaskDefinitionArn)
+	assert.Equal(t, int64(1), result.NextTaskDefinitionRevision)
+	assert.NotEmpty(t, result.PreviousTaskDefinitionArn)
+	assert.NotEqual(t, result.NextTaskDefinitionArn, result.PreviousTaskDefinitionArn)
+	assert.Equal(t, []Phase{
+		PhasePreflight, PhaseStartCanary, PhaseVerifyCanary, PhaseUpdateService, PhaseStopCanary,
+	}, phaseNames(result.Phases))
+	for _, v := range result.Phases {
+		assert.False(t, v.EndTime.IsZero())
+		assert.False(t, v.EndTime.Before(v.StartTime))
+	}
+	assert.Equal(t, Phase(""), result.FailedPhase)
+	assert.Equal(t, 1, len(result.CanaryTasks))
+	canary := result.CanaryTasks[0]
+	assert.NotEmpty(t, canary.TaskArn)
+	assert.Equal(t, 1, len(canary.Targets))
+	assert.Equal(t, "127.0.0.1:8000", canary.Targets[0].TargetId)
+	assert.Equal(t, "healthy", canary.Targets[0].HealthState)
+}
+
+func TestCage_RollOut_ResultFailed(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	t.Run("verify_canary", func(t *testing.T) {
+		// 失敗したフェーズと最後に見えたヘルス状態を返す
+		envars := DefaultEnvars()
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mctx, ecsMock, _, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+		cagecli := NewCage(&Input{
+			Env: envars,
+			ECS: ecsMock,
+			ALB: setupTargetGroup(ctrl, mctx, &elbv2.TargetGroup{
+				Protocol:         aws.String("HTTP"),
+				LoadBalancerArns: []*string{aws.String("arn://hoge/app/aa/bb")},
+			}, "unhealthy", 1),
+			EC2: ec2Mock,
+		})
+		result, err := cagecli.RollOut(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, PhaseVerifyCanary, result.FailedPhase)
+		assert.Equal(t, []Phase{
+			PhasePreflight, PhaseStartCanary, PhaseVerifyCanary, PhaseStopCanary,
+		}, phaseNames(result.Phases))
+		assert.Equal(t, "unhealthy", result.CanaryTasks[0].Targets[0].HealthState)
+	})
+	t.Run("preflight", func(t *testing.T) {
+		envars := DefaultEnvars()
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		_, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+		cagecli := NewCage(&Input{Env: envars, ECS: &faultyECS{ECSAPI: ecsMock, registerFails: true}, ALB: albMock, EC2: ec2Mock})
+		result, err := cagecli.RollOut(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, PhasePreflight, result.FailedPhase)
+		assert.Empty(t, result.NextTaskDefinitionArn)
+		assert.Empty(t, result.CanaryTasks)
+	})
+	t.Run("stop_canary", func(t *testing.T) {
+		envars := DefaultEnvars()
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		_, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+		cagecli := NewCage(&Input{Env: envars, ECS: &faultyECS{ECSAPI: ecsMock, stopFails: true}, ALB: albMock, EC2: ec2Mock})
+		result, err := cagecli.RollOut(context.Background())
+		assert.NotNil(t, err)
+		assert.Equal(t, PhaseStopCanary, result.FailedPhase)
+	})
+}
+
+func TestCage_Up_Result(t *testing.T) {
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	_, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 0, "FARGATE")
+	cagecli := NewCage(&Input{Env: envars, ECS: ecsMock, ALB: albMock, EC2: ec2Mock})
+	result, err := cagecli.Up(context.Background())
+	assert.Nil(t, err)
+	assert.Equal(t, []Phase{PhasePreflight, PhaseCreateService}, phaseNames(result.Phases))
+	assert.Equal(t, Phase(""), result.FailedPhase)
+	assert.NotNil(t, result.TaskDefinition)
+	assert.Equal(t, envars.Service, *result.Service.ServiceName)
+}
+
+func TestCage_Up_CreateServiceFailed(t *testing.T) {
+	// サービスが作られなかった場合はpreflightとして扱う
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ecsMock := mock_ecsiface.NewMockECSAPI(ctrl)
+	ecsMock.EXPECT().RegisterTaskDefinition(gomock.Any()).Return(&ecs.RegisterTaskDefinitionOutput{
+		TaskDefinition: &ecs.TaskDefinition{TaskDefinitionArn: aws.String("arn://td:2")},
+	}, nil)
+	ecsMock.EXPECT().CreateService(gomock.Any()).Return(nil, errors.New("failed"))
+	cagecli := NewCage(&Input{Env: envars, ECS: ecsMock})
+	result, err := cagecli.Up(context.Background())
+	assert.Equal(t, ErrorKindPreflight, KindOf(err))
+	assert.True(t, err.(*Error).ServiceIntact)
+	assert.Equal(t, PhaseCreateService, result.FailedPhase)
+}
+
+func TestCage_Up_Cancelled(t *testing.T) {
+	// サービス作成後にキャンセルされたら待たずに終わる
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	ecsMock := mock_ecsiface.NewMockECSAPI(ctrl)
+	ecsMock.EXPECT().RegisterTaskDefinition(gomock.Any()).Return(&ecs.RegisterTaskDefinitionOutput{
+		TaskDefinition: &ecs.TaskDefinition{TaskDefinitionArn: aws.String("arn://td:2")},
+	}, nil)
+	ecsMock.EXPECT().CreateService(gomock.Any()).DoAndReturn(func(input *ecs.CreateServiceInput) (*ecs.CreateServiceOutput, error) {
+		cancel()
+		return &ecs.CreateServiceOutput{Service: &ecs.Service{ServiceArn: aws.String("arn://service")}}, nil
+	})
+	ecsMock.EXPECT().WaitUntilServicesStableWithContext(gomock.Any(), gomock.Any()).DoAndReturn(func(ctx aws.Context, input *ecs.DescribeServicesInput) error {
+		return ctx.Err()
+	})
+	cagecli := NewCage(&Input{Env: envars, ECS: ecsMock})
+	result, err := cagecli.Up(ctx)
+	assert.Equal(t, context.Canceled, err.(*Error).Err)
+	assert.Equal(t, ErrorKindServiceUpdate, KindOf(err))
+	assert.Equal(t, PhaseCreateService, result.FailedPhase)
+}
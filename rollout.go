@@ -2,80 +2,191 @@ package cage
 
 import (
 	"context"
+	"errors"
 	"fmt"
 	"github.com/apex/log"
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/elbv2"
+	"math"
+	"strings"
 	"time"
 )
 
 type RollOutResult struct {
-	StartTime     time.Time
-	EndTime       time.Time
-	ServiceIntact bool
+	StartTime     time.Time `json:"startTime"`
+	EndTime       time.Time `json:"endTime"`
+	ServiceIntact bool      `json:"serviceIntact"`
+	// true if the service was reverted to the previous task definition after failing to update
+	RolledBack bool `json:"rolledBack"`
+	// error occurred while rolling back the service, if any
+	RollBackError error `json:"-"`
+	// id and final status of CodeDeploy deployment. set only for services with CODE_DEPLOY deployment controller
+	CodeDeployDeploymentId     string `json:"codeDeployDeploymentId,omitempty"`
+	CodeDeployStatus           string `json:"codeDeployStatus,omitempty"`
+	NextTaskDefinitionArn      string `json:"nextTaskDefinitionArn"`
+	NextTaskDefinitionRevision int64  `json:"nextTaskDefinitionRevision"`
+	PreviousTaskDefinitionArn  string `json:"previousTaskDefinitionArn"`
+	// canary tasks, or tasks of canary task set
+	CanaryTasks []*CanaryTaskResult `json:"canaryTasks"`
+	Phases      []*PhaseResult      `json:"phases"`
+	// phase where rolling out failed. empty if succeeded
+	FailedPhase Phase `json:"failedPhase,omitempty"`
 }
 
-func (c *cage) RollOut(ctx context.Context) (*RollOutResult, error) {
-	ret := &RollOutResult{
+// returned error is always *Error that tells how far rolling out proceeded
+func (c *cage) RollOut(ctx context.Context) (ret *RollOutResult, err error) {
+	ret = &RollOutResult{
 		StartTime:     now(),
 		ServiceIntact: true,
 	}
 	var aggregatedError error
-	throw := func(err error) (*RollOutResult, error) {
+	// emitted once with the final error after canary tasks are cleaned up
+	defer func() {
+		if err != nil {
+			c.emit(&Event{Type: EventRollOutFailed, Err: err})
+		}
+	}()
+	throw := func(kind ErrorKind, err error) (*RollOutResult, error) {
 		ret.EndTime = now()
-		aggregatedError = err
-		return ret, err
+		if current := currentPhase(ret.Phases); current != nil {
+			ret.FailedPhase = current.Name
+		}
+		endPhase(ret.Phases)
+		if !ret.ServiceIntact {
+			kind = ErrorKindServiceUpdate
+		}
+		aggregatedError = newError(kind, ret.ServiceIntact, err)
+		return ret, aggregatedError
 	}
 	defer func(result *RollOutResult) {
+		endPhase(ret.Phases)
 		ret.EndTime = now()
 	}(ret)
+	beginPhase(&ret.Phases, PhasePreflight)
 	var service *ecs.Service
 	if out, err := c.ecs.DescribeServices(&ecs.DescribeServicesInput{
 		Cluster: &c.env.Cluster,
 		Services: []*string{
 			&c.env.Service,
 		},
+		// tags are propagated to canary tasks
+		Include: []*string{aws.String(ecs.ServiceFieldTags)},
 	}); err != nil {
 		log.Errorf("failed to describe current service due to: %s", err.Error())
-		return throw(err)
+		return throw(ErrorKindPreflight, err)
 	} else {
 		service = out.Services[0]
 	}
-	if *service.LaunchType == "EC2" && c.env.CanaryInstanceArn == "" {
-		return throw(fmt.Errorf("🥺 --canaryInstanceArn is required when LaunchType = 'EC2'"))
+	if IsCodeDeployService(service) {
+		if c.cd == nil {
+			return throw(ErrorKindInvalidInput, fmt.Errorf("CodeDeploy client is required for service with CODE_DEPLOY deployment controller"))
+		} else if len(c.env.TrafficShiftSteps) > 0 {
+			return throw(ErrorKindInvalidInput, fmt.Errorf("--trafficShiftSteps can't be used for service with CODE_DEPLOY deployment controller"))
+		}
 	}
-	var (
-		targetGroupArn *string
-	)
-	if len(service.LoadBalancers) > 0 {
-		targetGroupArn = service.LoadBalancers[0].TargetGroupArn
+	if !IsExternalService(service) && len(CanaryServiceRegistries(service)) > 0 && c.sd == nil {
+		return throw(ErrorKindInvalidInput, fmt.Errorf("ServiceDiscovery client is required for service with service registries"))
 	}
+	if IsExternalService(service) && len(c.env.TrafficShiftSteps) > 0 {
+		return throw(ErrorKindInvalidInput, fmt.Errorf("--trafficShiftSteps can't be used for service with EXTERNAL deployment controller"))
+	}
+	previousTaskDefinitionArn := service.TaskDefinition
+	ret.PreviousTaskDefinitionArn = aws.StringValue(previousTaskDefinitionArn)
 	log.Infof("ensuring next task definition...")
 	nextTaskDefinition, err := c.CreateNextTaskDefinition()
 	if err != nil {
 		log.Errorf("failed to register next task definition due to: %s", err)
-		return throw(err)
+		return throw(ErrorKindPreflight, err)
+	}
+	ret.NextTaskDefinitionArn = *nextTaskDefinition.TaskDefinitionArn
+	ret.NextTaskDefinitionRevision = aws.Int64Value(nextTaskDefinition.Revision)
+	for _, lb := range service.LoadBalancers {
+		if _, err := LoadBalancedPortMapping(nextTaskDefinition, lb); err != nil {
+			return throw(ErrorKindPreflight, err)
+		}
+	}
+	// canary tasks are registered to target group serving requests
+	canaryService := service
+	if IsCodeDeployService(service) && len(service.LoadBalancers) > 0 {
+		if o, err := c.LiveTargetGroupArn(); err != nil {
+			log.Errorf("failed to find live target group due to: %s", err)
+			return throw(ErrorKindPreflight, err)
+		} else if *o != *service.LoadBalancers[0].TargetGroupArn {
+			log.Infof("target group '%s' is live instead of '%s'", *o, *service.LoadBalancers[0].TargetGroupArn)
+			s := *service
+			lb := *service.LoadBalancers[0]
+			lb.TargetGroupArn = o
+			s.LoadBalancers = append([]*ecs.LoadBalancer{&lb}, service.LoadBalancers[1:]...)
+			canaryService = &s
+		}
 	}
-	log.Infof("starting canary task...")
-	var canaryTask *StartCanaryTaskOutput
-	if o, err := c.StartCanaryTask(nextTaskDefinition); err != nil {
+	var placements []*canaryPlacement
+	if !IsExternalService(service) {
+		if o, err := c.PlanCanaryPlacements(canaryService, nextTaskDefinition, c.CanaryTaskCount(service)); err != nil {
+			log.Errorf("failed to find placement for canary tasks due to: %s", err)
+			return throw(ErrorKindPreflight, err)
+		} else {
+			placements = o
+		}
+	}
+	if IsExternalService(service) {
+		if err := c.RollOutWithTaskSets(ctx, service, nextTaskDefinition, ret); err != nil {
+			log.Errorf("😥 %s", err)
+			return throw(ErrorKindCanary, err)
+		}
+		log.Infof(
+			"🐥 service '%s' successfully rolled out to '%s:%d'!",
+			c.env.Service, *nextTaskDefinition.Family, *nextTaskDefinition.Revision,
+		)
+		endPhase(ret.Phases)
+		ret.EndTime = now()
+		return ret, nil
+	}
+	beginPhase(&ret.Phases, PhaseStartCanary)
+	log.Infof("starting canary tasks...")
+	var canaryTasks []*StartCanaryTaskOutput
+	if o, err := c.startCanaryTasks(ctx, nextTaskDefinition, canaryService, placements); err != nil {
 		log.Errorf("failed to start canary task due to: %s", err)
-		return throw(err)
+		return throw(ErrorKindCanary, err)
 	} else {
-		canaryTask = o
+		canaryTasks = o
 	}
-	// ensure canary task stopped after rolling out
-	defer func(task *StartCanaryTaskOutput, result *RollOutResult) {
-		if task == nil {
-			return
+	// ensure canary tasks stopped after rolling out
+	defer func(tasks []*StartCanaryTaskOutput, result *RollOutResult) {
+		beginPhase(&result.Phases, PhaseStopCanary)
+		defer func() {
+			// health states seen until the end
+			result.CanaryTasks = canaryTaskResults(tasks)
+		}()
+		var failed []string
+		for _, task := range tasks {
+			log.Infof("stopping canary task '%s'...", *task.task.TaskArn)
+			if err := c.StopCanaryTask(task); err != nil {
+				log.Errorf("failed to stop canary task '%s': %s", *task.task.TaskArn, err)
+				failed = append(failed, *task.task.TaskArn)
+				continue
+			}
+			log.Infof("canary task '%s' has successfully been stopped", *task.task.TaskArn)
 		}
-		log.Infof("stopping canary task '%s'...", *canaryTask.task.TaskArn)
-		if err := c.StopCanaryTask(canaryTask); err != nil {
-			log.Fatalf("failed to stop canary task '%s': %s", *canaryTask.task.TaskArn, err)
+		if len(failed) > 0 {
+			cleanupErr := fmt.Errorf("failed to stop canary tasks: %s", strings.Join(failed, ", "))
+			log.Errorf("😱 %s", cleanupErr)
+			switch KindOf(aggregatedError) {
+			case "", ErrorKindPreflight, ErrorKindCanary:
+				if aggregatedError != nil {
+					cleanupErr = fmt.Errorf("%s (%s)", cleanupErr, aggregatedError)
+				}
+				err = &Error{Kind: ErrorKindCleanup, ServiceIntact: result.ServiceIntact, Err: cleanupErr}
+				result.FailedPhase = PhaseStopCanary
+			default:
+				// failure of updating the service is more severe. its kind and phase are kept
+				former := aggregatedError.(*Error)
+				err = &Error{Kind: former.Kind, ServiceIntact: former.ServiceIntact, Err: fmt.Errorf("%s (%s)", former.Err, cleanupErr)}
+			}
+			return
 		}
-		log.Infof("canary task '%s' has successfully been stopped", *canaryTask.task.TaskArn)
 		if aggregatedError == nil {
 			log.Infof(
 				"🐥 service '%s' successfully rolled out to '%s:%d'!",
@@ -86,57 +197,209 @@ func (c *cage) RollOut(ctx context.Context) (*RollOutResult, error) {
 				"😥 %s", aggregatedError,
 			)
 		}
-	}(canaryTask, ret)
-	log.Infof("canary task '%s' ensured.", *canaryTask.task.TaskArn)
-	if targetGroupArn != nil {
-		log.Infof("😷 ensuring canary task to become healthy...")
-		if err := c.EnsureTaskHealthy(
-			canaryTask.task.TaskArn,
-			targetGroupArn,
-			canaryTask.targetId,
-			canaryTask.targetPort,
-		); err != nil {
-			return throw(err)
-		}
-		log.Info("🤩 canary task is healthy!")
-	}
-	ret.ServiceIntact = false
+	}(canaryTasks, ret)
+	for _, canaryTask := range canaryTasks {
+		log.Infof("canary task '%s' ensured.", *canaryTask.task.TaskArn)
+	}
+	beginPhase(&ret.Phases, PhaseVerifyCanary)
+	if err := c.VerifyCanaryTasks(ctx, nextTaskDefinition, canaryTasks); err != nil {
+		return throw(ErrorKindCanary, err)
+	}
+	if c.approver != nil {
+		beginPhase(&ret.Phases, PhaseApproval)
+		if err := c.WaitForApproval(ctx, nextTaskDefinition, canaryTasks); err != nil {
+			return throw(ErrorKindCanary, err)
+		}
+	}
+	beginPhase(&ret.Phases, PhaseUpdateService)
+	// throw classifies it as service_update once the service is changed
+	if IsCodeDeployService(service) {
+		if err := c.RollOutWithCodeDeploy(ctx, service, nextTaskDefinition, ret); err != nil {
+			return throw(ErrorKindCanary, err)
+		}
+	} else if len(c.env.TrafficShiftSteps) > 0 {
+		if err := c.RollOutWithTrafficShifting(ctx, service, nextTaskDefinition, previousTaskDefinitionArn, ret); err != nil {
+			return throw(ErrorKindCanary, err)
+		}
+	} else if err := c.UpdateServiceTaskDefinition(ctx, nextTaskDefinition, previousTaskDefinitionArn, ret); err != nil {
+		return throw(ErrorKindCanary, err)
+	}
+	endPhase(ret.Phases)
+	ret.EndTime = now()
+	return ret, nil
+}
+
+// ensure canary tasks become healthy, keep running for minimum uptime, survive soak period and satisfy metric thresholds
+func (c *cage) VerifyCanaryTasks(ctx context.Context, nextTaskDefinition *ecs.TaskDefinition, canaryTasks []*StartCanaryTaskOutput) error {
+	targetGroupArns := CanaryTargetGroupArns(canaryTasks)
+	registryArns := CanaryRegistryArns(canaryTasks)
+	// container health checks come first. custom health status of Cloud Map is reported based on them
+	containers := HealthCheckedContainers(nextTaskDefinition)
+	if len(containers) > 0 {
+		log.Infof("😷 ensuring canary tasks to become healthy by health checks of %d containers...", len(containers))
+		for _, canaryTask := range canaryTasks {
+			if err := c.EnsureContainersHealthy(ctx, canaryTask, containers); err != nil {
+				log.Errorf("😨 %s", err)
+				return err
+			}
+		}
+	}
+	if len(targetGroupArns) > 0 || len(registryArns) > 0 {
+		log.Infof(
+			"😷 ensuring canary tasks to become healthy in %d target groups and %d Cloud Map services...",
+			len(targetGroupArns), len(registryArns),
+		)
+		for _, canaryTask := range canaryTasks {
+			if err := c.EnsureCanaryTaskHealthy(ctx, canaryTask); err != nil {
+				return err
+			}
+		}
+		log.Info("🤩 canary tasks are healthy!")
+	} else if len(containers) > 0 {
+		// neither load balancer nor service registry is attached. e.g. queue workers
+		log.Info("🤩 canary tasks are healthy!")
+	} else {
+		log.Warnf("no health check is defined for essential containers. canary tasks are only ensured to be running")
+	}
+	if len(c.env.Probes) > 0 {
+		log.Infof("🔍 sending %d probes to canary tasks...", len(c.env.Probes))
+		if err := c.ProbeCanaryTasks(ctx, canaryTasks); err != nil {
+			log.Errorf("😨 %s", err)
+			return err
+		}
+		log.Infof("canary tasks have passed all probes!")
+	}
+	if c.env.CanaryMinUptime > 0 {
+		log.Infof("⏱ ensuring canary tasks keep running for %s...", c.env.CanaryMinUptime)
+		if err := c.WatchCanaryTasks(ctx, canaryTasks, c.env.CanaryMinUptime); err != nil {
+			log.Errorf("😨 %s", err)
+			return err
+		}
+		log.Infof("canary tasks have been running for %s!", c.env.CanaryMinUptime)
+	}
+	if c.env.CanarySoakDuration > 0 {
+		log.Infof("🍵 soaking canary tasks for %s...", c.env.CanarySoakDuration)
+		if err := c.SoakCanaryTasks(ctx, canaryTasks, c.env.CanarySoakDuration); err != nil {
+			log.Errorf("😨 %s", err)
+			return err
+		}
+		log.Infof("canary tasks have survived soak period!")
+	}
+	if c.MetricsAnalysisEnabled() {
+		if len(targetGroupArns) == 0 {
+			log.Warnf("no load balancer is attached to service '%s'. skip analyzing metrics", c.env.Service)
+		} else if targetGroupArns = ApplicationTargetGroupArns(canaryTasks); len(targetGroupArns) == 0 {
+			log.Warnf("metrics of network load balancer are not supported. skip analyzing metrics")
+		} else if _, err := c.AnalyzeCanaryMetrics(ctx, targetGroupArns); err != nil {
+			log.Errorf("😨 %s", err)
+			return err
+		} else {
+			log.Info("📊 metrics of target group satisfy thresholds!")
+		}
+	}
+	return nil
+}
+
+// update service to next task definition and wait for it to be stable.
+// if it doesn't become stable, service will be rolled back to the previous task definition
+func (c *cage) UpdateServiceTaskDefinition(
+	ctx context.Context,
+	nextTaskDefinition *ecs.TaskDefinition,
+	previousTaskDefinitionArn *string,
+	result *RollOutResult,
+) error {
+	rollback := func(err error) error {
+		log.Errorf("failed to update service '%s' due to: %s", c.env.Service, err)
+		if rollbackErr := c.RollBackService(previousTaskDefinitionArn); rollbackErr != nil {
+			log.Errorf("😱 failed to roll back service '%s': %s", c.env.Service, rollbackErr)
+			result.RollBackError = rollbackErr
+		} else {
+			result.RolledBack = true
+		}
+		return err
+	}
 	log.Infof(
 		"updating '%s' 's task definition to '%s:%d'...",
 		c.env.Service, *nextTaskDefinition.Family, *nextTaskDefinition.Revision,
 	)
+	c.emit(&Event{Type: EventServiceUpdateStarted, TaskDefinitionArn: *nextTaskDefinition.TaskDefinitionArn})
 	if _, err := c.ecs.UpdateService(&ecs.UpdateServiceInput{
 		Cluster:        &c.env.Cluster,
 		Service:        &c.env.Service,
 		TaskDefinition: nextTaskDefinition.TaskDefinitionArn,
 	}); err != nil {
-		return throw(err)
+		// service was not changed and there is nothing to roll back
+		log.Errorf("failed to update service '%s' due to: %s", c.env.Service, err)
+		return err
 	}
+	result.ServiceIntact = false
 	log.Infof("waiting for service '%s' to be stable...", c.env.Service)
 	//TODO: avoid stdout sticking while CI
-	if err := c.ecs.WaitUntilServicesStable(&ecs.DescribeServicesInput{
+	if err := c.ecs.WaitUntilServicesStableWithContext(ctx, &ecs.DescribeServicesInput{
 		Cluster:  &c.env.Cluster,
 		Services: []*string{&c.env.Service},
 	}); err != nil {
-		return throw(err)
+		return rollback(err)
 	}
 	log.Infof("🥴 service '%s' has become to be stable!", c.env.Service)
-	ret.EndTime = now()
-	return ret, nil
+	c.emit(&Event{Type: EventServiceStable, TaskDefinitionArn: *nextTaskDefinition.TaskDefinitionArn})
+	return nil
+}
+
+func (c *cage) RollBackService(taskDefinitionArn *string) error {
+	if taskDefinitionArn == nil {
+		return fmt.Errorf("previous task definition of service '%s' is unknown", c.env.Service)
+	}
+	log.Infof("⏪ rolling back service '%s' to '%s'...", c.env.Service, *taskDefinitionArn)
+	if _, err := c.ecs.UpdateService(&ecs.UpdateServiceInput{
+		Cluster:        &c.env.Cluster,
+		Service:        &c.env.Service,
+		TaskDefinition: taskDefinitionArn,
+	}); err != nil {
+		return err
+	}
+	log.Infof("waiting for service '%s' to be stable again...", c.env.Service)
+	if err := c.ecs.WaitUntilServicesStable(&ecs.DescribeServicesInput{
+		Cluster:  &c.env.Cluster,
+		Services: []*string{&c.env.Service},
+	}); err != nil {
+		return err
+	}
+	log.Infof("service '%s' has been rolled back to '%s'", c.env.Service, *taskDefinitionArn)
+	return nil
 }
 
 func (c *cage) EnsureTaskHealthy(
+	ctx context.Context,
 	taskArn *string,
-	tgArn *string,
-	targetId *string,
-	targetPort *int64,
+	target *canaryTarget,
 ) error {
-	log.Infof("checking canary task's health state...")
+	tgArn := target.targetGroupArn
+	targetId := target.targetId
+	targetPort := target.targetPort
+	interval, timeout := c.TargetHealthCheckPolicy(target)
+	log.Infof("checking canary task's health state in target group '%s' every %s for %s...", *tgArn, interval, timeout)
 	var unusedCount = 0
 	var initialized = false
 	var recentState *string
+	var previousState string
+	start := now()
+	deadline := start.Add(timeout)
 	for {
-		<-newTimer(time.Duration(15) * time.Second).C
+		remaining := deadline.Sub(now())
+		if remaining <= 0 {
+			log.Errorf("😨 canary task '%s' didn't become healthy in %s", *taskArn, timeout)
+			return fmt.Errorf(
+				"canary task '%s' (%s:%d) didn't become healthy in %s. recent state: %s",
+				*taskArn, *targetId, *targetPort, timeout, aws.StringValue(recentState),
+			)
+		}
+		if remaining > interval {
+			remaining = interval
+		}
+		if err := sleep(ctx, remaining); err != nil {
+			return err
+		}
 		if o, err := c.alb.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
 			TargetGroupArn: tgArn,
 			Targets: []*elbv2.TargetDescription{{
@@ -151,6 +414,17 @@ func (c *cage) EnsureTaskHealthy(
 				return fmt.Errorf("'%s' is not registered to target group '%s'", *targetId, *tgArn)
 			}
 			log.Infof("canary task '%s' (%s:%d) state is: %s", *taskArn, *targetId, *targetPort, *recentState)
+			target.healthState = *recentState
+			if *recentState != previousState {
+				c.emit(&Event{
+					Type:           EventCanaryTaskHealthStateChanged,
+					TaskArn:        *taskArn,
+					TargetGroupArn: *tgArn,
+					Target:         fmt.Sprintf("%s:%d", *targetId, *targetPort),
+					HealthState:    *recentState,
+				})
+				previousState = *recentState
+			}
 			switch *recentState {
 			case "healthy":
 				return nil
@@ -160,9 +434,20 @@ func (c *cage) EnsureTaskHealthy(
 				continue
 			case "unused":
 				unusedCount++
-				if !initialized && unusedCount < 5 {
+				if !initialized && unusedCount < target.targetGroup.unusedBudget(interval) {
 					continue
 				}
+			case "unhealthy":
+				// same as ECS, failed health checks are ignored during the grace period of the service
+				if now().Sub(start) < target.healthCheckGracePeriod {
+					log.Infof("still in health check grace period...")
+					continue
+				}
+			case "unavailable":
+				if target.targetGroup.healthCheckDisabled() {
+					log.Warnf("health check of target group '%s' is disabled. canary task is regarded as healthy", *tgArn)
+					return nil
+				}
 			default:
 			}
 		}
@@ -175,6 +460,127 @@ func (c *cage) EnsureTaskHealthy(
 	}
 }
 
+// interval of polling health state of the target and timeout for it to become healthy.
+// derived from health check settings of the target group and grace period of the service unless specified
+func (c *cage) TargetHealthCheckPolicy(target *canaryTarget) (time.Duration, time.Duration) {
+	interval := target.targetGroup.healthCheckInterval()
+	if c.env.TargetHealthCheckInterval > 0 {
+		interval = c.env.TargetHealthCheckInterval
+	}
+	timeout := target.healthCheckGracePeriod + target.targetGroup.healthCheckTimeout()
+	if c.env.TargetHealthCheckTimeout > 0 {
+		timeout = c.env.TargetHealthCheckTimeout
+	}
+	return interval, timeout
+}
+
+// keep canary tasks registered to the target group and serving traffic for the duration.
+// returns error if any of them stops or leaves healthy state during the period
+func (c *cage) SoakCanaryTasks(ctx context.Context, tasks []*StartCanaryTaskOutput, duration time.Duration) error {
+	deadline := now().Add(duration)
+	for {
+		remaining := deadline.Sub(now())
+		if remaining <= 0 {
+			return nil
+		}
+		interval := time.Duration(15) * time.Second
+		if remaining < interval {
+			interval = remaining
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+		if err := c.EnsureTasksRunning(tasks); err != nil {
+			return err
+		}
+		for _, task := range tasks {
+			for _, target := range task.targets {
+				if o, err := c.alb.DescribeTargetHealth(&elbv2.DescribeTargetHealthInput{
+					TargetGroupArn: target.targetGroupArn,
+					Targets: []*elbv2.TargetDescription{{
+						Id:   target.targetId,
+						Port: target.targetPort,
+					}},
+				}); err != nil {
+					return err
+				} else if state := GetTargetIsHealthy(o, target.targetId, target.targetPort); state == nil {
+					return fmt.Errorf("'%s' has been deregistered from target group '%s'", *target.targetId, *target.targetGroupArn)
+				} else if target.healthState = *state; *state != "healthy" {
+					return fmt.Errorf(
+						"canary task '%s' (%s:%d) has left healthy state in target group '%s' during soak period. recent state: %s",
+						*task.task.TaskArn, *target.targetId, *target.targetPort, *target.targetGroupArn, *state,
+					)
+				}
+			}
+		}
+		log.Infof("canary tasks are still healthy. %s remaining...", deadline.Sub(now()))
+	}
+}
+
+func (c *cage) EnsureTasksRunning(tasks []*StartCanaryTaskOutput) error {
+	var arns []*string
+	for _, task := range tasks {
+		arns = append(arns, task.task.TaskArn)
+	}
+	o, err := c.ecs.DescribeTasks(&ecs.DescribeTasksInput{
+		Cluster: &c.env.Cluster,
+		Tasks:   arns,
+	})
+	if err != nil {
+		return err
+	}
+	for _, arn := range arns {
+		var task *ecs.Task
+		for _, v := range o.Tasks {
+			if *v.TaskArn == *arn {
+				task = v
+			}
+		}
+		if task == nil {
+			return fmt.Errorf("canary task '%s' was not found", *arn)
+		} else if aws.StringValue(task.LastStatus) != "RUNNING" {
+			return fmt.Errorf("canary task '%s' has stopped: %s", *arn, StoppedReason(task))
+		}
+	}
+	return nil
+}
+
+// stopped reason of the task with exit codes of its containers
+func StoppedReason(task *ecs.Task) string {
+	var exitCodes []string
+	for _, container := range task.Containers {
+		if container.ExitCode != nil {
+			exitCodes = append(exitCodes, fmt.Sprintf("%s=%d", *container.Name, *container.ExitCode))
+		}
+	}
+	if len(exitCodes) == 0 {
+		return aws.StringValue(task.StoppedReason)
+	}
+	return fmt.Sprintf("%s (exit codes: %s)", aws.StringValue(task.StoppedReason), strings.Join(exitCodes, ", "))
+}
+
+// keep watching canary tasks not to stop for the duration
+func (c *cage) WatchCanaryTasks(ctx context.Context, tasks []*StartCanaryTaskOutput, duration time.Duration) error {
+	deadline := now().Add(duration)
+	for {
+		remaining := deadline.Sub(now())
+		if remaining <= 0 {
+			return nil
+		}
+		interval := time.Duration(10) * time.Second
+		if remaining < interval {
+			interval = remaining
+		}
+		if err := sleep(ctx, interval); err != nil {
+			return err
+		}
+		if err := c.EnsureTasksRunning(tasks); err != nil {
+			return err
+		}
+		log.Infof("canary tasks are still running. %s remaining...", deadline.Sub(now()))
+	}
+}
+
 func GetTargetIsHealthy(o *elbv2.DescribeTargetHealthOutput, targetId *string, targetPort *int64) *string {
 	for _, desc := range o.TargetHealthDescriptions {
 		log.Debugf("%+v", desc)
@@ -203,11 +609,30 @@ func (c *cage) CreateNextTaskDefinition() (*ecs.TaskDefinition, error) {
 		if out, err := c.ecs.RegisterTaskDefinition(c.env.TaskDefinitionInput); err != nil {
 			return nil, err
 		} else {
+			c.emit(&Event{Type: EventTaskDefinitionRegistered, TaskDefinitionArn: *out.TaskDefinition.TaskDefinitionArn})
 			return out.TaskDefinition, nil
 		}
 	}
 }
 
+// port mapping of the container that receives traffic from the load balancer
+func LoadBalancedPortMapping(taskDefinition *ecs.TaskDefinition, lb *ecs.LoadBalancer) (*ecs.PortMapping, error) {
+	for _, container := range taskDefinition.ContainerDefinitions {
+		if aws.StringValue(container.Name) != aws.StringValue(lb.ContainerName) {
+			continue
+		}
+		for _, mapping := range container.PortMappings {
+			if aws.Int64Value(mapping.ContainerPort) == aws.Int64Value(lb.ContainerPort) {
+				return mapping, nil
+			}
+		}
+	}
+	return nil, fmt.Errorf(
+		"🥺 next task definition has no port mapping for container '%s' and port %d of load balancer",
+		aws.StringValue(lb.ContainerName), aws.Int64Value(lb.ContainerPort),
+	)
+}
+
 func (c *cage) DescribeSubnet(subnetId *string) (*ec2.Subnet, error) {
 	if o, err := c.ec2.DescribeSubnets(&ec2.DescribeSubnetsInput{
 		SubnetIds: []*string{subnetId},
@@ -219,61 +644,318 @@ func (c *cage) DescribeSubnet(subnetId *string) (*ec2.Subnet, error) {
 }
 
 type StartCanaryTaskOutput struct {
-	task                *ecs.Task
+	task *ecs.Task
+	// targets are not registered (and deregistered) by cage
 	registrationSkipped bool
-	targetGroupArn      *string
-	availabilityZone    *string
-	targetId            *string
-	targetPort          *int64
+	// one for each load balancer of the service
+	targets []*canaryTarget
+	// one for each service registry of the service
+	registrations []*canaryRegistration
+	// address for sending probes directly
+	privateIp *string
+	// the final health status by container health checks
+	healthStatus string
+	// any essential container of the task has health check
+	containerHealthCheck bool
 }
 
-func (c *cage) StartCanaryTask(nextTaskDefinition *ecs.TaskDefinition) (*StartCanaryTaskOutput, error) {
-	var service *ecs.Service
-	if o, err := c.ecs.DescribeServices(&ecs.DescribeServicesInput{
-		Cluster:  &c.env.Cluster,
-		Services: []*string{&c.env.Service},
+type canaryTarget struct {
+	targetGroup      *targetGroupInfo
+	targetGroupArn   *string
+	availabilityZone *string
+	targetId         *string
+	targetPort       *int64
+	// health check grace period of the service
+	healthCheckGracePeriod time.Duration
+	// the final health state seen
+	healthState string
+}
+
+// ip:port of canary task to access directly, with the port registered to the first target group
+// or Cloud Map service. empty if unknown
+func (o *StartCanaryTaskOutput) address() string {
+	if o.privateIp == nil {
+		return ""
+	}
+	if len(o.targets) > 0 {
+		return fmt.Sprintf("%s:%d", *o.privateIp, *o.targets[0].targetPort)
+	}
+	for _, registration := range o.registrations {
+		if registration.port != nil {
+			return fmt.Sprintf("%s:%d", *o.privateIp, *registration.port)
+		}
+	}
+	return ""
+}
+
+// distinct Cloud Map services canary tasks are registered to
+func CanaryRegistryArns(tasks []*StartCanaryTaskOutput) []*string {
+	var ret []*string
+	found := make(map[string]bool)
+	for _, task := range tasks {
+		for _, registration := range task.registrations {
+			if !found[*registration.registryArn] {
+				found[*registration.registryArn] = true
+				ret = append(ret, registration.registryArn)
+			}
+		}
+	}
+	return ret
+}
+
+// service registries of Cloud Map the canary task is registered to
+func CanaryServiceRegistries(service *ecs.Service) []*ecs.ServiceRegistry {
+	var ret []*ecs.ServiceRegistry
+	for _, v := range service.ServiceRegistries {
+		if aws.StringValue(v.RegistryArn) != "" {
+			ret = append(ret, v)
+		}
+	}
+	return ret
+}
+
+// distinct target groups canary tasks are registered to
+func CanaryTargetGroupArns(tasks []*StartCanaryTaskOutput) []*string {
+	var ret []*string
+	found := make(map[string]bool)
+	for _, task := range tasks {
+		for _, target := range task.targets {
+			if !found[*target.targetGroupArn] {
+				found[*target.targetGroupArn] = true
+				ret = append(ret, target.targetGroupArn)
+			}
+		}
+	}
+	return ret
+}
+
+// distinct target groups of application load balancer canary tasks are registered to
+func ApplicationTargetGroupArns(tasks []*StartCanaryTaskOutput) []*string {
+	var ret []*string
+	found := make(map[string]bool)
+	for _, task := range tasks {
+		for _, target := range task.targets {
+			if !target.targetGroup.isNetwork() && !found[*target.targetGroupArn] {
+				found[*target.targetGroupArn] = true
+				ret = append(ret, target.targetGroupArn)
+			}
+		}
+	}
+	return ret
+}
+
+// ensure canary task becomes healthy in all target groups it is registered to
+func (c *cage) EnsureCanaryTaskHealthy(ctx context.Context, task *StartCanaryTaskOutput) error {
+	for _, target := range task.targets {
+		if err := c.EnsureTaskHealthy(ctx, task.task.TaskArn, target); err != nil {
+			return err
+		}
+	}
+	for _, registration := range task.registrations {
+		if err := c.EnsureInstanceHealthy(ctx, task, registration); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// number of canary tasks to be started for the service
+func (c *cage) CanaryTaskCount(service *ecs.Service) int64 {
+	if c.env.CanaryPercentage > 0 {
+		count := int64(math.Ceil(float64(*service.DesiredCount) * float64(c.env.CanaryPercentage) / 100))
+		if count < 1 {
+			return 1
+		}
+		return count
+	}
+	if c.env.CanaryCount > 0 {
+		return c.env.CanaryCount
+	}
+	return 1
+}
+
+// start canary tasks spread across subnets in distinct availability zones as far as possible.
+// if any of them failed to start (or ctx is cancelled), already started tasks will be stopped.
+func (c *cage) StartCanaryTasks(
+	ctx context.Context,
+	nextTaskDefinition *ecs.TaskDefinition,
+	service *ecs.Service,
+	count int64,
+) ([]*StartCanaryTaskOutput, error) {
+	placements, err := c.PlanCanaryPlacements(service, nextTaskDefinition, count)
+	if err != nil {
+		return nil, err
+	}
+	return c.startCanaryTasks(ctx, nextTaskDefinition, service, placements)
+}
+
+func (c *cage) startCanaryTasks(
+	ctx context.Context,
+	nextTaskDefinition *ecs.TaskDefinition,
+	service *ecs.Service,
+	placements []*canaryPlacement,
+) ([]*StartCanaryTaskOutput, error) {
+	count := len(placements)
+	var ret []*StartCanaryTaskOutput
+	started := false
+	defer func() {
+		if started {
+			return
+		}
+		// also on panic
+		for _, task := range ret {
+			log.Infof("stopping canary task '%s'...", *task.task.TaskArn)
+			if err := c.StopCanaryTask(task); err != nil {
+				log.Errorf("failed to stop canary task '%s': %s", *task.task.TaskArn, err)
+			}
+		}
+	}()
+	for i, placement := range placements {
+		log.Infof("starting canary task (%d/%d)...", i+1, count)
+		o, err := c.StartCanaryTask(ctx, nextTaskDefinition, service, placement)
+		if err != nil {
+			return nil, err
+		}
+		ret = append(ret, o)
+	}
+	started = true
+	return ret, nil
+}
+
+// build network configurations for each canary task.
+// subnets of awsvpc configuration are assigned in round robin across availability zones
+func (c *cage) SpreadNetworkConfiguration(base *ecs.NetworkConfiguration, count int64) ([]*ecs.NetworkConfiguration, error) {
+	ret := make([]*ecs.NetworkConfiguration, count)
+	if base == nil || base.AwsvpcConfiguration == nil || len(base.AwsvpcConfiguration.Subnets) <= 1 || count == 1 {
+		for i := range ret {
+			ret[i] = base
+		}
+		return ret, nil
+	}
+	subnets, err := c.DescribeSubnetZones(base.AwsvpcConfiguration.Subnets)
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(subnets.zones)) < count {
+		log.Warnf("%d canary tasks will be placed in only %d availability zones", count, len(subnets.zones))
+	}
+	for i := range ret {
+		zone := subnets.zones[i%len(subnets.zones)]
+		if ret[i], err = subnets.networkConfiguration(base, zone, i/len(subnets.zones)); err != nil {
+			return nil, err
+		}
+	}
+	return ret, nil
+}
+
+// subnets of awsvpc configuration grouped by availability zone
+type subnetZones struct {
+	// in the order of subnets
+	zones   []string
+	subnets map[string][]*string
+}
+
+func (c *cage) DescribeSubnetZones(subnetIds []*string) (*subnetZones, error) {
+	ret := &subnetZones{subnets: make(map[string][]*string)}
+	if o, err := c.ec2.DescribeSubnets(&ec2.DescribeSubnetsInput{
+		SubnetIds: subnetIds,
 	}); err != nil {
 		return nil, err
 	} else {
-		service = o.Services[0]
+		for _, subnet := range o.Subnets {
+			az := *subnet.AvailabilityZone
+			if _, ok := ret.subnets[az]; !ok {
+				ret.zones = append(ret.zones, az)
+			}
+			ret.subnets[az] = append(ret.subnets[az], subnet.SubnetId)
+		}
+	}
+	if len(ret.zones) == 0 {
+		return nil, fmt.Errorf("subnets of the service were not found: %s", strings.Join(aws.StringValueSlice(subnetIds), ", "))
+	}
+	return ret, nil
+}
+
+func (s *subnetZones) has(zone string) bool {
+	_, ok := s.subnets[zone]
+	return ok
+}
+
+// zone of the subnet if the configuration has only one subnet
+func (s *subnetZones) zoneOf(networkConfiguration *ecs.NetworkConfiguration) string {
+	if networkConfiguration == nil || networkConfiguration.AwsvpcConfiguration == nil || len(networkConfiguration.AwsvpcConfiguration.Subnets) != 1 {
+		return ""
+	}
+	for zone, subnets := range s.subnets {
+		for _, v := range subnets {
+			if aws.StringValue(v) == aws.StringValue(networkConfiguration.AwsvpcConfiguration.Subnets[0]) {
+				return zone
+			}
+		}
 	}
+	return ""
+}
+
+// copy of the configuration with n-th subnet (in round robin) in the zone
+func (s *subnetZones) networkConfiguration(base *ecs.NetworkConfiguration, zone string, n int) (*ecs.NetworkConfiguration, error) {
+	subnets, ok := s.subnets[zone]
+	if !ok {
+		return nil, fmt.Errorf("service has no subnet in availability zone '%s'", zone)
+	}
+	vpc := *base.AwsvpcConfiguration
+	vpc.Subnets = []*string{subnets[n%len(subnets)]}
+	return &ecs.NetworkConfiguration{AwsvpcConfiguration: &vpc}, nil
+}
+
+func (c *cage) StartCanaryTask(
+	ctx context.Context,
+	nextTaskDefinition *ecs.TaskDefinition,
+	service *ecs.Service,
+	plan *canaryPlacement,
+) (*StartCanaryTaskOutput, error) {
 	var taskArn *string
-	if c.env.CanaryInstanceArn != "" {
+	if plan.instanceArn != "" {
 		// ec2
-		startTask := &ecs.StartTaskInput{
-			Cluster:              &c.env.Cluster,
-			Group:                aws.String(fmt.Sprintf("cage:canary-task:%s", c.env.Service)),
-			NetworkConfiguration: service.NetworkConfiguration,
-			TaskDefinition:       nextTaskDefinition.TaskDefinitionArn,
-			ContainerInstances:   []*string{&c.env.CanaryInstanceArn},
-		}
-		if o, err := c.ecs.StartTask(startTask); err != nil {
+		if o, err := c.ecs.StartTask(c.CanaryStartTaskInput(nextTaskDefinition, service, plan)); err != nil {
 			return nil, err
 		} else {
 			taskArn = o.Tasks[0].TaskArn
 		}
 	} else {
-		// fargate
-		if o, err := c.ecs.RunTask(&ecs.RunTaskInput{
-			Cluster:              &c.env.Cluster,
-			Group:                aws.String(fmt.Sprintf("cage:canary-task:%s", c.env.Service)),
-			NetworkConfiguration: service.NetworkConfiguration,
-			TaskDefinition:       nextTaskDefinition.TaskDefinitionArn,
-			LaunchType:           aws.String("FARGATE"),
-		}); err != nil {
+		// fargate or capacity providers
+		if o, err := c.ecs.RunTask(c.CanaryRunTaskInput(nextTaskDefinition, service, plan.networkConfiguration)); err != nil {
 			return nil, err
+		} else if len(o.Tasks) == 0 {
+			return nil, fmt.Errorf("failed to run canary task: %s", o.Failures)
 		} else {
 			taskArn = o.Tasks[0].TaskArn
 		}
 	}
+	ret := &StartCanaryTaskOutput{
+		task:                 &ecs.Task{TaskArn: taskArn},
+		containerHealthCheck: len(HealthCheckedContainers(nextTaskDefinition)) > 0,
+	}
+	// stop canary task and deregister it from target groups already registered
+	// unless it has been started successfully. also on cancellation or panic
+	started := false
+	defer func() {
+		if started {
+			return
+		}
+		if stopErr := c.StopCanaryTask(ret); stopErr != nil {
+			log.Errorf("failed to stop canary task '%s': %s", *taskArn, stopErr)
+		}
+	}()
+	c.emit(&Event{Type: EventCanaryTaskStarted, TaskDefinitionArn: *nextTaskDefinition.TaskDefinitionArn, TaskArn: *taskArn})
 	log.Infof("🥚 waiting for canary task '%s' is running...", *taskArn)
-	if err := c.ecs.WaitUntilTasksRunning(&ecs.DescribeTasksInput{
+	if err := c.ecs.WaitUntilTasksRunningWithContext(ctx, &ecs.DescribeTasksInput{
 		Cluster: &c.env.Cluster,
 		Tasks:   []*string{taskArn},
 	}); err != nil {
 		return nil, err
 	}
 	log.Infof("🐣 canary task '%s' is running!️", *taskArn)
+	c.emit(&Event{Type: EventCanaryTaskRunning, TaskDefinitionArn: *nextTaskDefinition.TaskDefinitionArn, TaskArn: *taskArn})
 	var task *ecs.Task
 	if o, err := c.ecs.DescribeTasks(&ecs.DescribeTasksInput{
 		Cluster: &c.env.Cluster,
@@ -283,113 +965,323 @@ func (c *cage) StartCanaryTask(nextTaskDefinition *ecs.TaskDefinition) (*StartCa
 	} else {
 		task = o.Tasks[0]
 	}
-	if len(service.LoadBalancers) == 0 {
-		log.Infof("no load balancer is attached to service '%s'. skip registration to target group", *service.ServiceName)
-		return &StartCanaryTaskOutput{
-			task:                task,
-			registrationSkipped: true,
-		}, nil
-	}
-	var targetId *string
-	var targetPort *int64
-	var subnet *ec2.Subnet
-	for _, container := range nextTaskDefinition.ContainerDefinitions {
-		if *container.Name == *service.LoadBalancers[0].ContainerName {
-			targetPort = container.PortMappings[0].HostPort
-		}
-	}
-	if *task.LaunchType == "FARGATE" {
-		details := task.Attachments[0].Details
-		var subnetId *string
-		var privateIp *string
-		for _, v := range details {
-			if *v.Name == "subnetId" {
-				subnetId = v.Value
-			} else if *v.Name == "privateIPv4Address" {
-				privateIp = v.Value
-			}
-		}
-		if o, err := c.ec2.DescribeSubnets(&ec2.DescribeSubnetsInput{
-			SubnetIds: []*string{subnetId},
-		}); err != nil {
+	ret.task = task
+	registries := CanaryServiceRegistries(service)
+	if len(service.LoadBalancers) == 0 && len(registries) == 0 {
+		log.Infof("neither load balancer nor service registry is attached to service '%s'. skip registration of canary task", *service.ServiceName)
+		ret.registrationSkipped = true
+		started = true
+		return ret, nil
+	}
+	placement, err := c.DescribeTaskPlacement(task)
+	if err != nil {
+		return nil, err
+	}
+	subnet, err := c.DescribeSubnet(placement.subnetId)
+	if err != nil {
+		return nil, err
+	}
+	if placement.instanceId != nil {
+		log.Infof("canary task was placed: instanceId = '%s', privateIp = '%s', az = '%s'", *placement.instanceId, *placement.privateIp, *subnet.AvailabilityZone)
+	} else {
+		log.Infof("canary task was placed: privateIp = '%s', az = '%s'", *placement.privateIp, *subnet.AvailabilityZone)
+	}
+	ret.privateIp = placement.privateIp
+	for _, lb := range service.LoadBalancers {
+		tg, err := c.DescribeTargetGroup(lb.TargetGroupArn)
+		if err != nil {
 			return nil, err
-		} else {
-			subnet = o.Subnets[0]
 		}
-		targetId = privateIp
-		log.Infof("canary task was placed: privateIp = '%s', hostPort = '%d', az = '%s'", *targetId, *targetPort, *subnet.AvailabilityZone)
-	} else {
-		var containerInstance *ecs.ContainerInstance
-		if outputs, err := c.ecs.DescribeContainerInstances(&ecs.DescribeContainerInstancesInput{
-			Cluster:            &c.env.Cluster,
-			ContainerInstances: []*string{&c.env.CanaryInstanceArn},
-		}); err != nil {
+		if tg.isNetwork() && tg.preserveClientIp {
+			log.Warnf("client IP preservation is enabled on target group '%s'. canary task receives traffic from clients' IP directly", *lb.TargetGroupArn)
+		}
+		target, err := c.taskTarget(task, lb, tg, placement)
+		if err != nil {
 			return nil, err
-		} else {
-			containerInstance = outputs.ContainerInstances[0]
 		}
-		if o, err := c.ec2.DescribeInstances(&ec2.DescribeInstancesInput{
-			InstanceIds: []*string{containerInstance.Ec2InstanceId},
+		target.availabilityZone = subnet.AvailabilityZone
+		target.healthCheckGracePeriod = time.Duration(aws.Int64Value(service.HealthCheckGracePeriodSeconds)) * time.Second
+		log.Infof("registering '%s:%d' to target group '%s'...", *target.targetId, *target.targetPort, *lb.TargetGroupArn)
+		if _, err := c.alb.RegisterTargets(&elbv2.RegisterTargetsInput{
+			TargetGroupArn: target.targetGroupArn,
+			Targets: []*elbv2.TargetDescription{{
+				AvailabilityZone: target.availabilityZone,
+				Id:               target.targetId,
+				Port:             target.targetPort,
+			}},
 		}); err != nil {
 			return nil, err
-		} else if sn, err := c.DescribeSubnet(o.Reservations[0].Instances[0].SubnetId); err != nil {
+		}
+		c.emit(&Event{
+			Type:           EventCanaryTaskRegistered,
+			TaskArn:        *taskArn,
+			TargetGroupArn: *target.targetGroupArn,
+			Target:         fmt.Sprintf("%s:%d", *target.targetId, *target.targetPort),
+		})
+		ret.targets = append(ret.targets, target)
+	}
+	for _, registry := range registries {
+		if registration, err := c.RegisterCanaryInstance(ctx, task, registry, placement, subnet.AvailabilityZone); err != nil {
 			return nil, err
 		} else {
-			targetId = containerInstance.Ec2InstanceId
-			subnet = sn
+			c.emit(&Event{
+				Type:        EventCanaryTaskRegistered,
+				TaskArn:     *taskArn,
+				RegistryArn: *registration.registryArn,
+				Target:      *registration.instanceId,
+			})
+			ret.registrations = append(ret.registrations, registration)
 		}
-		log.Infof("canary task was placed: instanceId = '%s', hostPort = '%d', az = '%s'", *targetId, *targetPort, *subnet.AvailabilityZone)
 	}
-	if _, err := c.alb.RegisterTargets(&elbv2.RegisterTargetsInput{
-		TargetGroupArn: service.LoadBalancers[0].TargetGroupArn,
-		Targets: []*elbv2.TargetDescription{{
-			AvailabilityZone: subnet.AvailabilityZone,
-			Id:               targetId,
-			Port:             targetPort,
-		}},
+	started = true
+	return ret, nil
+}
+
+// canary task is placed on the specified container instance with tags and settings of the service
+func (c *cage) CanaryStartTaskInput(
+	nextTaskDefinition *ecs.TaskDefinition,
+	service *ecs.Service,
+	plan *canaryPlacement,
+) *ecs.StartTaskInput {
+	propagateTags, tags := canaryTaskTags(service)
+	return &ecs.StartTaskInput{
+		Cluster:              &c.env.Cluster,
+		Group:                aws.String(fmt.Sprintf("cage:canary-task:%s", c.env.Service)),
+		NetworkConfiguration: plan.networkConfiguration,
+		TaskDefinition:       nextTaskDefinition.TaskDefinitionArn,
+		ContainerInstances:   []*string{aws.String(plan.instanceArn)},
+		EnableExecuteCommand: service.EnableExecuteCommand,
+		EnableECSManagedTags: service.EnableECSManagedTags,
+		PropagateTags:        propagateTags,
+		Tags:                 tags,
+	}
+}
+
+// canary task is launched with the same capacity providers (or launch type), platform version
+// and placement as the service
+func (c *cage) CanaryRunTaskInput(
+	nextTaskDefinition *ecs.TaskDefinition,
+	service *ecs.Service,
+	networkConfiguration *ecs.NetworkConfiguration,
+) *ecs.RunTaskInput {
+	propagateTags, tags := canaryTaskTags(service)
+	ret := &ecs.RunTaskInput{
+		Cluster:              &c.env.Cluster,
+		Group:                aws.String(fmt.Sprintf("cage:canary-task:%s", c.env.Service)),
+		NetworkConfiguration: networkConfiguration,
+		TaskDefinition:       nextTaskDefinition.TaskDefinitionArn,
+		PlatformVersion:      service.PlatformVersion,
+		EnableExecuteCommand: service.EnableExecuteCommand,
+		EnableECSManagedTags: service.EnableECSManagedTags,
+		PropagateTags:        propagateTags,
+		Tags:                 tags,
+	}
+	// if neither is specified, default capacity provider strategy of the cluster is used
+	fargate := false
+	if len(service.CapacityProviderStrategy) > 0 {
+		// launch type can't be specified with capacity provider strategy
+		ret.CapacityProviderStrategy = service.CapacityProviderStrategy
+		for _, v := range service.CapacityProviderStrategy {
+			if strings.HasPrefix(aws.StringValue(v.CapacityProvider), "FARGATE") {
+				fargate = true
+			}
+		}
+	} else if service.LaunchType != nil {
+		ret.LaunchType = service.LaunchType
+		fargate = *service.LaunchType == ecs.LaunchTypeFargate
+	}
+	if !fargate {
+		// placement is not supported for fargate
+		ret.PlacementConstraints = service.PlacementConstraints
+		ret.PlacementStrategy = service.PlacementStrategy
+	}
+	return ret
+}
+
+// tags of the service are copied to canary task as SERVICE can't be specified when running task.
+// tags with 'aws:' prefix are reserved and can't be specified
+func canaryTaskTags(service *ecs.Service) (*string, []*ecs.Tag) {
+	switch aws.StringValue(service.PropagateTags) {
+	case ecs.PropagateTagsTaskDefinition:
+		return service.PropagateTags, nil
+	case ecs.PropagateTagsService:
+		var tags []*ecs.Tag
+		for _, tag := range service.Tags {
+			if !strings.HasPrefix(strings.ToLower(aws.StringValue(tag.Key)), "aws:") {
+				tags = append(tags, tag)
+			}
+		}
+		return nil, tags
+	}
+	return nil, nil
+}
+
+// where the task is running
+type taskPlacement struct {
+	// nil for FARGATE
+	instanceId *string
+	// ip of the task's network interface in awsvpc mode, otherwise of the instance
+	privateIp *string
+	subnetId  *string
+	awsvpc    bool
+}
+
+func (c *cage) DescribeTaskPlacement(task *ecs.Task) (*taskPlacement, error) {
+	ret := &taskPlacement{}
+	for _, attachment := range task.Attachments {
+		if attachment.Type != nil && *attachment.Type != "ElasticNetworkInterface" {
+			continue
+		}
+		for _, v := range attachment.Details {
+			switch *v.Name {
+			case "subnetId":
+				ret.subnetId = v.Value
+			case "privateIPv4Address":
+				ret.privateIp = v.Value
+				ret.awsvpc = true
+			}
+		}
+	}
+	if task.ContainerInstanceArn == nil {
+		// fargate
+		if !ret.awsvpc {
+			return nil, fmt.Errorf("network interface of task '%s' was not found", *task.TaskArn)
+		}
+		return ret, nil
+	}
+	if o, err := c.ecs.DescribeContainerInstances(&ecs.DescribeContainerInstancesInput{
+		Cluster:            &c.env.Cluster,
+		ContainerInstances: []*string{task.ContainerInstanceArn},
 	}); err != nil {
 		return nil, err
+	} else if len(o.ContainerInstances) == 0 {
+		return nil, fmt.Errorf("container instance '%s' was not found", *task.ContainerInstanceArn)
+	} else {
+		ret.instanceId = o.ContainerInstances[0].Ec2InstanceId
+	}
+	if ret.awsvpc {
+		return ret, nil
 	}
-	return &StartCanaryTaskOutput{
-		targetGroupArn: service.LoadBalancers[0].TargetGroupArn,
-		targetId:       targetId,
-		targetPort:     targetPort,
-		task:           task,
-	}, nil
+	// bridge or host network mode
+	if o, err := c.ec2.DescribeInstances(&ec2.DescribeInstancesInput{
+		InstanceIds: []*string{ret.instanceId},
+	}); err != nil {
+		return nil, err
+	} else {
+		instance := o.Reservations[0].Instances[0]
+		ret.privateIp = instance.PrivateIpAddress
+		ret.subnetId = instance.SubnetId
+	}
+	return ret, nil
 }
 
+// target of the task in the target group.
+// ip and container port in awsvpc mode, otherwise instance id (or ip of the instance) and host port bound to the container
+func (c *cage) taskTarget(
+	task *ecs.Task,
+	lb *ecs.LoadBalancer,
+	targetGroup *targetGroupInfo,
+	placement *taskPlacement,
+) (*canaryTarget, error) {
+	ret := &canaryTarget{
+		targetGroup:    targetGroup,
+		targetGroupArn: lb.TargetGroupArn,
+		targetId:       placement.privateIp,
+	}
+	// target type is not specified only in older target groups of instance type
+	if targetGroup.targetType() == elbv2.TargetTypeEnumInstance || (targetGroup.targetType() == "" && !placement.awsvpc) {
+		if placement.awsvpc {
+			return nil, fmt.Errorf("target group '%s' with target type 'instance' can't be used for tasks in awsvpc network mode", *lb.TargetGroupArn)
+		}
+		ret.targetId = placement.instanceId
+	}
+	if port, err := taskPort(task, placement, lb.ContainerName, lb.ContainerPort); err != nil {
+		return nil, err
+	} else {
+		ret.targetPort = port
+	}
+	return ret, nil
+}
+
+// port to access the container of the task.
+// container port in awsvpc mode, otherwise host port bound to the container
+func taskPort(task *ecs.Task, placement *taskPlacement, containerName *string, containerPort *int64) (*int64, error) {
+	if placement.awsvpc {
+		return containerPort, nil
+	}
+	// host port may be assigned dynamically
+	var ret *int64
+	for _, container := range task.Containers {
+		if aws.StringValue(container.Name) != aws.StringValue(containerName) {
+			continue
+		}
+		for _, binding := range container.NetworkBindings {
+			if aws.Int64Value(binding.ContainerPort) == aws.Int64Value(containerPort) {
+				ret = binding.HostPort
+			}
+		}
+	}
+	if ret == nil {
+		return nil, fmt.Errorf("task '%s' has no network binding for container '%s' and port %d", *task.TaskArn, aws.StringValue(containerName), aws.Int64Value(containerPort))
+	}
+	return ret, nil
+}
+
+// every step of cleanup runs even if former steps failed so that canary task doesn't remain serving.
+// canary task is stopped after deregistration is completed so that in-flight requests are drained
 func (c *cage) StopCanaryTask(input *StartCanaryTaskOutput) error {
+	var failed []string
+	if !input.registrationSkipped {
+		// deregister from Cloud Map first so that clients stop resolving canary task before it stops
+		for _, registration := range input.registrations {
+			if err := c.DeregisterCanaryInstance(registration); err != nil {
+				failed = append(failed, fmt.Sprintf("failed to deregister from Cloud Map service '%s': %s", *registration.serviceId, err))
+			}
+		}
+	}
+	if !input.registrationSkipped {
+		for _, target := range input.targets {
+			if err := c.DeregisterCanaryTarget(target); err != nil {
+				failed = append(failed, fmt.Sprintf("failed to deregister from target group '%s': %s", *target.targetGroupArn, err))
+			}
+		}
+	}
 	if _, err := c.ecs.StopTask(&ecs.StopTaskInput{
 		Cluster: &c.env.Cluster,
 		Task:    input.task.TaskArn,
 	}); err != nil {
-		return err
+		failed = append(failed, fmt.Sprintf("failed to stop task: %s", err))
 	}
+	if err := c.ecs.WaitUntilTasksStopped(&ecs.DescribeTasksInput{
+		Cluster: &c.env.Cluster,
+		Tasks:   []*string{input.task.TaskArn},
+	}); err != nil {
+		failed = append(failed, fmt.Sprintf("task didn't stop: %s", err))
+	}
+	if len(failed) > 0 {
+		return errors.New(strings.Join(failed, ", "))
+	}
+	c.emit(&Event{Type: EventCanaryTaskStopped, TaskArn: *input.task.TaskArn})
+	return nil
+}
+
+func (c *cage) DeregisterCanaryTarget(target *canaryTarget) error {
 	if _, err := c.alb.DeregisterTargets(&elbv2.DeregisterTargetsInput{
-		TargetGroupArn: input.targetGroupArn,
+		TargetGroupArn: target.targetGroupArn,
 		Targets: []*elbv2.TargetDescription{{
-			AvailabilityZone: input.availabilityZone,
-			Id:               input.targetId,
-			Port:             input.targetPort,
+			AvailabilityZone: target.availabilityZone,
+			Id:               target.targetId,
+			Port:             target.targetPort,
 		}},
 	}); err != nil {
 		return err
 	}
-	if err := c.alb.WaitUntilTargetDeregistered(&elbv2.DescribeTargetHealthInput{
-		TargetGroupArn: input.targetGroupArn,
+	return c.alb.WaitUntilTargetDeregistered(&elbv2.DescribeTargetHealthInput{
+		TargetGroupArn: target.targetGroupArn,
 		Targets: []*elbv2.TargetDescription{{
-			AvailabilityZone: input.availabilityZone,
-			Id:               input.targetId,
-			Port:             input.targetPort,
+			AvailabilityZone: target.availabilityZone,
+			Id:               target.targetId,
+			Port:             target.targetPort,
 		}},
-	}); err != nil {
-		return err
-	}
-	if err := c.ecs.WaitUntilTasksStopped(&ecs.DescribeTasksInput{
-		Cluster: &c.env.Cluster,
-		Tasks:   []*string{input.task.TaskArn},
-	}); err != nil {
-		return err
-	}
-	return nil
+	})
 }
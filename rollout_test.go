@@ -3,9 +3,13 @@ package cage
 import (
 	"context"
 	"encoding/json"
+	"errors"
 	"github.com/apex/log"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	awsecsiface "github.com/aws/aws-sdk-go/service/ecs/ecsiface"
 	"github.com/aws/aws-sdk-go/service/elbv2"
 	"github.com/golang/mock/gomock"
 	"github.com/loilo-inc/canarycage/mocks/github.com/aws/aws-sdk-go/service/ec2/ec2iface"
@@ -16,6 +20,7 @@ import (
 	"io/ioutil"
 	"regexp"
 	"testing"
+	"time"
 )
 
 func DefaultEnvars() *Envars {
@@ -60,13 +65,21 @@ func Setup(ctrl *gomock.Controller, envars *Envars, currentTaskCount int64, laun
 	ecsMock.EXPECT().StopTask(gomock.Any()).DoAndReturn(mocker.StopTask).AnyTimes()
 	ecsMock.EXPECT().RegisterTaskDefinition(gomock.Any()).DoAndReturn(mocker.RegisterTaskDefinition).AnyTimes()
 	ecsMock.EXPECT().WaitUntilServicesStable(gomock.Any()).DoAndReturn(mocker.WaitUntilServicesStable).AnyTimes()
+	ecsMock.EXPECT().WaitUntilServicesStableWithContext(gomock.Any(), gomock.Any()).DoAndReturn(mocker.WaitUntilServicesStableWithContext).AnyTimes()
 	ecsMock.EXPECT().WaitUntilServicesInactive(gomock.Any()).DoAndReturn(mocker.WaitUntilServicesInactive).AnyTimes()
 	ecsMock.EXPECT().DescribeServices(gomock.Any()).DoAndReturn(mocker.DescribeServices).AnyTimes()
 	ecsMock.EXPECT().DescribeTasks(gomock.Any()).DoAndReturn(mocker.DescribeTasks).AnyTimes()
 	ecsMock.EXPECT().WaitUntilTasksRunning(gomock.Any()).DoAndReturn(mocker.WaitUntilTasksRunning).AnyTimes()
+	ecsMock.EXPECT().WaitUntilTasksRunningWithContext(gomock.Any(), gomock.Any()).DoAndReturn(mocker.WaitUntilTasksRunningWithContext).AnyTimes()
 	ecsMock.EXPECT().WaitUntilTasksStopped(gomock.Any()).DoAndReturn(mocker.WaitUntilTasksStopped).AnyTimes()
 	ecsMock.EXPECT().ListTasks(gomock.Any()).DoAndReturn(mocker.ListTasks).AnyTimes()
 	ecsMock.EXPECT().DescribeContainerInstances(gomock.Any()).DoAndReturn(mocker.DescribeContainerInstances).AnyTimes()
+	ecsMock.EXPECT().ListContainerInstances(gomock.Any()).DoAndReturn(mocker.ListContainerInstances).AnyTimes()
+	ecsMock.EXPECT().CreateTaskSet(gomock.Any()).DoAndReturn(mocker.CreateTaskSet).AnyTimes()
+	ecsMock.EXPECT().DescribeTaskSets(gomock.Any()).DoAndReturn(mocker.DescribeTaskSets).AnyTimes()
+	ecsMock.EXPECT().UpdateTaskSet(gomock.Any()).DoAndReturn(mocker.UpdateTaskSet).AnyTimes()
+	ecsMock.EXPECT().UpdateServicePrimaryTaskSet(gomock.Any()).DoAndReturn(mocker.UpdateServicePrimaryTaskSet).AnyTimes()
+	ecsMock.EXPECT().DeleteTaskSet(gomock.Any()).DoAndReturn(mocker.DeleteTaskSet).AnyTimes()
 	albMock.EXPECT().DescribeTargetGroups(gomock.Any()).DoAndReturn(mocker.DescribeTargetGroups).AnyTimes()
 	albMock.EXPECT().DescribeTargetHealth(gomock.Any()).DoAndReturn(mocker.DescribeTargetHealth).AnyTimes()
 	albMock.EXPECT().DescribeTargetGroupAttributes(gomock.Any()).DoAndReturn(mocker.DescribeTargetGroupAttibutes).AnyTimes()
@@ -128,6 +141,8 @@ func TestCage_RollOut2(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mocker, ecsMock, _, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
 	albMock := mock_elbv2iface.NewMockELBV2API(ctrl)
+	albMock.EXPECT().DescribeTargetGroups(gomock.Any()).DoAndReturn(mocker.DescribeTargetGroups).AnyTimes()
+	albMock.EXPECT().DescribeTargetGroupAttributes(gomock.Any()).DoAndReturn(mocker.DescribeTargetGroupAttibutes).AnyTimes()
 	albMock.EXPECT().RegisterTargets(gomock.Any()).DoAndReturn(mocker.RegisterTarget).AnyTimes()
 	albMock.EXPECT().DeregisterTargets(gomock.Any()).DoAndReturn(mocker.DeregisterTarget).AnyTimes()
 	albMock.EXPECT().WaitUntilTargetDeregistered(gomock.Any()).Return(nil).AnyTimes()
@@ -136,7 +151,7 @@ func TestCage_RollOut2(t *testing.T) {
 			TargetHealthDescriptions: []*elbv2.TargetHealthDescription{{
 				Target: &elbv2.TargetDescription{
 					Id:               aws.String("127.0.0.1"),
-					Port:             aws.Int64(80),
+					Port:             aws.Int64(8000),
 					AvailabilityZone: aws.String("us-west-2"),
 				},
 				TargetHealth: &elbv2.TargetHealth{
@@ -167,6 +182,8 @@ func TestCage_RollOut3(t *testing.T) {
 	ctrl := gomock.NewController(t)
 	mocker, ecsMock, _, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
 	albMock := mock_elbv2iface.NewMockELBV2API(ctrl)
+	albMock.EXPECT().DescribeTargetGroups(gomock.Any()).DoAndReturn(mocker.DescribeTargetGroups).AnyTimes()
+	albMock.EXPECT().DescribeTargetGroupAttributes(gomock.Any()).DoAndReturn(mocker.DescribeTargetGroupAttibutes).AnyTimes()
 	albMock.EXPECT().RegisterTargets(gomock.Any()).DoAndReturn(mocker.RegisterTarget).AnyTimes()
 	albMock.EXPECT().DeregisterTargets(gomock.Any()).DoAndReturn(mocker.DeregisterTarget).AnyTimes()
 	albMock.EXPECT().WaitUntilTargetDeregistered(gomock.Any()).Return(nil).AnyTimes()
@@ -289,13 +306,24 @@ func TestCage_RollOut_EC2_without_ContainerInstanceArn(t *testing.T) {
 		ALB: albMock,
 	})
 	ctx := context.Background()
+	// container instanceがなければ失敗する
 	result, err := cagecli.RollOut(ctx)
 	if err == nil {
 		t.Fatal("Rollout with no container instance should be error")
 	} else {
-		assert.True(t, regexp.MustCompile("canaryInstanceArn is required").MatchString(err.Error()))
+		assert.True(t, regexp.MustCompile("no ACTIVE container instance").MatchString(err.Error()))
 		assert.NotNil(t, result)
+		assert.True(t, result.ServiceIntact)
 	}
+	mctx.PutContainerInstance(newContainerInstance("arn://ci/1", "i-1", "us-west-2a", 1024, 1024))
+	result, err = cagecli.RollOut(ctx)
+	if err != nil {
+		t.Fatalf("%s", err)
+	}
+	assert.False(t, result.ServiceIntact)
+	// 選んだインスタンスはenvarsに書き戻さない
+	assert.Equal(t, "", envars.CanaryInstanceArn)
+	assert.Equal(t, int64(1), mctx.TaskSize())
 }
 
 func TestCage_RollOut_EC2_no_attribute(t *testing.T) {
@@ -334,6 +362,706 @@ func TestCage_RollOut_EC2_no_attribute(t *testing.T) {
 	assert.Equal(t, int64(1), mctx.TaskSize())
 }
 
+func TestCage_StartCanaryTask_EC2(t *testing.T) {
+	// awsvpcならENIのipとcontainerPort、それ以外はインスタンスと動的に割り当てられたhostPortを登録する
+	for _, v := range []struct {
+		awsvpc     bool
+		targetType string
+		targetId   string
+		targetPort int64
+		address    string
+	}{
+		{awsvpc: false, targetType: "", targetId: "i-1234567890abcdefg", targetPort: 32768, address: "127.0.0.1:32768"},
+		{awsvpc: false, targetType: "instance", targetId: "i-1234567890abcdefg", targetPort: 32768, address: "127.0.0.1:32768"},
+		{awsvpc: false, targetType: "ip", targetId: "127.0.0.1", targetPort: 32768, address: "127.0.0.1:32768"},
+		{awsvpc: true, targetType: "ip", targetId: "127.0.0.2", targetPort: 8000, address: "127.0.0.2:8000"},
+		{awsvpc: true, targetType: "instance"},
+	} {
+		envars := DefaultEnvars()
+		envars.CanaryInstanceArn = "arn:aws:ecs:us-west-2:1234567689012:container-instance/abcdefg-hijk-lmn-opqrstuvwxyz"
+		envars.TaskDefinitionInput.ContainerDefinitions[0].PortMappings[0].HostPort = aws.Int64(0)
+		ctrl := gomock.NewController(t)
+		mctx, ecsMock, _, ec2Mock := Setup(ctrl, envars, 1, "EC2")
+		albMock := setupTargetGroup(ctrl, mctx, &elbv2.TargetGroup{
+			Protocol:         aws.String("HTTP"),
+			TargetType:       aws.String(v.targetType),
+			LoadBalancerArns: []*string{aws.String("arn://hoge/app/aa/bb")},
+		}, "healthy", 0)
+		cagecli := &cage{env: envars, ecs: ecsMock, alb: albMock, ec2: ec2Mock}
+		service, _ := mctx.GetService(envars.Service)
+		if v.awsvpc {
+			service.NetworkConfiguration = envars.ServiceDefinitionInput.NetworkConfiguration
+		}
+		td, _ := cagecli.CreateNextTaskDefinition()
+		tasks, err := cagecli.StartCanaryTasks(context.Background(), td, service, 1)
+		if v.targetId == "" {
+			assert.NotNil(t, err)
+			assert.Equal(t, int64(1), mctx.TaskSize())
+			ctrl.Finish()
+			continue
+		}
+		assert.Nil(t, err)
+		assert.Equal(t, v.targetId, *tasks[0].targets[0].targetId)
+		assert.Equal(t, v.targetPort, *tasks[0].targets[0].targetPort)
+		assert.Equal(t, v.address, tasks[0].address())
+		assert.Nil(t, cagecli.StopCanaryTask(tasks[0]))
+		ctrl.Finish()
+	}
+}
+
+func TestCage_RollOut_NoPortMapping(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	for _, v := range []*ecs.LoadBalancer{
+		{TargetGroupArn: aws.String("aaaa/targetgroup/aaa/bbb"), ContainerName: aws.String("container"), ContainerPort: aws.Int64(9000)},
+		{TargetGroupArn: aws.String("aaaa/targetgroup/aaa/bbb"), ContainerName: aws.String("sidecar"), ContainerPort: aws.Int64(8000)},
+	} {
+		envars := DefaultEnvars()
+		envars.ServiceDefinitionInput.LoadBalancers = []*ecs.LoadBalancer{v}
+		ctrl := gomock.NewController(t)
+		mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+		cagecli := NewCage(&Input{
+			Env: envars,
+			ECS: ecsMock,
+			ALB: albMock,
+			EC2: ec2Mock,
+		})
+		result, err := cagecli.RollOut(context.Background())
+		assert.NotNil(t, err)
+		assert.True(t, regexp.MustCompile("no port mapping").MatchString(err.Error()))
+		assert.True(t, result.ServiceIntact)
+		// canary taskは起動しない
+		assert.Equal(t, int64(2), mctx.TaskSize())
+		ctrl.Finish()
+	}
+}
+
+func TestCage_StartCanaryTask_MultiplePortMappings(t *testing.T) {
+	envars := DefaultEnvars()
+	envars.CanaryInstanceArn = "arn:aws:ecs:us-west-2:1234567689012:container-instance/abcdefg-hijk-lmn-opqrstuvwxyz"
+	envars.TaskDefinitionInput.ContainerDefinitions[0].PortMappings = []*ecs.PortMapping{
+		{ContainerPort: aws.Int64(9090), HostPort: aws.Int64(9090)},
+		{ContainerPort: aws.Int64(8000), HostPort: aws.Int64(8080)},
+	}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 1, "EC2")
+	cagecli := &cage{env: envars, ecs: ecsMock, alb: albMock, ec2: ec2Mock}
+	service, _ := mctx.GetService(envars.Service)
+	td, _ := cagecli.CreateNextTaskDefinition()
+	mapping, err := LoadBalancedPortMapping(td, service.LoadBalancers[0])
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8080), *mapping.HostPort)
+	tasks, err := cagecli.StartCanaryTasks(context.Background(), td, service, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, int64(8080), *tasks[0].targets[0].targetPort)
+	assert.Nil(t, cagecli.StopCanaryTask(tasks[0]))
+}
+
+func TestCage_CanaryRunTaskInput(t *testing.T) {
+	placementConstraints := []*ecs.PlacementConstraint{{Type: aws.String("distinctInstance")}}
+	placementStrategy := []*ecs.PlacementStrategy{{Type: aws.String("spread"), Field: aws.String("attribute:ecs.availability-zone")}}
+	tags := []*ecs.Tag{{Key: aws.String("env"), Value: aws.String("test")}}
+	cagecli := &cage{env: DefaultEnvars()}
+	td := &ecs.TaskDefinition{TaskDefinitionArn: aws.String("arn://td:2")}
+	// fargateにplacementは指定できない
+	o := cagecli.CanaryRunTaskInput(td, &ecs.Service{
+		LaunchType:           aws.String("FARGATE"),
+		PlatformVersion:      aws.String("1.4.0"),
+		EnableExecuteCommand: aws.Bool(true),
+		PlacementConstraints: placementConstraints,
+		PropagateTags:        aws.String("TASK_DEFINITION"),
+		Tags:                 tags,
+	}, nil)
+	assert.Equal(t, "FARGATE", *o.LaunchType)
+	assert.Equal(t, "1.4.0", *o.PlatformVersion)
+	assert.True(t, *o.EnableExecuteCommand)
+	assert.Nil(t, o.PlacementConstraints)
+	assert.Equal(t, "TASK_DEFINITION", *o.PropagateTags)
+	assert.Nil(t, o.Tags)
+	// aws:で始まるタグはコピーしない
+	o = cagecli.CanaryRunTaskInput(td, &ecs.Service{
+		CapacityProviderStrategy: []*ecs.CapacityProviderStrategyItem{{CapacityProvider: aws.String("FARGATE_SPOT"), Weight: aws.Int64(1)}},
+		PlacementStrategy:        placementStrategy,
+		EnableECSManagedTags:     aws.Bool(true),
+		PropagateTags:            aws.String("SERVICE"),
+		Tags:                     append([]*ecs.Tag{{Key: aws.String("aws:cloudformation:stack-name"), Value: aws.String("stack")}}, tags...),
+	}, nil)
+	assert.Nil(t, o.LaunchType)
+	assert.Equal(t, "FARGATE_SPOT", *o.CapacityProviderStrategy[0].CapacityProvider)
+	assert.Nil(t, o.PlacementStrategy)
+	assert.True(t, *o.EnableECSManagedTags)
+	assert.Nil(t, o.PropagateTags)
+	assert.Equal(t, tags, o.Tags)
+	o = cagecli.CanaryRunTaskInput(td, &ecs.Service{
+		CapacityProviderStrategy: []*ecs.CapacityProviderStrategyItem{{CapacityProvider: aws.String("asg-provider"), Weight: aws.Int64(1)}},
+		PlacementConstraints:     placementConstraints,
+		PlacementStrategy:        placementStrategy,
+	}, nil)
+	assert.Nil(t, o.LaunchType)
+	assert.Equal(t, placementConstraints, o.PlacementConstraints)
+	assert.Equal(t, placementStrategy, o.PlacementStrategy)
+}
+
+func TestCage_StartCanaryTask_CapacityProvider(t *testing.T) {
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 1, "FARGATE")
+	cagecli := &cage{env: envars, ecs: ecsMock, alb: albMock, ec2: ec2Mock}
+	service, _ := mctx.GetService(envars.Service)
+	service.LaunchType = nil
+	service.CapacityProviderStrategy = []*ecs.CapacityProviderStrategyItem{{CapacityProvider: aws.String("FARGATE_SPOT"), Weight: aws.Int64(1)}}
+	service.PlatformVersion = aws.String("1.4.0")
+	td, _ := cagecli.CreateNextTaskDefinition()
+	tasks, err := cagecli.StartCanaryTasks(context.Background(), td, service, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "FARGATE_SPOT", *tasks[0].task.CapacityProviderName)
+	assert.Equal(t, "1.4.0", *tasks[0].task.PlatformVersion)
+	assert.Nil(t, cagecli.StopCanaryTask(tasks[0]))
+}
+
+func TestCage_RollOut_MultipleCanaries(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.CanaryCount = 3
+	ctrl := gomock.NewController(t)
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	cagecli := &cage{env: envars, ecs: ecsMock, alb: albMock, ec2: ec2Mock}
+	service, _ := mctx.GetService(envars.Service)
+	td, _ := cagecli.CreateNextTaskDefinition()
+	tasks, err := cagecli.StartCanaryTasks(context.Background(), td, service, 3)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(t, 3, len(tasks))
+	assert.Equal(t, int64(5), mctx.TaskSize())
+	for _, task := range tasks {
+		if err := cagecli.StopCanaryTask(task); err != nil {
+			t.Fatalf(err.Error())
+		}
+	}
+	result, err := cagecli.RollOut(context.Background())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.False(t, result.ServiceIntact)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
+
+func TestCage_RollOut_MultipleLoadBalancers(t *testing.T) {
+	// 全てのtarget groupに登録してhealthyになるのを確認する
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.ServiceDefinitionInput.LoadBalancers = append(envars.ServiceDefinitionInput.LoadBalancers, &ecs.LoadBalancer{
+		TargetGroupArn: aws.String("aaaa/targetgroup/internal/ccc"),
+		ContainerName:  aws.String("container"),
+		ContainerPort:  aws.Int64(8000),
+	})
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mocker, ecsMock, _, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	albMock := mock_elbv2iface.NewMockELBV2API(ctrl)
+	albMock.EXPECT().DescribeTargetGroups(gomock.Any()).DoAndReturn(mocker.DescribeTargetGroups).AnyTimes()
+	albMock.EXPECT().DescribeTargetGroupAttributes(gomock.Any()).DoAndReturn(mocker.DescribeTargetGroupAttibutes).AnyTimes()
+	var registered, checked, deregistered []string
+	albMock.EXPECT().RegisterTargets(gomock.Any()).DoAndReturn(func(input *elbv2.RegisterTargetsInput) (*elbv2.RegisterTargetsOutput, error) {
+		registered = append(registered, *input.TargetGroupArn)
+		return mocker.RegisterTarget(input)
+	}).Times(2)
+	albMock.EXPECT().DescribeTargetHealth(gomock.Any()).DoAndReturn(func(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+		checked = append(checked, *input.TargetGroupArn)
+		return mocker.DescribeTargetHealth(input)
+	}).Times(2)
+	albMock.EXPECT().DeregisterTargets(gomock.Any()).DoAndReturn(func(input *elbv2.DeregisterTargetsInput) (*elbv2.DeregisterTargetsOutput, error) {
+		deregistered = append(deregistered, *input.TargetGroupArn)
+		return mocker.DeregisterTarget(input)
+	}).Times(2)
+	albMock.EXPECT().WaitUntilTargetDeregistered(gomock.Any()).Return(nil).Times(2)
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.False(t, result.ServiceIntact)
+	expected := []string{"aaaa/targetgroup/aaa/bbb", "aaaa/targetgroup/internal/ccc"}
+	assert.Equal(t, expected, registered)
+	assert.Equal(t, expected, checked)
+	assert.Equal(t, expected, deregistered)
+	assert.Equal(t, int64(2), mocker.TaskSize())
+}
+
+func TestCage_StopCanaryTask_DeregisterFailed(t *testing.T) {
+	// 一つのtarget groupで失敗しても全てから外す
+	envars := DefaultEnvars()
+	envars.ServiceDefinitionInput.LoadBalancers = append(envars.ServiceDefinitionInput.LoadBalancers, &ecs.LoadBalancer{
+		TargetGroupArn: aws.String("aaaa/targetgroup/internal/ccc"),
+		ContainerName:  aws.String("container"),
+		ContainerPort:  aws.Int64(8000),
+	})
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mocker, ecsMock, _, ec2Mock := Setup(ctrl, envars, 1, "FARGATE")
+	albMock := mock_elbv2iface.NewMockELBV2API(ctrl)
+	albMock.EXPECT().DescribeTargetGroups(gomock.Any()).DoAndReturn(mocker.DescribeTargetGroups).AnyTimes()
+	albMock.EXPECT().DescribeTargetGroupAttributes(gomock.Any()).DoAndReturn(mocker.DescribeTargetGroupAttibutes).AnyTimes()
+	albMock.EXPECT().RegisterTargets(gomock.Any()).DoAndReturn(mocker.RegisterTarget).Times(2)
+	var deregistered []string
+	var running []int64
+	albMock.EXPECT().DeregisterTargets(gomock.Any()).DoAndReturn(func(input *elbv2.DeregisterTargetsInput) (*elbv2.DeregisterTargetsOutput, error) {
+		deregistered = append(deregistered, *input.TargetGroupArn)
+		running = append(running, mocker.TaskSize())
+		if len(deregistered) == 1 {
+			return nil, errors.New("throttled")
+		}
+		return mocker.DeregisterTarget(input)
+	}).Times(2)
+	albMock.EXPECT().WaitUntilTargetDeregistered(gomock.Any()).Return(nil).Times(1)
+	cagecli := &cage{env: envars, ecs: ecsMock, alb: albMock, ec2: ec2Mock}
+	service, _ := mocker.GetService(envars.Service)
+	td, _ := cagecli.CreateNextTaskDefinition()
+	tasks, err := cagecli.StartCanaryTasks(context.Background(), td, service, 1)
+	assert.Nil(t, err)
+	err = cagecli.StopCanaryTask(tasks[0])
+	assert.NotNil(t, err)
+	assert.True(t, regexp.MustCompile("aaaa/targetgroup/aaa/bbb").MatchString(err.Error()))
+	assert.Equal(t, []string{"aaaa/targetgroup/aaa/bbb", "aaaa/targetgroup/internal/ccc"}, deregistered)
+	// タスクを止める前に外す
+	assert.Equal(t, []int64{2, 2}, running)
+	assert.Equal(t, int64(1), mocker.TaskSize())
+}
+
+func TestCage_RollOut_WithoutLoadBalancer(t *testing.T) {
+	// lbがない場合はtarget groupを操作しない
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.ServiceDefinitionInput.LoadBalancers = nil
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mocker, ecsMock, _, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: mock_elbv2iface.NewMockELBV2API(ctrl),
+		EC2: ec2Mock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.False(t, result.ServiceIntact)
+	assert.Equal(t, int64(2), mocker.TaskSize())
+}
+
+func TestCage_CanaryTaskCount(t *testing.T) {
+	service := &ecs.Service{DesiredCount: aws.Int64(15)}
+	for _, v := range []struct {
+		count      int64
+		percentage int64
+		expected   int64
+	}{
+		{expected: 1},
+		{count: 3, expected: 3},
+		{percentage: 10, expected: 2},
+		{percentage: 1, expected: 1},
+		{percentage: 100, expected: 15},
+	} {
+		cagecli := &cage{env: &Envars{CanaryCount: v.count, CanaryPercentage: v.percentage}}
+		assert.Equal(t, v.expected, cagecli.CanaryTaskCount(service))
+	}
+}
+
+func TestCage_SpreadNetworkConfiguration(t *testing.T) {
+	ctrl := gomock.NewController(t)
+	ec2Mock := mock_ec2iface.NewMockEC2API(ctrl)
+	ec2Mock.EXPECT().DescribeSubnets(gomock.Any()).Return(&ec2.DescribeSubnetsOutput{
+		Subnets: []*ec2.Subnet{
+			{SubnetId: aws.String("subnet-a1"), AvailabilityZone: aws.String("us-west-2a")},
+			{SubnetId: aws.String("subnet-a2"), AvailabilityZone: aws.String("us-west-2a")},
+			{SubnetId: aws.String("subnet-b1"), AvailabilityZone: aws.String("us-west-2b")},
+			{SubnetId: aws.String("subnet-c1"), AvailabilityZone: aws.String("us-west-2c")},
+		},
+	}, nil)
+	cagecli := &cage{env: &Envars{}, ec2: ec2Mock}
+	base := &ecs.NetworkConfiguration{
+		AwsvpcConfiguration: &ecs.AwsVpcConfiguration{
+			Subnets:        aws.StringSlice([]string{"subnet-a1", "subnet-a2", "subnet-b1", "subnet-c1"}),
+			SecurityGroups: aws.StringSlice([]string{"sg-1"}),
+			AssignPublicIp: aws.String("DISABLED"),
+		},
+	}
+	o, err := cagecli.SpreadNetworkConfiguration(base, 4)
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	var subnets []string
+	for _, v := range o {
+		assert.Equal(t, 1, len(v.AwsvpcConfiguration.Subnets))
+		assert.Equal(t, "sg-1", *v.AwsvpcConfiguration.SecurityGroups[0])
+		subnets = append(subnets, *v.AwsvpcConfiguration.Subnets[0])
+	}
+	assert.Equal(t, []string{"subnet-a1", "subnet-b1", "subnet-c1", "subnet-a2"}, subnets)
+	assert.Equal(t, 4, len(base.AwsvpcConfiguration.Subnets))
+	// サブネットが見つからなければエラー
+	ec2Mock.EXPECT().DescribeSubnets(gomock.Any()).Return(&ec2.DescribeSubnetsOutput{}, nil)
+	_, err = cagecli.SpreadNetworkConfiguration(base, 4)
+	assert.NotNil(t, err)
+}
+
+func TestCage_RollOut_Soak(t *testing.T) {
+	newTimer = fakeTimer
+	now = fakeNow
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.CanarySoakDuration = time.Duration(1) * time.Minute
+	ctrl := gomock.NewController(t)
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.False(t, result.ServiceIntact)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
+
+func TestCage_RollOut_SoakUnhealthy(t *testing.T) {
+	// soak中にunhealthyになった場合は打ち切る
+	newTimer = fakeTimer
+	now = fakeNow
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.CanarySoakDuration = time.Duration(5) * time.Minute
+	ctrl := gomock.NewController(t)
+	mocker, ecsMock, _, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	albMock := mock_elbv2iface.NewMockELBV2API(ctrl)
+	albMock.EXPECT().DescribeTargetGroups(gomock.Any()).DoAndReturn(mocker.DescribeTargetGroups).AnyTimes()
+	albMock.EXPECT().DescribeTargetGroupAttributes(gomock.Any()).DoAndReturn(mocker.DescribeTargetGroupAttibutes).AnyTimes()
+	albMock.EXPECT().RegisterTargets(gomock.Any()).DoAndReturn(mocker.RegisterTarget).AnyTimes()
+	albMock.EXPECT().DeregisterTargets(gomock.Any()).DoAndReturn(mocker.DeregisterTarget).AnyTimes()
+	albMock.EXPECT().WaitUntilTargetDeregistered(gomock.Any()).Return(nil).AnyTimes()
+	gomock.InOrder(
+		albMock.EXPECT().DescribeTargetHealth(gomock.Any()).DoAndReturn(mocker.DescribeTargetHealth).Times(3),
+		albMock.EXPECT().DescribeTargetHealth(gomock.Any()).Return(&elbv2.DescribeTargetHealthOutput{
+			TargetHealthDescriptions: []*elbv2.TargetHealthDescription{{
+				Target: &elbv2.TargetDescription{
+					Id:               aws.String("127.0.0.1"),
+					Port:             aws.Int64(8000),
+					AvailabilityZone: aws.String("us-west-2"),
+				},
+				TargetHealth: &elbv2.TargetHealth{
+					State: aws.String("unhealthy"),
+				},
+			}},
+		}, nil).Times(1),
+	)
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.NotNil(t, err)
+	assert.True(t, result.ServiceIntact)
+	assert.Equal(t, int64(2), mocker.TaskSize())
+}
+
+// ecs client whose tasks crash after the time
+type crashingECS struct {
+	awsecsiface.ECSAPI
+	crashAt time.Time
+}
+
+func (e *crashingECS) DescribeTasks(input *ecs.DescribeTasksInput) (*ecs.DescribeTasksOutput, error) {
+	o, err := e.ECSAPI.DescribeTasks(input)
+	if err != nil || now().Before(e.crashAt) {
+		return o, err
+	}
+	var tasks []*ecs.Task
+	for _, v := range o.Tasks {
+		task := *v
+		task.LastStatus = aws.String("STOPPED")
+		task.StoppedReason = aws.String("Essential container in task exited")
+		task.Containers = []*ecs.Container{{Name: aws.String("container"), ExitCode: aws.Int64(137)}}
+		tasks = append(tasks, &task)
+	}
+	return &ecs.DescribeTasksOutput{Tasks: tasks}, nil
+}
+
+func TestCage_RollOut_MinUptime(t *testing.T) {
+	newTimer = fakeTimer
+	now = fakeNow
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.ServiceDefinitionInput.LoadBalancers = nil
+	envars.CanaryMinUptime = time.Duration(3) * time.Minute
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, _, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: mock_elbv2iface.NewMockELBV2API(ctrl),
+		EC2: ec2Mock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, result.ServiceIntact)
+	assert.True(t, time.Duration(fakeElapsed) >= envars.CanaryMinUptime)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
+
+func TestCage_RollOut_MinUptimeCrashed(t *testing.T) {
+	// 最低稼働時間の間にcanaryが落ちたら終了コードとともに打ち切る
+	newTimer = fakeTimer
+	now = fakeNow
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.ServiceDefinitionInput.LoadBalancers = nil
+	envars.CanaryMinUptime = time.Duration(5) * time.Minute
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, _, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: &crashingECS{ECSAPI: ecsMock, crashAt: now().Add(time.Duration(2) * time.Minute)},
+		ALB: mock_elbv2iface.NewMockELBV2API(ctrl),
+		EC2: ec2Mock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.NotNil(t, err)
+	assert.True(t, regexp.MustCompile(`Essential container in task exited \(exit codes: container=137\)$`).MatchString(err.Error()), err.Error())
+	assert.True(t, result.ServiceIntact)
+	assert.True(t, time.Duration(fakeElapsed) < envars.CanaryMinUptime)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
+
+// alb client that calls f while checking health state of targets
+func setupInterruptedTargetGroup(ctrl *gomock.Controller, mocker *test.MockContext, f func()) *mock_elbv2iface.MockELBV2API {
+	albMock := mock_elbv2iface.NewMockELBV2API(ctrl)
+	albMock.EXPECT().DescribeTargetGroups(gomock.Any()).DoAndReturn(mocker.DescribeTargetGroups).AnyTimes()
+	albMock.EXPECT().DescribeTargetGroupAttributes(gomock.Any()).DoAndReturn(mocker.DescribeTargetGroupAttibutes).AnyTimes()
+	albMock.EXPECT().RegisterTargets(gomock.Any()).DoAndReturn(mocker.RegisterTarget).AnyTimes()
+	albMock.EXPECT().DeregisterTargets(gomock.Any()).DoAndReturn(mocker.DeregisterTarget).AnyTimes()
+	albMock.EXPECT().WaitUntilTargetDeregistered(gomock.Any()).Return(nil).AnyTimes()
+	albMock.EXPECT().DescribeTargetHealth(gomock.Any()).DoAndReturn(func(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+		f()
+		return &elbv2.DescribeTargetHealthOutput{
+			TargetHealthDescriptions: []*elbv2.TargetHealthDescription{{
+				Target:       input.Targets[0],
+				TargetHealth: &elbv2.TargetHealth{State: aws.String("initial")},
+			}},
+		}, nil
+	}).AnyTimes()
+	return albMock
+}
+
+func TestCage_RollOut_Cancel(t *testing.T) {
+	// 中断されてもcanaryは止める
+	newTimer = fakeTimer
+	now = fakeNow
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, _, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	ctx, cancel := context.WithCancel(context.Background())
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: setupInterruptedTargetGroup(ctrl, mctx, cancel),
+		EC2: ec2Mock,
+	})
+	result, err := cagecli.RollOut(ctx)
+	assert.True(t, errors.Is(err, context.Canceled))
+	assert.Equal(t, ErrorKindCanary, KindOf(err))
+	assert.True(t, result.ServiceIntact)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
+
+func TestCage_StartCanaryTasks_Cancelled(t *testing.T) {
+	// 起動待ちの間に中断されたら起動したタスクを止める
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	cagecli := &cage{env: envars, ecs: ecsMock, alb: albMock, ec2: ec2Mock}
+	service, _ := mctx.GetService(envars.Service)
+	td, _ := cagecli.CreateNextTaskDefinition()
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	tasks, err := cagecli.StartCanaryTasks(ctx, td, service, 1)
+	assert.Equal(t, context.Canceled, err)
+	assert.Nil(t, tasks)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
+
+func TestCage_RollOut_Panic(t *testing.T) {
+	newTimer = fakeTimer
+	now = fakeNow
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, _, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: setupInterruptedTargetGroup(ctrl, mctx, func() { panic("unexpected") }),
+		EC2: ec2Mock,
+	})
+	assert.Panics(t, func() {
+		cagecli.RollOut(context.Background())
+	})
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
+
+// ecs client whose first WaitUntilServicesStableWithContext fails
+type unstableECS struct {
+	awsecsiface.ECSAPI
+	failed bool
+}
+
+func (e *unstableECS) WaitUntilServicesStableWithContext(ctx aws.Context, input *ecs.DescribeServicesInput, opts ...request.WaiterOption) error {
+	if !e.failed {
+		e.failed = true
+		return errors.New("ResourceNotReady: exceeded wait attempts")
+	}
+	return e.ECSAPI.WaitUntilServicesStableWithContext(ctx, input, opts...)
+}
+
+func TestCage_RollOut_RollBack(t *testing.T) {
+	// サービスが安定しなかった場合は元のタスク定義に戻す
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	service, _ := mctx.GetService(envars.Service)
+	previousTaskDefinitionArn := *service.TaskDefinition
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: &unstableECS{ECSAPI: ecsMock},
+		ALB: albMock,
+		EC2: ec2Mock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.NotNil(t, err)
+	assert.False(t, result.ServiceIntact)
+	assert.True(t, result.RolledBack)
+	assert.Nil(t, result.RollBackError)
+	assert.Equal(t, ErrorKindServiceUpdate, KindOf(err))
+	assert.Equal(t, previousTaskDefinitionArn, *service.TaskDefinition)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
+
+// ecs client that fails to register task definitions, to update services or to stop tasks
+type faultyECS struct {
+	awsecsiface.ECSAPI
+	registerFails bool
+	updateFails   bool
+	stopFails     bool
+}
+
+func (e *faultyECS) UpdateService(input *ecs.UpdateServiceInput) (*ecs.UpdateServiceOutput, error) {
+	if e.updateFails {
+		return nil, errors.New("ServiceNotActiveException")
+	}
+	return e.ECSAPI.UpdateService(input)
+}
+
+func (e *faultyECS) RegisterTaskDefinition(input *ecs.RegisterTaskDefinitionInput) (*ecs.RegisterTaskDefinitionOutput, error) {
+	if e.registerFails {
+		return nil, errors.New("ClientException: Too many concurrent attempts")
+	}
+	return e.ECSAPI.RegisterTaskDefinition(input)
+}
+
+func (e *faultyECS) StopTask(input *ecs.StopTaskInput) (*ecs.StopTaskOutput, error) {
+	if e.stopFails {
+		return nil, errors.New("AccessDeniedException")
+	}
+	return e.ECSAPI.StopTask(input)
+}
+
+func TestCage_RollOut_ErrorKind(t *testing.T) {
+	// どこで失敗したかをエラーで返す
+	newTimer = fakeTimer
+	defer recoverTimer()
+	t.Run("preflight", func(t *testing.T) {
+		envars := DefaultEnvars()
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+		cagecli := NewCage(&Input{Env: envars, ECS: &faultyECS{ECSAPI: ecsMock, registerFails: true}, ALB: albMock, EC2: ec2Mock})
+		result, err := cagecli.RollOut(context.Background())
+		assert.Equal(t, ErrorKindPreflight, KindOf(err))
+		assert.True(t, result.ServiceIntact)
+		assert.Equal(t, int64(2), mctx.TaskSize())
+	})
+	t.Run("update service", func(t *testing.T) {
+		// UpdateServiceが失敗した場合はサービスは変わっていないのでロールバックしない
+		envars := DefaultEnvars()
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+		service, _ := mctx.GetService(envars.Service)
+		previousTaskDefinitionArn := *service.TaskDefinition
+		cagecli := NewCage(&Input{Env: envars, ECS: &faultyECS{ECSAPI: ecsMock, updateFails: true}, ALB: albMock, EC2: ec2Mock})
+		result, err := cagecli.RollOut(context.Background())
+		assert.Equal(t, ErrorKindCanary, KindOf(err))
+		assert.Equal(t, PhaseUpdateService, result.FailedPhase)
+		assert.True(t, result.ServiceIntact)
+		assert.False(t, result.RolledBack)
+		assert.Equal(t, previousTaskDefinitionArn, *service.TaskDefinition)
+		assert.Equal(t, int64(2), mctx.TaskSize())
+	})
+	t.Run("cleanup", func(t *testing.T) {
+		envars := DefaultEnvars()
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		_, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+		cagecli := NewCage(&Input{Env: envars, ECS: &faultyECS{ECSAPI: ecsMock, stopFails: true}, ALB: albMock, EC2: ec2Mock})
+		result, err := cagecli.RollOut(context.Background())
+		assert.Equal(t, ErrorKindCleanup, KindOf(err))
+		// サービスは更新済み
+		assert.False(t, result.ServiceIntact)
+		assert.False(t, err.(*Error).ServiceIntact)
+	})
+	t.Run("cleanup after rolling back", func(t *testing.T) {
+		// サービスの更新に失敗した場合はそちらを優先する
+		envars := DefaultEnvars()
+		ctrl := gomock.NewController(t)
+		defer ctrl.Finish()
+		_, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+		cagecli := NewCage(&Input{
+			Env: envars,
+			ECS: &unstableECS{ECSAPI: &faultyECS{ECSAPI: ecsMock, stopFails: true}},
+			ALB: albMock,
+			EC2: ec2Mock,
+		})
+		result, err := cagecli.RollOut(context.Background())
+		assert.Equal(t, ErrorKindServiceUpdate, KindOf(err))
+		assert.Equal(t, PhaseUpdateService, result.FailedPhase)
+		assert.True(t, result.RolledBack)
+		assert.Contains(t, err.Error(), "failed to stop canary tasks")
+	})
+}
+
 func TestCage_CreateNextTaskDefinition(t *testing.T) {
 	envars := &Envars{
 		TaskDefinitionArn: "arn://task",
@@ -0,0 +1,190 @@
+package cage
+
+import (
+	"context"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/servicediscovery"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// instance of canary task registered to Cloud Map service
+type canaryRegistration struct {
+	registryArn *string
+	serviceId   *string
+	instanceId  *string
+	// health status is reported by cage instead of ECS
+	customHealthCheck bool
+	// health status is checked by Route 53
+	healthCheck bool
+	port        *int64
+	// the final health state seen
+	healthState string
+}
+
+// id of Cloud Map service from its arn. e.g. arn:aws:servicediscovery:us-west-2:123456789012:service/srv-xxx
+func ServiceIdOfRegistry(registryArn string) string {
+	return registryArn[strings.LastIndex(registryArn, "/")+1:]
+}
+
+// register canary task to Cloud Map service in the same way as ECS does
+func (c *cage) RegisterCanaryInstance(
+	ctx context.Context,
+	task *ecs.Task,
+	registry *ecs.ServiceRegistry,
+	placement *taskPlacement,
+	availabilityZone *string,
+) (*canaryRegistration, error) {
+	ret := &canaryRegistration{
+		registryArn: registry.RegistryArn,
+		serviceId:   aws.String(ServiceIdOfRegistry(*registry.RegistryArn)),
+		instanceId:  aws.String((*task.TaskArn)[strings.LastIndex(*task.TaskArn, "/")+1:]),
+	}
+	if o, err := c.sd.GetService(&servicediscovery.GetServiceInput{
+		Id: ret.serviceId,
+	}); err != nil {
+		return nil, err
+	} else {
+		ret.customHealthCheck = o.Service.HealthCheckCustomConfig != nil
+		ret.healthCheck = o.Service.HealthCheckConfig != nil
+	}
+	attributes := map[string]*string{
+		"AWS_INSTANCE_IPV4": placement.privateIp,
+		"AVAILABILITY_ZONE": availabilityZone,
+		"ECS_CLUSTER_NAME":  &c.env.Cluster,
+		"ECS_SERVICE_NAME":  &c.env.Service,
+	}
+	if registry.Port != nil {
+		ret.port = registry.Port
+	} else if registry.ContainerName != nil {
+		if port, err := taskPort(task, placement, registry.ContainerName, registry.ContainerPort); err != nil {
+			return nil, err
+		} else {
+			ret.port = port
+		}
+	}
+	if ret.port != nil {
+		attributes["AWS_INSTANCE_PORT"] = aws.String(strconv.FormatInt(*ret.port, 10))
+	}
+	if ret.customHealthCheck {
+		// reported to be healthy after task is verified to be running
+		attributes["AWS_INIT_HEALTH_STATUS"] = aws.String(servicediscovery.CustomHealthStatusUnhealthy)
+	}
+	log.Infof("registering canary task '%s' to Cloud Map service '%s'...", *task.TaskArn, *ret.serviceId)
+	if o, err := c.sd.RegisterInstance(&servicediscovery.RegisterInstanceInput{
+		ServiceId:  ret.serviceId,
+		InstanceId: ret.instanceId,
+		Attributes: attributes,
+	}); err != nil {
+		return nil, err
+	} else if err := c.WaitForOperation(ctx, o.OperationId); err != nil {
+		return nil, err
+	}
+	return ret, nil
+}
+
+func (c *cage) DeregisterCanaryInstance(registration *canaryRegistration) error {
+	log.Infof("deregistering instance '%s' from Cloud Map service '%s'...", *registration.instanceId, *registration.serviceId)
+	if o, err := c.sd.DeregisterInstance(&servicediscovery.DeregisterInstanceInput{
+		ServiceId:  registration.serviceId,
+		InstanceId: registration.instanceId,
+	}); err != nil {
+		return err
+	} else {
+		// deregistration is a part of cleanup, which must complete even after rolling out is cancelled
+		return c.WaitForOperation(context.Background(), o.OperationId)
+	}
+}
+
+// registering and deregistering instance are processed asynchronously
+func (c *cage) WaitForOperation(ctx context.Context, operationId *string) error {
+	for count := 0; count < 60; count++ {
+		if o, err := c.sd.GetOperation(&servicediscovery.GetOperationInput{
+			OperationId: operationId,
+		}); err != nil {
+			return err
+		} else {
+			switch *o.Operation.Status {
+			case servicediscovery.OperationStatusSuccess:
+				return nil
+			case servicediscovery.OperationStatusFail:
+				return fmt.Errorf("operation '%s' of Cloud Map failed: %s", *operationId, aws.StringValue(o.Operation.ErrorMessage))
+			}
+		}
+		if err := sleep(ctx, time.Duration(5)*time.Second); err != nil {
+			return err
+		}
+	}
+	return fmt.Errorf("operation '%s' of Cloud Map didn't complete in time", *operationId)
+}
+
+// report custom health status if needed and wait until instance becomes healthy in Cloud Map service.
+// as ECS does, custom health status is reported after the task has become HEALTHY by container health checks,
+// or after it has become RUNNING if it has no container health checks
+func (c *cage) EnsureInstanceHealthy(ctx context.Context, canaryTask *StartCanaryTaskOutput, registration *canaryRegistration) error {
+	taskArn := canaryTask.task.TaskArn
+	if registration.customHealthCheck {
+		if canaryTask.containerHealthCheck {
+			if canaryTask.healthStatus != ecs.HealthStatusHealthy {
+				return fmt.Errorf("canary task '%s' is not healthy by container health checks", *taskArn)
+			}
+		} else if o, err := c.ecs.DescribeTasks(&ecs.DescribeTasksInput{
+			Cluster: &c.env.Cluster,
+			Tasks:   []*string{taskArn},
+		}); err != nil {
+			return err
+		} else if len(o.Tasks) == 0 {
+			return fmt.Errorf("canary task '%s' was not found", *taskArn)
+		} else if status := aws.StringValue(o.Tasks[0].LastStatus); status != ecs.DesiredStatusRunning {
+			return fmt.Errorf("canary task '%s' is not running: %s", *taskArn, status)
+		}
+		log.Infof("reporting canary task '%s' is healthy to Cloud Map service '%s'...", *taskArn, *registration.serviceId)
+		if _, err := c.sd.UpdateInstanceCustomHealthStatus(&servicediscovery.UpdateInstanceCustomHealthStatusInput{
+			ServiceId:  registration.serviceId,
+			InstanceId: registration.instanceId,
+			Status:     aws.String(servicediscovery.CustomHealthStatusHealthy),
+		}); err != nil {
+			return err
+		}
+	} else if !registration.healthCheck {
+		// instances are always UNKNOWN and considered to be healthy
+		log.Infof("health check is not configured for Cloud Map service '%s'", *registration.serviceId)
+		return nil
+	}
+	var previousStatus string
+	for count := 0; count < 20; count++ {
+		if err := sleep(ctx, time.Duration(15)*time.Second); err != nil {
+			return err
+		}
+		var status string
+		if o, err := c.sd.GetInstancesHealthStatus(&servicediscovery.GetInstancesHealthStatusInput{
+			ServiceId: registration.serviceId,
+			Instances: []*string{registration.instanceId},
+		}); err != nil {
+			return err
+		} else {
+			status = aws.StringValue(o.Status[*registration.instanceId])
+		}
+		registration.healthState = status
+		log.Infof("canary task '%s' state in Cloud Map service '%s' is: %s", *taskArn, *registration.serviceId, status)
+		if status != previousStatus {
+			c.emit(&Event{
+				Type:        EventCanaryTaskHealthStateChanged,
+				TaskArn:     *taskArn,
+				RegistryArn: *registration.registryArn,
+				Target:      *registration.instanceId,
+				HealthState: status,
+			})
+			previousStatus = status
+		}
+		switch status {
+		case servicediscovery.HealthStatusHealthy:
+			return nil
+		}
+	}
+	return fmt.Errorf("canary task '%s' didn't become healthy in Cloud Map service '%s'", *taskArn, *registration.serviceId)
+}
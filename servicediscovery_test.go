@@ -0,0 +1,241 @@
+package cage
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/servicediscovery"
+	"github.com/golang/mock/gomock"
+	"github.com/loilo-inc/canarycage/mocks/github.com/aws/aws-sdk-go/service/servicediscovery/servicediscoveryiface"
+	"github.com/loilo-inc/canarycage/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+const registryArn = "arn:aws:servicediscovery:us-west-2:123456789012:service/srv-canary"
+
+func setupServiceDiscovery(ctrl *gomock.Controller, mocker *test.MockContext) *mock_servicediscoveryiface.MockServiceDiscoveryAPI {
+	sdMock := mock_servicediscoveryiface.NewMockServiceDiscoveryAPI(ctrl)
+	sdMock.EXPECT().GetService(gomock.Any()).DoAndReturn(mocker.GetDiscoveryService).AnyTimes()
+	sdMock.EXPECT().RegisterInstance(gomock.Any()).DoAndReturn(mocker.RegisterInstance).AnyTimes()
+	sdMock.EXPECT().DeregisterInstance(gomock.Any()).DoAndReturn(mocker.DeregisterInstance).AnyTimes()
+	sdMock.EXPECT().GetOperation(gomock.Any()).DoAndReturn(mocker.GetOperation).AnyTimes()
+	sdMock.EXPECT().UpdateInstanceCustomHealthStatus(gomock.Any()).DoAndReturn(mocker.UpdateInstanceCustomHealthStatus).AnyTimes()
+	sdMock.EXPECT().GetInstancesHealthStatus(gomock.Any()).DoAndReturn(mocker.GetInstancesHealthStatus).AnyTimes()
+	return sdMock
+}
+
+func TestServiceIdOfRegistry(t *testing.T) {
+	assert.Equal(t, "srv-canary", ServiceIdOfRegistry(registryArn))
+}
+
+func TestCage_StartCanaryTask_ServiceDiscovery(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 1, "FARGATE")
+	cagecli := &cage{env: envars, ecs: ecsMock, alb: albMock, ec2: ec2Mock, sd: setupServiceDiscovery(ctrl, mctx)}
+	service, _ := mctx.GetService(envars.Service)
+	service.LoadBalancers = nil
+	service.ServiceRegistries = []*ecs.ServiceRegistry{{
+		RegistryArn:   aws.String(registryArn),
+		ContainerName: aws.String("container"),
+		ContainerPort: aws.Int64(8000),
+	}}
+	td, _ := cagecli.CreateNextTaskDefinition()
+	tasks, err := cagecli.StartCanaryTasks(context.Background(), td, service, 1)
+	assert.Nil(t, err)
+	assert.Equal(t, "127.0.0.1:8000", tasks[0].address())
+	attributes := mctx.CloudMapInstances["srv-canary"][*tasks[0].registrations[0].instanceId]
+	assert.Equal(t, "127.0.0.1", *attributes["AWS_INSTANCE_IPV4"])
+	assert.Equal(t, "8000", *attributes["AWS_INSTANCE_PORT"])
+	// custom health checkはコンテナがhealthyになってからcageがhealthyにする
+	assert.Equal(t, "UNHEALTHY", *attributes["AWS_INIT_HEALTH_STATUS"])
+	assert.NotNil(t, cagecli.EnsureCanaryTaskHealthy(context.Background(), tasks[0]))
+	assert.Equal(t, "UNHEALTHY", *attributes["AWS_INIT_HEALTH_STATUS"])
+	assert.Nil(t, cagecli.EnsureContainersHealthy(context.Background(), tasks[0], HealthCheckedContainers(td)))
+	assert.Nil(t, cagecli.EnsureCanaryTaskHealthy(context.Background(), tasks[0]))
+	assert.Equal(t, "HEALTHY", *attributes["AWS_INIT_HEALTH_STATUS"])
+	assert.Nil(t, cagecli.StopCanaryTask(tasks[0]))
+	assert.Equal(t, int64(0), mctx.CloudMapInstanceSize())
+}
+
+func TestCage_StopCanaryTask_DeregisterInstanceFailed(t *testing.T) {
+	// Cloud Mapから外せなくてもタスクは止める
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 1, "FARGATE")
+	sdMock := mock_servicediscoveryiface.NewMockServiceDiscoveryAPI(ctrl)
+	sdMock.EXPECT().GetService(gomock.Any()).DoAndReturn(mctx.GetDiscoveryService).AnyTimes()
+	sdMock.EXPECT().RegisterInstance(gomock.Any()).DoAndReturn(mctx.RegisterInstance).AnyTimes()
+	sdMock.EXPECT().GetOperation(gomock.Any()).DoAndReturn(mctx.GetOperation).AnyTimes()
+	sdMock.EXPECT().DeregisterInstance(gomock.Any()).Return(nil, errors.New("throttled"))
+	cagecli := &cage{env: envars, ecs: ecsMock, alb: albMock, ec2: ec2Mock, sd: sdMock}
+	service, _ := mctx.GetService(envars.Service)
+	service.ServiceRegistries = []*ecs.ServiceRegistry{{RegistryArn: aws.String(registryArn)}}
+	td, _ := cagecli.CreateNextTaskDefinition()
+	tasks, err := cagecli.StartCanaryTasks(context.Background(), td, service, 1)
+	assert.Nil(t, err)
+	err = cagecli.StopCanaryTask(tasks[0])
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "throttled")
+	assert.Equal(t, int64(1), mctx.TaskSize())
+}
+
+func TestCage_RollOut_ServiceDiscovery(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	for _, withLoadBalancer := range []bool{true, false} {
+		envars := DefaultEnvars()
+		ctrl := gomock.NewController(t)
+		mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+		service, _ := mctx.GetService(envars.Service)
+		if !withLoadBalancer {
+			service.LoadBalancers = nil
+		}
+		service.ServiceRegistries = []*ecs.ServiceRegistry{{RegistryArn: aws.String(registryArn)}}
+		cagecli := NewCage(&Input{
+			Env:              envars,
+			ECS:              ecsMock,
+			ALB:              albMock,
+			EC2:              ec2Mock,
+			ServiceDiscovery: setupServiceDiscovery(ctrl, mctx),
+		})
+		result, err := cagecli.RollOut(context.Background())
+		assert.Nil(t, err)
+		assert.False(t, result.ServiceIntact)
+		assert.Equal(t, int64(2), mctx.TaskSize())
+		assert.Equal(t, int64(0), mctx.CloudMapInstanceSize())
+		ctrl.Finish()
+	}
+}
+
+func TestCage_RollOut_ServiceDiscoveryUnhealthy(t *testing.T) {
+	// route53のhealth checkが通らなければ打ち切る
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	service, _ := mctx.GetService(envars.Service)
+	service.ServiceRegistries = []*ecs.ServiceRegistry{{RegistryArn: aws.String(registryArn)}}
+	sdMock := mock_servicediscoveryiface.NewMockServiceDiscoveryAPI(ctrl)
+	sdMock.EXPECT().GetService(gomock.Any()).Return(&servicediscovery.GetServiceOutput{
+		Service: &servicediscovery.Service{
+			Id:                aws.String("srv-canary"),
+			HealthCheckConfig: &servicediscovery.HealthCheckConfig{Type: aws.String("HTTP")},
+		},
+	}, nil).AnyTimes()
+	sdMock.EXPECT().RegisterInstance(gomock.Any()).DoAndReturn(mctx.RegisterInstance).AnyTimes()
+	sdMock.EXPECT().DeregisterInstance(gomock.Any()).DoAndReturn(mctx.DeregisterInstance).AnyTimes()
+	sdMock.EXPECT().GetOperation(gomock.Any()).DoAndReturn(mctx.GetOperation).AnyTimes()
+	sdMock.EXPECT().GetInstancesHealthStatus(gomock.Any()).DoAndReturn(func(input *servicediscovery.GetInstancesHealthStatusInput) (*servicediscovery.GetInstancesHealthStatusOutput, error) {
+		return &servicediscovery.GetInstancesHealthStatusOutput{
+			Status: map[string]*string{*input.Instances[0]: aws.String("UNHEALTHY")},
+		}, nil
+	}).AnyTimes()
+	cagecli := NewCage(&Input{
+		Env:              envars,
+		ECS:              ecsMock,
+		ALB:              albMock,
+		EC2:              ec2Mock,
+		ServiceDiscovery: sdMock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.NotNil(t, err)
+	assert.True(t, result.ServiceIntact)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+	assert.Equal(t, int64(0), mctx.CloudMapInstanceSize())
+}
+
+func TestCage_RollOut_ServiceDiscoveryWithoutContainerHealthCheck(t *testing.T) {
+	// コンテナのhealth checkがなければRUNNINGになったらcustom healthをhealthyにする
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	for _, container := range envars.TaskDefinitionInput.ContainerDefinitions {
+		container.HealthCheck = nil
+	}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	service, _ := mctx.GetService(envars.Service)
+	service.ServiceRegistries = []*ecs.ServiceRegistry{{RegistryArn: aws.String(registryArn)}}
+	sdMock := mock_servicediscoveryiface.NewMockServiceDiscoveryAPI(ctrl)
+	sdMock.EXPECT().UpdateInstanceCustomHealthStatus(gomock.Any()).DoAndReturn(func(input *servicediscovery.UpdateInstanceCustomHealthStatusInput) (*servicediscovery.UpdateInstanceCustomHealthStatusOutput, error) {
+		assert.Equal(t, servicediscovery.CustomHealthStatusHealthy, *input.Status)
+		return mctx.UpdateInstanceCustomHealthStatus(input)
+	})
+	sdMock.EXPECT().GetService(gomock.Any()).DoAndReturn(mctx.GetDiscoveryService).AnyTimes()
+	sdMock.EXPECT().RegisterInstance(gomock.Any()).DoAndReturn(mctx.RegisterInstance).AnyTimes()
+	sdMock.EXPECT().DeregisterInstance(gomock.Any()).DoAndReturn(mctx.DeregisterInstance).AnyTimes()
+	sdMock.EXPECT().GetOperation(gomock.Any()).DoAndReturn(mctx.GetOperation).AnyTimes()
+	sdMock.EXPECT().GetInstancesHealthStatus(gomock.Any()).DoAndReturn(mctx.GetInstancesHealthStatus).AnyTimes()
+	cagecli := NewCage(&Input{
+		Env:              envars,
+		ECS:              ecsMock,
+		ALB:              albMock,
+		EC2:              ec2Mock,
+		ServiceDiscovery: sdMock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, result.ServiceIntact)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+	assert.Equal(t, int64(0), mctx.CloudMapInstanceSize())
+}
+
+func TestCage_RollOut_ServiceDiscoveryWithoutHealthCheck(t *testing.T) {
+	// health checkがなければUNKNOWNのままなので待たない
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	service, _ := mctx.GetService(envars.Service)
+	service.ServiceRegistries = []*ecs.ServiceRegistry{{RegistryArn: aws.String(registryArn)}}
+	sdMock := mock_servicediscoveryiface.NewMockServiceDiscoveryAPI(ctrl)
+	sdMock.EXPECT().GetService(gomock.Any()).Return(&servicediscovery.GetServiceOutput{
+		Service: &servicediscovery.Service{Id: aws.String("srv-canary")},
+	}, nil).AnyTimes()
+	sdMock.EXPECT().RegisterInstance(gomock.Any()).DoAndReturn(mctx.RegisterInstance).AnyTimes()
+	sdMock.EXPECT().DeregisterInstance(gomock.Any()).DoAndReturn(mctx.DeregisterInstance).AnyTimes()
+	sdMock.EXPECT().GetOperation(gomock.Any()).DoAndReturn(mctx.GetOperation).AnyTimes()
+	sdMock.EXPECT().GetInstancesHealthStatus(gomock.Any()).Times(0)
+	cagecli := NewCage(&Input{
+		Env:              envars,
+		ECS:              ecsMock,
+		ALB:              albMock,
+		EC2:              ec2Mock,
+		ServiceDiscovery: sdMock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.Nil(t, err)
+	assert.False(t, result.ServiceIntact)
+	assert.Equal(t, int64(0), mctx.CloudMapInstanceSize())
+}
+
+func TestCage_RollOut_ServiceDiscoveryWithoutClient(t *testing.T) {
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	service, _ := mctx.GetService(envars.Service)
+	service.ServiceRegistries = []*ecs.ServiceRegistry{{RegistryArn: aws.String(registryArn)}}
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.NotNil(t, err)
+	assert.True(t, result.ServiceIntact)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
@@ -0,0 +1,88 @@
+package cage
+
+import (
+	"fmt"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"math"
+	"time"
+)
+
+// target group with attributes that affect registration and health checks of canary task
+type targetGroupInfo struct {
+	targetGroup      *elbv2.TargetGroup
+	preserveClientIp bool
+}
+
+func (c *cage) DescribeTargetGroup(targetGroupArn *string) (*targetGroupInfo, error) {
+	var ret *targetGroupInfo
+	if o, err := c.alb.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{
+		TargetGroupArns: []*string{targetGroupArn},
+	}); err != nil {
+		return nil, err
+	} else if len(o.TargetGroups) == 0 {
+		return nil, fmt.Errorf("target group '%s' was not found", *targetGroupArn)
+	} else {
+		ret = &targetGroupInfo{targetGroup: o.TargetGroups[0]}
+	}
+	if o, err := c.alb.DescribeTargetGroupAttributes(&elbv2.DescribeTargetGroupAttributesInput{
+		TargetGroupArn: targetGroupArn,
+	}); err != nil {
+		return nil, err
+	} else {
+		for _, attr := range o.Attributes {
+			if *attr.Key == "preserve_client_ip.enabled" {
+				ret.preserveClientIp = aws.StringValue(attr.Value) == "true"
+			}
+		}
+	}
+	return ret, nil
+}
+
+// whether the target group is for network load balancer
+func (t *targetGroupInfo) isNetwork() bool {
+	switch aws.StringValue(t.targetGroup.Protocol) {
+	case elbv2.ProtocolEnumTcp, elbv2.ProtocolEnumTls, elbv2.ProtocolEnumUdp, elbv2.ProtocolEnumTcpUdp:
+		return true
+	}
+	return false
+}
+
+// ip, instance or empty if not specified
+func (t *targetGroupInfo) targetType() string {
+	return aws.StringValue(t.targetGroup.TargetType)
+}
+
+// interval for polling health state of targets, same as health checks of the target group
+func (t *targetGroupInfo) healthCheckInterval() time.Duration {
+	if aws.Int64Value(t.targetGroup.HealthCheckIntervalSeconds) > 0 {
+		return time.Duration(*t.targetGroup.HealthCheckIntervalSeconds) * time.Second
+	}
+	return time.Duration(15) * time.Second
+}
+
+// time for a newly registered target to pass consecutive health checks and become healthy
+func (t *targetGroupInfo) healthCheckTimeout() time.Duration {
+	threshold := aws.Int64Value(t.targetGroup.HealthyThresholdCount)
+	if threshold <= 0 {
+		threshold = 5
+	}
+	// registering targets to network load balancer takes a few minutes
+	registration := t.healthCheckInterval()
+	if t.isNetwork() {
+		registration = 5 * time.Minute
+	}
+	return t.healthCheckInterval()*time.Duration(threshold) + registration
+}
+
+// number of polls tolerated while target stays 'unused' just after registration
+func (t *targetGroupInfo) unusedBudget(interval time.Duration) int {
+	if t.isNetwork() {
+		return int(math.Ceil(float64(5*time.Minute) / float64(interval)))
+	}
+	return 5
+}
+
+func (t *targetGroupInfo) healthCheckDisabled() bool {
+	return t.targetGroup.HealthCheckEnabled != nil && !*t.targetGroup.HealthCheckEnabled
+}
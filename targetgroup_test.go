@@ -0,0 +1,243 @@
+package cage
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/golang/mock/gomock"
+	"github.com/loilo-inc/canarycage/mocks/github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/loilo-inc/canarycage/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestTargetGroupInfo(t *testing.T) {
+	alb := &targetGroupInfo{targetGroup: &elbv2.TargetGroup{
+		Protocol:                   aws.String("HTTP"),
+		HealthCheckIntervalSeconds: aws.Int64(30),
+	}}
+	assert.False(t, alb.isNetwork())
+	assert.Equal(t, time.Duration(30)*time.Second, alb.healthCheckInterval())
+	// 30s × 5回 + 登録直後の1回
+	assert.Equal(t, time.Duration(180)*time.Second, alb.healthCheckTimeout())
+	assert.Equal(t, 5, alb.unusedBudget(alb.healthCheckInterval()))
+	nlb := &targetGroupInfo{targetGroup: &elbv2.TargetGroup{
+		Protocol:                   aws.String("TCP"),
+		HealthCheckIntervalSeconds: aws.Int64(30),
+		HealthyThresholdCount:      aws.Int64(3),
+	}}
+	assert.True(t, nlb.isNetwork())
+	assert.Equal(t, time.Duration(30)*time.Second, nlb.healthCheckInterval())
+	assert.Equal(t, time.Duration(390)*time.Second, nlb.healthCheckTimeout())
+	assert.Equal(t, 10, nlb.unusedBudget(nlb.healthCheckInterval()))
+	assert.False(t, nlb.healthCheckDisabled())
+}
+
+// alb client with the target group whose health state is 'state' for 'count' times and then healthy
+func setupTargetGroup(
+	ctrl *gomock.Controller,
+	mocker *test.MockContext,
+	targetGroup *elbv2.TargetGroup,
+	state string,
+	count int,
+) *mock_elbv2iface.MockELBV2API {
+	albMock := mock_elbv2iface.NewMockELBV2API(ctrl)
+	albMock.EXPECT().DescribeTargetGroups(gomock.Any()).DoAndReturn(func(input *elbv2.DescribeTargetGroupsInput) (*elbv2.DescribeTargetGroupsOutput, error) {
+		tg := *targetGroup
+		tg.TargetGroupArn = input.TargetGroupArns[0]
+		return &elbv2.DescribeTargetGroupsOutput{TargetGroups: []*elbv2.TargetGroup{&tg}}, nil
+	}).AnyTimes()
+	albMock.EXPECT().DescribeTargetGroupAttributes(gomock.Any()).Return(&elbv2.DescribeTargetGroupAttributesOutput{
+		Attributes: []*elbv2.TargetGroupAttribute{{
+			Key:   aws.String("preserve_client_ip.enabled"),
+			Value: aws.String("true"),
+		}},
+	}, nil).AnyTimes()
+	albMock.EXPECT().RegisterTargets(gomock.Any()).DoAndReturn(mocker.RegisterTarget).AnyTimes()
+	albMock.EXPECT().DeregisterTargets(gomock.Any()).DoAndReturn(mocker.DeregisterTarget).AnyTimes()
+	albMock.EXPECT().WaitUntilTargetDeregistered(gomock.Any()).Return(nil).AnyTimes()
+	gomock.InOrder(
+		albMock.EXPECT().DescribeTargetHealth(gomock.Any()).DoAndReturn(func(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+			return &elbv2.DescribeTargetHealthOutput{
+				TargetHealthDescriptions: []*elbv2.TargetHealthDescription{{
+					Target:       input.Targets[0],
+					TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+				}},
+			}, nil
+		}).MaxTimes(count),
+		albMock.EXPECT().DescribeTargetHealth(gomock.Any()).DoAndReturn(mocker.DescribeTargetHealth).AnyTimes(),
+	)
+	return albMock
+}
+
+func TestCage_RollOut_NetworkLoadBalancer(t *testing.T) {
+	// nlbへの登録は時間がかかるのでunusedをしばらく許容する
+	newTimer = fakeTimer
+	defer recoverTimer()
+	for _, v := range []struct {
+		targetGroup *elbv2.TargetGroup
+		state       string
+		ok          bool
+	}{
+		{
+			targetGroup: &elbv2.TargetGroup{
+				Protocol:                   aws.String("TCP"),
+				TargetType:                 aws.String("ip"),
+				HealthCheckIntervalSeconds: aws.Int64(30),
+				LoadBalancerArns:           []*string{aws.String("arn://hoge/net/aa/bb")},
+			},
+			state: "unused",
+			ok:    true,
+		},
+		{
+			targetGroup: &elbv2.TargetGroup{
+				Protocol:                   aws.String("HTTP"),
+				TargetType:                 aws.String("ip"),
+				HealthCheckIntervalSeconds: aws.Int64(30),
+				LoadBalancerArns:           []*string{aws.String("arn://hoge/app/aa/bb")},
+			},
+			state: "unused",
+			ok:    false,
+		},
+		{
+			targetGroup: &elbv2.TargetGroup{
+				Protocol:           aws.String("UDP"),
+				TargetType:         aws.String("ip"),
+				HealthCheckEnabled: aws.Bool(false),
+				LoadBalancerArns:   []*string{aws.String("arn://hoge/net/aa/bb")},
+			},
+			state: "unavailable",
+			ok:    true,
+		},
+		{
+			// fargateはinstanceで登録できない
+			targetGroup: &elbv2.TargetGroup{
+				Protocol:         aws.String("TCP"),
+				TargetType:       aws.String("instance"),
+				LoadBalancerArns: []*string{aws.String("arn://hoge/net/aa/bb")},
+			},
+			ok: false,
+		},
+	} {
+		envars := DefaultEnvars()
+		// metrics of nlb are skipped, so cloudwatch client is not required
+		envars.AvailabilityThreshold = 0.9999
+		ctrl := gomock.NewController(t)
+		mocker, ecsMock, _, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+		cagecli := NewCage(&Input{
+			Env: envars,
+			ECS: ecsMock,
+			ALB: setupTargetGroup(ctrl, mocker, v.targetGroup, v.state, 8),
+			EC2: ec2Mock,
+		})
+		result, err := cagecli.RollOut(context.Background())
+		if v.ok {
+			assert.Nil(t, err, "%s", v.targetGroup)
+			assert.False(t, result.ServiceIntact)
+		} else {
+			assert.NotNil(t, err, "%s", v.targetGroup)
+			assert.True(t, result.ServiceIntact)
+		}
+		assert.Equal(t, int64(2), mocker.TaskSize())
+		ctrl.Finish()
+	}
+}
+
+func TestCage_EnsureTaskHealthy_Timeout(t *testing.T) {
+	// initialのまま終わらなければ期限で打ち切る
+	newTimer = fakeTimer
+	now = fakeNow
+	defer recoverTimer()
+	for _, v := range []struct {
+		interval time.Duration
+		timeout  time.Duration
+		polls    int
+	}{
+		// 10s × 3回 + 登録直後の1回
+		{polls: 4},
+		{interval: time.Duration(5) * time.Second, polls: 8},
+		{timeout: time.Minute, polls: 6},
+	} {
+		envars := DefaultEnvars()
+		envars.TargetHealthCheckInterval = v.interval
+		envars.TargetHealthCheckTimeout = v.timeout
+		ctrl := gomock.NewController(t)
+		albMock := mock_elbv2iface.NewMockELBV2API(ctrl)
+		polls := 0
+		albMock.EXPECT().DescribeTargetHealth(gomock.Any()).DoAndReturn(func(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+			polls++
+			return &elbv2.DescribeTargetHealthOutput{
+				TargetHealthDescriptions: []*elbv2.TargetHealthDescription{{
+					Target:       input.Targets[0],
+					TargetHealth: &elbv2.TargetHealth{State: aws.String("initial")},
+				}},
+			}, nil
+		}).AnyTimes()
+		cagecli := &cage{env: envars, alb: albMock}
+		target := &canaryTarget{
+			targetGroup: &targetGroupInfo{targetGroup: &elbv2.TargetGroup{
+				Protocol:                   aws.String("HTTP"),
+				HealthCheckIntervalSeconds: aws.Int64(10),
+				HealthyThresholdCount:      aws.Int64(3),
+			}},
+			targetGroupArn: aws.String("arn://tg"),
+			targetId:       aws.String("127.0.0.1"),
+			targetPort:     aws.Int64(8000),
+		}
+		err := cagecli.EnsureTaskHealthy(context.Background(), aws.String("arn://task"), target)
+		assert.NotNil(t, err)
+		assert.Regexp(t, "didn't become healthy", err.Error())
+		assert.Equal(t, v.polls, polls)
+		ctrl.Finish()
+		recoverTimer()
+		newTimer = fakeTimer
+		now = fakeNow
+	}
+}
+
+func TestCage_EnsureTaskHealthy_GracePeriod(t *testing.T) {
+	// grace period中のunhealthyは許容する
+	newTimer = fakeTimer
+	now = fakeNow
+	defer recoverTimer()
+	for _, v := range []struct {
+		gracePeriod time.Duration
+		ok          bool
+	}{
+		{gracePeriod: time.Minute, ok: true},
+		{gracePeriod: 0, ok: false},
+	} {
+		ctrl := gomock.NewController(t)
+		albMock := mock_elbv2iface.NewMockELBV2API(ctrl)
+		polls := 0
+		albMock.EXPECT().DescribeTargetHealth(gomock.Any()).DoAndReturn(func(input *elbv2.DescribeTargetHealthInput) (*elbv2.DescribeTargetHealthOutput, error) {
+			// 3回目まではunhealthy
+			polls++
+			state := "unhealthy"
+			if polls > 3 {
+				state = "healthy"
+			}
+			return &elbv2.DescribeTargetHealthOutput{
+				TargetHealthDescriptions: []*elbv2.TargetHealthDescription{{
+					Target:       input.Targets[0],
+					TargetHealth: &elbv2.TargetHealth{State: aws.String(state)},
+				}},
+			}, nil
+		}).AnyTimes()
+		cagecli := &cage{env: DefaultEnvars(), alb: albMock}
+		target := &canaryTarget{
+			targetGroup: &targetGroupInfo{targetGroup: &elbv2.TargetGroup{
+				Protocol:                   aws.String("HTTP"),
+				HealthCheckIntervalSeconds: aws.Int64(10),
+			}},
+			targetGroupArn:         aws.String("arn://tg"),
+			targetId:               aws.String("127.0.0.1"),
+			targetPort:             aws.Int64(8000),
+			healthCheckGracePeriod: v.gracePeriod,
+		}
+		err := cagecli.EnsureTaskHealthy(context.Background(), aws.String("arn://task"), target)
+		assert.Equal(t, v.ok, err == nil, "%s", err)
+		ctrl.Finish()
+	}
+}
@@ -0,0 +1,255 @@
+package cage
+
+import (
+	"context"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"math"
+	"time"
+)
+
+func IsExternalService(service *ecs.Service) bool {
+	return service.DeploymentController != nil &&
+		aws.StringValue(service.DeploymentController.Type) == ecs.DeploymentControllerTypeExternal
+}
+
+// find current primary task set of the service
+func PrimaryTaskSet(service *ecs.Service) *ecs.TaskSet {
+	for _, v := range service.TaskSets {
+		if aws.StringValue(v.Status) == "PRIMARY" {
+			return v
+		}
+	}
+	return nil
+}
+
+// scale of canary task set in percent of the service's desired count
+func (c *cage) CanaryTaskSetScale(service *ecs.Service) float64 {
+	if *service.DesiredCount == 0 {
+		return 100
+	}
+	scale := math.Ceil(float64(c.CanaryTaskCount(service)) * 100 / float64(*service.DesiredCount))
+	return math.Min(scale, 100)
+}
+
+// Roll out service with EXTERNAL deployment controller by managing task sets.
+//
+//  1. create task set with next task definition at small scale, as canary
+//  2. verify tasks of the task set in the same way as canary tasks
+//  3. scale the task set up to 100% and make it primary
+//  4. delete previous primary task set
+//
+// If any step before switching primary task set fails, the new task set is deleted.
+func (c *cage) RollOutWithTaskSets(
+	ctx context.Context,
+	service *ecs.Service,
+	nextTaskDefinition *ecs.TaskDefinition,
+	result *RollOutResult,
+) error {
+	primary := PrimaryTaskSet(service)
+	if primary == nil {
+		return fmt.Errorf("service '%s' has no primary task set", c.env.Service)
+	}
+	loadBalancers := primary.LoadBalancers
+	if len(loadBalancers) == 0 {
+		loadBalancers = service.LoadBalancers
+	}
+	scale := c.CanaryTaskSetScale(service)
+	beginPhase(&result.Phases, PhaseStartCanary)
+	log.Infof("creating canary task set with %.0f%% scale...", scale)
+	var taskSet *ecs.TaskSet
+	if o, err := c.ecs.CreateTaskSet(&ecs.CreateTaskSetInput{
+		Cluster:                  &c.env.Cluster,
+		Service:                  &c.env.Service,
+		TaskDefinition:           nextTaskDefinition.TaskDefinitionArn,
+		ExternalId:               primary.ExternalId,
+		LaunchType:               primary.LaunchType,
+		PlatformVersion:          primary.PlatformVersion,
+		CapacityProviderStrategy: primary.CapacityProviderStrategy,
+		NetworkConfiguration:     primary.NetworkConfiguration,
+		LoadBalancers:            loadBalancers,
+		ServiceRegistries:        primary.ServiceRegistries,
+		Scale: &ecs.Scale{
+			Unit:  aws.String(ecs.ScaleUnitPercent),
+			Value: aws.Float64(scale),
+		},
+	}); err != nil {
+		return err
+	} else {
+		taskSet = o.TaskSet
+	}
+	log.Infof("canary task set '%s' has been created", *taskSet.Id)
+	promoted := false
+	defer func() {
+		if promoted {
+			return
+		}
+		log.Infof("deleting canary task set '%s'...", *taskSet.Id)
+		if err := c.DeleteTaskSet(taskSet.Id); err != nil {
+			log.Errorf("😱 failed to delete canary task set '%s': %s", *taskSet.Id, err)
+		} else if !result.ServiceIntact {
+			result.RolledBack = true
+		}
+	}()
+	if err := c.WaitUntilTaskSetStable(ctx, taskSet.Id); err != nil {
+		return err
+	}
+	tasks, err := c.DescribeTaskSetTasks(taskSet.Id, loadBalancers)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		result.CanaryTasks = canaryTaskResults(tasks)
+	}()
+	// tasks were started by ECS and are already running as the task set is stable
+	for _, task := range tasks {
+		c.emit(&Event{Type: EventCanaryTaskStarted, TaskDefinitionArn: *nextTaskDefinition.TaskDefinitionArn, TaskArn: *task.task.TaskArn})
+		c.emit(&Event{Type: EventCanaryTaskRunning, TaskDefinitionArn: *nextTaskDefinition.TaskDefinitionArn, TaskArn: *task.task.TaskArn})
+	}
+	beginPhase(&result.Phases, PhaseVerifyCanary)
+	if err := c.VerifyCanaryTasks(ctx, nextTaskDefinition, tasks); err != nil {
+		return err
+	}
+	if c.approver != nil {
+		beginPhase(&result.Phases, PhaseApproval)
+		if err := c.WaitForApproval(ctx, nextTaskDefinition, tasks); err != nil {
+			return err
+		}
+	}
+	beginPhase(&result.Phases, PhaseUpdateService)
+	log.Infof("scaling task set '%s' up to 100%%...", *taskSet.Id)
+	c.emit(&Event{Type: EventServiceUpdateStarted, TaskDefinitionArn: *nextTaskDefinition.TaskDefinitionArn})
+	result.ServiceIntact = false
+	if _, err := c.ecs.UpdateTaskSet(&ecs.UpdateTaskSetInput{
+		Cluster: &c.env.Cluster,
+		Service: &c.env.Service,
+		TaskSet: taskSet.Id,
+		Scale: &ecs.Scale{
+			Unit:  aws.String(ecs.ScaleUnitPercent),
+			Value: aws.Float64(100),
+		},
+	}); err != nil {
+		return err
+	}
+	if err := c.WaitUntilTaskSetStable(ctx, taskSet.Id); err != nil {
+		return err
+	}
+	log.Infof("making task set '%s' primary...", *taskSet.Id)
+	if _, err := c.ecs.UpdateServicePrimaryTaskSet(&ecs.UpdateServicePrimaryTaskSetInput{
+		Cluster:        &c.env.Cluster,
+		Service:        &c.env.Service,
+		PrimaryTaskSet: taskSet.Id,
+	}); err != nil {
+		return err
+	}
+	promoted = true
+	log.Infof("deleting previous task set '%s'...", *primary.Id)
+	if err := c.DeleteTaskSet(primary.Id); err != nil {
+		return err
+	}
+	log.Infof("waiting for service '%s' to be stable...", c.env.Service)
+	if err := c.ecs.WaitUntilServicesStableWithContext(ctx, &ecs.DescribeServicesInput{
+		Cluster:  &c.env.Cluster,
+		Services: []*string{&c.env.Service},
+	}); err != nil {
+		return err
+	}
+	c.emit(&Event{Type: EventServiceStable, TaskDefinitionArn: *nextTaskDefinition.TaskDefinitionArn})
+	return nil
+}
+
+// wait for task set to reach STEADY_STATE, polling in the same way as ECS waiters
+func (c *cage) WaitUntilTaskSetStable(ctx context.Context, taskSetId *string) error {
+	for i := 0; i < 40; i++ {
+		if err := sleep(ctx, time.Duration(15)*time.Second); err != nil {
+			return err
+		}
+		o, err := c.ecs.DescribeTaskSets(&ecs.DescribeTaskSetsInput{
+			Cluster:  &c.env.Cluster,
+			Service:  &c.env.Service,
+			TaskSets: []*string{taskSetId},
+		})
+		if err != nil {
+			return err
+		} else if len(o.TaskSets) == 0 {
+			return fmt.Errorf("task set '%s' was not found", *taskSetId)
+		}
+		taskSet := o.TaskSets[0]
+		if aws.StringValue(taskSet.StabilityStatus) == ecs.StabilityStatusSteadyState {
+			log.Infof("task set '%s' is stable: running = %d", *taskSetId, aws.Int64Value(taskSet.RunningCount))
+			return nil
+		}
+		log.Infof(
+			"task set '%s' is stabilizing: running = %d, desired = %d",
+			*taskSetId, aws.Int64Value(taskSet.RunningCount), aws.Int64Value(taskSet.ComputedDesiredCount),
+		)
+	}
+	return fmt.Errorf("task set '%s' didn't become stable", *taskSetId)
+}
+
+func (c *cage) DeleteTaskSet(taskSetId *string) error {
+	_, err := c.ecs.DeleteTaskSet(&ecs.DeleteTaskSetInput{
+		Cluster: &c.env.Cluster,
+		Service: &c.env.Service,
+		TaskSet: taskSetId,
+		Force:   aws.Bool(true),
+	})
+	return err
+}
+
+// describe running tasks of the task set and their targets in the load balancer.
+// tasks are registered to target group by ECS, so they are never deregistered by cage.
+func (c *cage) DescribeTaskSetTasks(taskSetId *string, loadBalancers []*ecs.LoadBalancer) ([]*StartCanaryTaskOutput, error) {
+	var arns []*string
+	if o, err := c.ecs.ListTasks(&ecs.ListTasksInput{
+		Cluster:   &c.env.Cluster,
+		StartedBy: taskSetId,
+	}); err != nil {
+		return nil, err
+	} else {
+		arns = o.TaskArns
+	}
+	if len(arns) == 0 {
+		return nil, fmt.Errorf("no task of task set '%s' is running", *taskSetId)
+	}
+	var tasks []*ecs.Task
+	if o, err := c.ecs.DescribeTasks(&ecs.DescribeTasksInput{
+		Cluster: &c.env.Cluster,
+		Tasks:   arns,
+	}); err != nil {
+		return nil, err
+	} else {
+		tasks = o.Tasks
+	}
+	var targetGroups []*targetGroupInfo
+	for _, lb := range loadBalancers {
+		if tg, err := c.DescribeTargetGroup(lb.TargetGroupArn); err != nil {
+			return nil, err
+		} else {
+			targetGroups = append(targetGroups, tg)
+		}
+	}
+	var ret []*StartCanaryTaskOutput
+	for _, task := range tasks {
+		placement, err := c.DescribeTaskPlacement(task)
+		if err != nil {
+			return nil, err
+		}
+		output := &StartCanaryTaskOutput{
+			task:                task,
+			registrationSkipped: true,
+			privateIp:           placement.privateIp,
+		}
+		for i, lb := range loadBalancers {
+			if target, err := c.taskTarget(task, lb, targetGroups[i], placement); err != nil {
+				return nil, err
+			} else {
+				output.targets = append(output.targets, target)
+			}
+		}
+		ret = append(ret, output)
+	}
+	return ret, nil
+}
@@ -0,0 +1,114 @@
+package cage
+
+import (
+	"context"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/golang/mock/gomock"
+	"github.com/loilo-inc/canarycage/mocks/github.com/aws/aws-sdk-go/service/cloudwatch/cloudwatchiface"
+	"github.com/loilo-inc/canarycage/test"
+	"github.com/stretchr/testify/assert"
+	"testing"
+)
+
+// make the service EXTERNAL deployment controller with a primary task set
+func setupTaskSet(t *testing.T, mctx *test.MockContext, envars *Envars, desiredCount int64) *ecs.Service {
+	service, _ := mctx.GetService(envars.Service)
+	service.DesiredCount = aws.Int64(desiredCount)
+	service.DeploymentController = &ecs.DeploymentController{Type: aws.String(ecs.DeploymentControllerTypeExternal)}
+	o, err := mctx.CreateTaskSet(&ecs.CreateTaskSetInput{
+		Cluster:        &envars.Cluster,
+		Service:        &envars.Service,
+		TaskDefinition: service.TaskDefinition,
+		LaunchType:     aws.String("FARGATE"),
+		LoadBalancers:  service.LoadBalancers,
+		Scale:          &ecs.Scale{Unit: aws.String(ecs.ScaleUnitPercent), Value: aws.Float64(100)},
+	})
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	if _, err := mctx.UpdateServicePrimaryTaskSet(&ecs.UpdateServicePrimaryTaskSetInput{
+		Cluster:        &envars.Cluster,
+		Service:        &envars.Service,
+		PrimaryTaskSet: o.TaskSet.Id,
+	}); err != nil {
+		t.Fatalf(err.Error())
+	}
+	return service
+}
+
+func TestCage_RollOut_TaskSet(t *testing.T) {
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 0, "FARGATE")
+	service := setupTaskSet(t, mctx, envars, 4)
+	previousTaskDefinition := *service.TaskDefinition
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.False(t, result.ServiceIntact)
+	assert.Equal(t, int64(1), mctx.TaskSetSize())
+	assert.Equal(t, int64(4), mctx.TaskSize())
+	primary := PrimaryTaskSet(service)
+	assert.NotNil(t, primary)
+	assert.NotEqual(t, previousTaskDefinition, *primary.TaskDefinition)
+	assert.Equal(t, *primary.TaskDefinition, *service.TaskDefinition)
+}
+
+func TestCage_RollOut_TaskSetFailed(t *testing.T) {
+	// canaryのtask setが基準を満たさない場合は削除して元のtask setを残す
+	newTimer = fakeTimer
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.ResponseTimeThreshold = 0.05
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 0, "FARGATE")
+	service := setupTaskSet(t, mctx, envars, 4)
+	previousTaskDefinition := *service.TaskDefinition
+	cwMock := mock_cloudwatchiface.NewMockCloudWatchAPI(ctrl)
+	cwMock.EXPECT().GetMetricStatistics(gomock.Any()).DoAndReturn(mctx.GetMetricStatics).AnyTimes()
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+		CW:  cwMock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.NotNil(t, err)
+	assert.True(t, result.ServiceIntact)
+	assert.Equal(t, int64(1), mctx.TaskSetSize())
+	assert.Equal(t, int64(4), mctx.TaskSize())
+	assert.Equal(t, previousTaskDefinition, *PrimaryTaskSet(service).TaskDefinition)
+}
+
+func TestCage_CanaryTaskSetScale(t *testing.T) {
+	for _, v := range []struct {
+		desired    int64
+		count      int64
+		percentage int64
+		expected   float64
+	}{
+		{desired: 4, expected: 25},
+		{desired: 3, expected: 34},
+		{desired: 4, count: 2, expected: 50},
+		{desired: 10, percentage: 20, expected: 20},
+		{desired: 1, count: 3, expected: 100},
+		{desired: 0, expected: 100},
+	} {
+		service := &ecs.Service{DesiredCount: aws.Int64(v.desired)}
+		cagecli := &cage{env: &Envars{CanaryCount: v.count, CanaryPercentage: v.percentage}}
+		assert.Equal(t, v.expected, cagecli.CanaryTaskSetScale(service))
+	}
+}
@@ -5,18 +5,29 @@ import (
 	"fmt"
 	"github.com/apex/log"
 	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/request"
 	"github.com/aws/aws-sdk-go/service/cloudwatch"
 	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/aws/aws-sdk-go/service/ecs"
 	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/aws/aws-sdk-go/service/servicediscovery"
 	"github.com/google/uuid"
+	"math"
 	"regexp"
 	"sync"
+	"time"
 )
 
 type MockContext struct {
 	Services map[string]*ecs.Service
 	Tasks    map[string]*ecs.Task
+	TaskSets map[string]*ecs.TaskSet
+	TaskDefinitions map[string]*ecs.TaskDefinition
+	ContainerInstances map[string]*ecs.ContainerInstance
+	// health status of containers with health check. default: HEALTHY
+	ContainerHealthStatus string
+	// attributes of instances for each Cloud Map service
+	CloudMapInstances map[string]map[string]map[string]*string
 	mux      sync.Mutex
 }
 
@@ -24,6 +35,11 @@ func NewMockContext() *MockContext {
 	return &MockContext{
 		Services: make(map[string]*ecs.Service),
 		Tasks:    make(map[string]*ecs.Task),
+		TaskSets: make(map[string]*ecs.TaskSet),
+		TaskDefinitions: make(map[string]*ecs.TaskDefinition),
+		ContainerInstances: make(map[string]*ecs.ContainerInstance),
+		CloudMapInstances: make(map[string]map[string]map[string]*string),
+		ContainerHealthStatus: "HEALTHY",
 	}
 }
 
@@ -53,24 +69,30 @@ func (ctx *MockContext) ServiceSize() int64 {
 	return int64(len(ctx.Services))
 }
 
+// returns a datapoint for every period from start time to end time
 func (ctx *MockContext) GetMetricStatics(input *cloudwatch.GetMetricStatisticsInput) (*cloudwatch.GetMetricStatisticsOutput, error) {
-	var ret = &cloudwatch.Datapoint{}
-	switch *input.MetricName {
-	case "RequestCount":
-		sum := 100000.0
-		ret.Sum = &sum
-	case "HTTPCode_ELB_5XX_Count":
-		sum := 1.0
-		ret.Sum = &sum
-	case "HTTPCode_Target_5XX_Count":
-		sum := 1.0
-		ret.Sum = &sum
-	case "TargetResponseTime":
-		average := 0.1
-		ret.Average = &average
+	var points []*cloudwatch.Datapoint
+	period := time.Duration(*input.Period) * time.Second
+	for t := input.StartTime.Truncate(period); t.Before(*input.EndTime); t = t.Add(period) {
+		var ret = &cloudwatch.Datapoint{Timestamp: aws.Time(t)}
+		switch *input.MetricName {
+		case "RequestCount":
+			sum := 100000.0
+			ret.Sum = &sum
+		case "HTTPCode_ELB_5XX_Count":
+			sum := 1.0
+			ret.Sum = &sum
+		case "HTTPCode_Target_5XX_Count":
+			sum := 1.0
+			ret.Sum = &sum
+		case "TargetResponseTime":
+			average := 0.1
+			ret.Average = &average
+		}
+		points = append(points, ret)
 	}
 	return &cloudwatch.GetMetricStatisticsOutput{
-		Datapoints: []*cloudwatch.Datapoint{ret},
+		Datapoints: points,
 	}, nil
 }
 
@@ -177,13 +199,21 @@ func (ctx *MockContext) DeleteService(input *ecs.DeleteServiceInput) (*ecs.Delet
 
 func (ctx *MockContext) RegisterTaskDefinition(input *ecs.RegisterTaskDefinitionInput) (*ecs.RegisterTaskDefinitionOutput, error) {
 	idstr := uuid.New().String()
+	td := &ecs.TaskDefinition{
+		TaskDefinitionArn: &idstr,
+		Family:            aws.String("family"),
+		Revision:          aws.Int64(1),
+		ContainerDefinitions: input.ContainerDefinitions,
+		NetworkMode: input.NetworkMode,
+		Cpu: input.Cpu,
+		Memory: input.Memory,
+		PlacementConstraints: input.PlacementConstraints,
+	}
+	ctx.mux.Lock()
+	defer ctx.mux.Unlock()
+	ctx.TaskDefinitions[idstr] = td
 	return &ecs.RegisterTaskDefinitionOutput{
-		TaskDefinition: &ecs.TaskDefinition{
-			TaskDefinitionArn: &idstr,
-			Family:            aws.String("family"),
-			Revision:          aws.Int64(1),
-			ContainerDefinitions: input.ContainerDefinitions,
-		},
+		TaskDefinition: td,
 	}, nil
 }
 
@@ -201,6 +231,9 @@ func (ctx *MockContext) StartTask(input *ecs.StartTaskInput) (*ecs.StartTaskOutp
 		ClusterArn:        input.Cluster,
 		TaskDefinitionArn: input.TaskDefinition,
 		Group:             input.Group,
+		StartedBy:         input.StartedBy,
+		LastStatus:        aws.String("RUNNING"),
+		DesiredStatus:     aws.String("RUNNING"),
 	}
 	ctx.mux.Lock()
 	defer ctx.mux.Unlock()
@@ -222,6 +255,49 @@ func (ctx *MockContext) StartTask(input *ecs.StartTaskInput) (*ecs.StartTaskOutp
 		ret.Attachments = attachments
 	} else {
 		ret.ContainerInstanceArn = aws.String("arn:aws:ecs:us-west-2:1234567890:container-instance/12345678-hoge-hoge-1234-1f2o3o4ba5r")
+		if len(input.ContainerInstances) > 0 {
+			ret.ContainerInstanceArn = input.ContainerInstances[0]
+		}
+		if input.NetworkConfiguration != nil && input.NetworkConfiguration.AwsvpcConfiguration != nil {
+			// awsvpc
+			ret.Attachments = []*ecs.Attachment{{
+				Type: aws.String("ElasticNetworkInterface"),
+				Details: []*ecs.KeyValuePair{{
+					Name:  aws.String("subnetId"),
+					Value: input.NetworkConfiguration.AwsvpcConfiguration.Subnets[0],
+				}, {
+					Name:  aws.String("privateIPv4Address"),
+					Value: aws.String("127.0.0.2"),
+				}},
+			}}
+		}
+	}
+	if td, ok := ctx.TaskDefinitions[*input.TaskDefinition]; ok {
+		// bridge if no network interface is attached. host port is assigned dynamically if not specified
+		bridge := ret.Attachments == nil
+		dynamicPort := int64(32768)
+		ret.HealthStatus = aws.String("UNKNOWN")
+		for _, container := range td.ContainerDefinitions {
+			c := &ecs.Container{Name: container.Name, HealthStatus: aws.String("UNKNOWN")}
+			if container.HealthCheck != nil {
+				c.HealthStatus = aws.String(ctx.ContainerHealthStatus)
+				ret.HealthStatus = c.HealthStatus
+			}
+			for _, mapping := range container.PortMappings {
+				if bridge {
+					hostPort := aws.Int64Value(mapping.HostPort)
+					if hostPort == 0 {
+						hostPort = dynamicPort
+						dynamicPort++
+					}
+					c.NetworkBindings = append(c.NetworkBindings, &ecs.NetworkBinding{
+						ContainerPort: mapping.ContainerPort,
+						HostPort:      aws.Int64(hostPort),
+					})
+				}
+			}
+			ret.Containers = append(ret.Containers, c)
+		}
 	}
 	return &ecs.StartTaskOutput{
 		Tasks: []*ecs.Task{ret},
@@ -235,6 +311,17 @@ func (ctx *MockContext) RunTask(input *ecs.RunTaskInput) (*ecs.RunTaskOutput, er
 		NetworkConfiguration: input.NetworkConfiguration,
 	})
 	if err != nil { return nil, err }
+	task := o.Tasks[0]
+	if input.LaunchType != nil {
+		task.LaunchType = input.LaunchType
+	}
+	if len(input.CapacityProviderStrategy) > 0 {
+		task.LaunchType = nil
+		task.CapacityProviderName = input.CapacityProviderStrategy[0].CapacityProvider
+	}
+	task.PlatformVersion = input.PlatformVersion
+	task.EnableExecuteCommand = input.EnableExecuteCommand
+	task.Tags = input.Tags
 	return &ecs.RunTaskOutput{
 		Tasks: o.Tasks,
 	}, nil
@@ -260,6 +347,12 @@ func (ctx *MockContext) ListTasks(input *ecs.ListTasksInput) (*ecs.ListTasksOutp
 	ctx.mux.Lock()
 	defer ctx.mux.Unlock()
 	for _, v := range ctx.Tasks {
+		if input.StartedBy != nil {
+			if aws.StringValue(v.StartedBy) == *input.StartedBy {
+				ret = append(ret, v.TaskArn)
+			}
+			continue
+		}
 		group := fmt.Sprintf("service:%s", *input.ServiceName)
 		if *v.Group == group {
 			ret = append(ret, v.TaskArn)
@@ -270,6 +363,156 @@ func (ctx *MockContext) ListTasks(input *ecs.ListTasksInput) (*ecs.ListTasksOutp
 	}, nil
 }
 
+func (ctx *MockContext) GetTaskSet(id string) (*ecs.TaskSet, bool) {
+	ctx.mux.Lock()
+	defer ctx.mux.Unlock()
+	o, ok := ctx.TaskSets[id]
+	return o, ok
+}
+
+func (ctx *MockContext) TaskSetSize() int64 {
+	ctx.mux.Lock()
+	defer ctx.mux.Unlock()
+	return int64(len(ctx.TaskSets))
+}
+
+// tasks of task set are started by task set id
+func (ctx *MockContext) scaleTaskSet(taskSet *ecs.TaskSet, service *ecs.Service) {
+	desiredCount := int64(math.Ceil(float64(*service.DesiredCount) * *taskSet.Scale.Value / 100))
+	var tasks []*string
+	ctx.mux.Lock()
+	for _, v := range ctx.Tasks {
+		if aws.StringValue(v.StartedBy) == *taskSet.Id {
+			tasks = append(tasks, v.TaskArn)
+		}
+	}
+	ctx.mux.Unlock()
+	for i := int64(len(tasks)); i < desiredCount; i++ {
+		ctx.StartTask(&ecs.StartTaskInput{
+			Cluster:        taskSet.ClusterArn,
+			Group:          aws.String(fmt.Sprintf("task-set:%s", *taskSet.Id)),
+			StartedBy:      taskSet.Id,
+			TaskDefinition: taskSet.TaskDefinition,
+		})
+	}
+	for i := desiredCount; i < int64(len(tasks)); i++ {
+		ctx.StopTask(&ecs.StopTaskInput{
+			Cluster: taskSet.ClusterArn,
+			Task:    tasks[i],
+		})
+	}
+	ctx.mux.Lock()
+	taskSet.ComputedDesiredCount = aws.Int64(desiredCount)
+	taskSet.RunningCount = aws.Int64(desiredCount)
+	taskSet.PendingCount = aws.Int64(0)
+	taskSet.StabilityStatus = aws.String(ecs.StabilityStatusSteadyState)
+	ctx.mux.Unlock()
+}
+
+func (ctx *MockContext) CreateTaskSet(input *ecs.CreateTaskSetInput) (*ecs.CreateTaskSetOutput, error) {
+	ctx.mux.Lock()
+	service, ok := ctx.Services[*input.Service]
+	ctx.mux.Unlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("service:%s not found", *input.Service))
+	}
+	id := fmt.Sprintf("ecs-svc/%s", uuid.New().String())
+	ret := &ecs.TaskSet{
+		Id:                   &id,
+		TaskSetArn:           aws.String(fmt.Sprintf("arn:aws:ecs:us-west-2:1234567890:task-set/%s", id)),
+		ClusterArn:           input.Cluster,
+		ServiceArn:           service.ServiceArn,
+		ExternalId:           input.ExternalId,
+		Status:               aws.String("ACTIVE"),
+		TaskDefinition:       input.TaskDefinition,
+		LaunchType:           input.LaunchType,
+		NetworkConfiguration: input.NetworkConfiguration,
+		LoadBalancers:        input.LoadBalancers,
+		Scale:                input.Scale,
+	}
+	ctx.mux.Lock()
+	ctx.TaskSets[id] = ret
+	service.TaskSets = append(service.TaskSets, ret)
+	ctx.mux.Unlock()
+	ctx.scaleTaskSet(ret, service)
+	return &ecs.CreateTaskSetOutput{
+		TaskSet: ret,
+	}, nil
+}
+
+func (ctx *MockContext) DescribeTaskSets(input *ecs.DescribeTaskSetsInput) (*ecs.DescribeTaskSetsOutput, error) {
+	ctx.mux.Lock()
+	defer ctx.mux.Unlock()
+	var ret []*ecs.TaskSet
+	for _, v := range input.TaskSets {
+		if taskSet, ok := ctx.TaskSets[*v]; ok {
+			ret = append(ret, taskSet)
+		}
+	}
+	return &ecs.DescribeTaskSetsOutput{
+		TaskSets: ret,
+	}, nil
+}
+
+func (ctx *MockContext) UpdateTaskSet(input *ecs.UpdateTaskSetInput) (*ecs.UpdateTaskSetOutput, error) {
+	ctx.mux.Lock()
+	service := ctx.Services[*input.Service]
+	taskSet, ok := ctx.TaskSets[*input.TaskSet]
+	ctx.mux.Unlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("task set:%s not found", *input.TaskSet))
+	}
+	taskSet.Scale = input.Scale
+	ctx.scaleTaskSet(taskSet, service)
+	return &ecs.UpdateTaskSetOutput{
+		TaskSet: taskSet,
+	}, nil
+}
+
+func (ctx *MockContext) UpdateServicePrimaryTaskSet(input *ecs.UpdateServicePrimaryTaskSetInput) (*ecs.UpdateServicePrimaryTaskSetOutput, error) {
+	ctx.mux.Lock()
+	defer ctx.mux.Unlock()
+	service := ctx.Services[*input.Service]
+	primary, ok := ctx.TaskSets[*input.PrimaryTaskSet]
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("task set:%s not found", *input.PrimaryTaskSet))
+	}
+	for _, v := range service.TaskSets {
+		v.Status = aws.String("ACTIVE")
+	}
+	primary.Status = aws.String("PRIMARY")
+	service.TaskDefinition = primary.TaskDefinition
+	return &ecs.UpdateServicePrimaryTaskSetOutput{
+		TaskSet: primary,
+	}, nil
+}
+
+func (ctx *MockContext) DeleteTaskSet(input *ecs.DeleteTaskSetInput) (*ecs.DeleteTaskSetOutput, error) {
+	ctx.mux.Lock()
+	service := ctx.Services[*input.Service]
+	taskSet, ok := ctx.TaskSets[*input.TaskSet]
+	ctx.mux.Unlock()
+	if !ok {
+		return nil, errors.New(fmt.Sprintf("task set:%s not found", *input.TaskSet))
+	}
+	taskSet.Scale = &ecs.Scale{Unit: aws.String(ecs.ScaleUnitPercent), Value: aws.Float64(0)}
+	ctx.scaleTaskSet(taskSet, service)
+	ctx.mux.Lock()
+	defer ctx.mux.Unlock()
+	delete(ctx.TaskSets, *input.TaskSet)
+	var taskSets []*ecs.TaskSet
+	for _, v := range service.TaskSets {
+		if *v.Id != *input.TaskSet {
+			taskSets = append(taskSets, v)
+		}
+	}
+	service.TaskSets = taskSets
+	taskSet.Status = aws.String("DRAINING")
+	return &ecs.DeleteTaskSetOutput{
+		TaskSet: taskSet,
+	}, nil
+}
+
 func (ctx *MockContext) WaitUntilServicesStable(input *ecs.DescribeServicesInput) error {
 	ctx.mux.Lock()
 	defer ctx.mux.Unlock()
@@ -281,6 +524,13 @@ func (ctx *MockContext) WaitUntilServicesStable(input *ecs.DescribeServicesInput
 	return nil
 }
 
+func (ctx *MockContext) WaitUntilServicesStableWithContext(c aws.Context, input *ecs.DescribeServicesInput, opts ...request.WaiterOption) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	return ctx.WaitUntilServicesStable(input)
+}
+
 func (ctx *MockContext) DescribeServices(input *ecs.DescribeServicesInput) (*ecs.DescribeServicesOutput, error) {
 	var ret []*ecs.Service
 	ctx.mux.Lock()
@@ -316,6 +566,12 @@ func (ctx *MockContext) WaitUntilTasksRunning(input *ecs.DescribeTasksInput) err
 	}
 	return nil
 }
+func (ctx *MockContext) WaitUntilTasksRunningWithContext(c aws.Context, input *ecs.DescribeTasksInput, opts ...request.WaiterOption) error {
+	if err := c.Err(); err != nil {
+		return err
+	}
+	return ctx.WaitUntilTasksRunning(input)
+}
 func (ctx *MockContext) WaitUntilTasksStopped(input *ecs.DescribeTasksInput) error {
 	ctx.mux.Lock()
 	defer ctx.mux.Unlock()
@@ -341,10 +597,45 @@ func (ctx *MockContext) DescribeTasks(input *ecs.DescribeTasksInput) (*ecs.Descr
 		Tasks: ret,
 	}, nil
 }
+func (ctx *MockContext) PutContainerInstance(instance *ecs.ContainerInstance) {
+	ctx.mux.Lock()
+	defer ctx.mux.Unlock()
+	ctx.ContainerInstances[*instance.ContainerInstanceArn] = instance
+}
+
+func (ctx *MockContext) ListContainerInstances(input *ecs.ListContainerInstancesInput) (*ecs.ListContainerInstancesOutput, error) {
+	ctx.mux.Lock()
+	defer ctx.mux.Unlock()
+	var ret []*string
+	for arn, v := range ctx.ContainerInstances {
+		if input.Status != nil && aws.StringValue(v.Status) != *input.Status {
+			continue
+		}
+		// only ec2InstanceId filter is supported
+		if m := regexp.MustCompile(`^ec2InstanceId == (.+)$`).FindStringSubmatch(aws.StringValue(input.Filter)); m != nil && aws.StringValue(v.Ec2InstanceId) != m[1] {
+			continue
+		}
+		ret = append(ret, aws.String(arn))
+	}
+	return &ecs.ListContainerInstancesOutput{
+		ContainerInstanceArns: ret,
+	}, nil
+}
+
 func (ctx *MockContext) DescribeContainerInstances(input *ecs.DescribeContainerInstancesInput) (*ecs.DescribeContainerInstancesOutput, error) {
 	ctx.mux.Lock()
 	defer ctx.mux.Unlock()
 	var ret []*ecs.ContainerInstance
+	if len(ctx.ContainerInstances) > 0 {
+		for _, v := range input.ContainerInstances {
+			if o, ok := ctx.ContainerInstances[*v]; ok {
+				ret = append(ret, o)
+			}
+		}
+		return &ecs.DescribeContainerInstancesOutput{
+			ContainerInstances: ret,
+		}, nil
+	}
 	ec2Id := "i-1234567890abcdefg"
 	instance := ecs.ContainerInstance{
 		Ec2InstanceId: &ec2Id,
@@ -414,16 +705,107 @@ func (ctx *MockContext) DescribeInstances(input *ec2.DescribeInstancesInput) (*e
 	return &ec2.DescribeInstancesOutput{
 		Reservations: []*ec2.Reservation{{
 			Instances: []*ec2.Instance{{
-				SubnetId: aws.String("us-west-2a"),
+				SubnetId:         aws.String("us-west-2a"),
+				PrivateIpAddress: aws.String("127.0.0.1"),
 			}},
 		}},
 	}, nil
 }
 
 func (ctx *MockContext) DescribeSubnets(input *ec2.DescribeSubnetsInput) (*ec2.DescribeSubnetsOutput, error) {
+	var ret []*ec2.Subnet
+	for _, v := range input.SubnetIds {
+		ret = append(ret, &ec2.Subnet{
+			SubnetId:         v,
+			AvailabilityZone: aws.String("us-west-2a"),
+		})
+	}
 	return &ec2.DescribeSubnetsOutput{
-		Subnets: []*ec2.Subnet{{
-			AvailabilityZone: aws.String("us-west-2"),
-		}},
+		Subnets: ret,
+	}, nil
+}
+
+func (ctx *MockContext) CloudMapInstanceSize() int64 {
+	ctx.mux.Lock()
+	defer ctx.mux.Unlock()
+	var ret int64
+	for _, v := range ctx.CloudMapInstances {
+		ret += int64(len(v))
+	}
+	return ret
+}
+
+func (ctx *MockContext) GetDiscoveryService(input *servicediscovery.GetServiceInput) (*servicediscovery.GetServiceOutput, error) {
+	return &servicediscovery.GetServiceOutput{
+		Service: &servicediscovery.Service{
+			Id:                      input.Id,
+			HealthCheckCustomConfig: &servicediscovery.HealthCheckCustomConfig{},
+		},
+	}, nil
+}
+
+func (ctx *MockContext) RegisterInstance(input *servicediscovery.RegisterInstanceInput) (*servicediscovery.RegisterInstanceOutput, error) {
+	ctx.mux.Lock()
+	defer ctx.mux.Unlock()
+	if _, ok := ctx.CloudMapInstances[*input.ServiceId]; !ok {
+		ctx.CloudMapInstances[*input.ServiceId] = make(map[string]map[string]*string)
+	}
+	attributes := make(map[string]*string)
+	for k, v := range input.Attributes {
+		attributes[k] = v
+	}
+	ctx.CloudMapInstances[*input.ServiceId][*input.InstanceId] = attributes
+	return &servicediscovery.RegisterInstanceOutput{
+		OperationId: aws.String(uuid.New().String()),
+	}, nil
+}
+
+func (ctx *MockContext) DeregisterInstance(input *servicediscovery.DeregisterInstanceInput) (*servicediscovery.DeregisterInstanceOutput, error) {
+	ctx.mux.Lock()
+	defer ctx.mux.Unlock()
+	if _, ok := ctx.CloudMapInstances[*input.ServiceId][*input.InstanceId]; !ok {
+		return nil, errors.New("instance not found")
+	}
+	delete(ctx.CloudMapInstances[*input.ServiceId], *input.InstanceId)
+	return &servicediscovery.DeregisterInstanceOutput{
+		OperationId: aws.String(uuid.New().String()),
+	}, nil
+}
+
+func (ctx *MockContext) GetOperation(input *servicediscovery.GetOperationInput) (*servicediscovery.GetOperationOutput, error) {
+	return &servicediscovery.GetOperationOutput{
+		Operation: &servicediscovery.Operation{
+			Id:     input.OperationId,
+			Status: aws.String("SUCCESS"),
+		},
+	}, nil
+}
+
+func (ctx *MockContext) UpdateInstanceCustomHealthStatus(input *servicediscovery.UpdateInstanceCustomHealthStatusInput) (*servicediscovery.UpdateInstanceCustomHealthStatusOutput, error) {
+	ctx.mux.Lock()
+	defer ctx.mux.Unlock()
+	attributes, ok := ctx.CloudMapInstances[*input.ServiceId][*input.InstanceId]
+	if !ok {
+		return nil, errors.New("instance not found")
+	}
+	attributes["AWS_INIT_HEALTH_STATUS"] = input.Status
+	return &servicediscovery.UpdateInstanceCustomHealthStatusOutput{}, nil
+}
+
+func (ctx *MockContext) GetInstancesHealthStatus(input *servicediscovery.GetInstancesHealthStatusInput) (*servicediscovery.GetInstancesHealthStatusOutput, error) {
+	ctx.mux.Lock()
+	defer ctx.mux.Unlock()
+	ret := make(map[string]*string)
+	for _, id := range input.Instances {
+		if attributes, ok := ctx.CloudMapInstances[*input.ServiceId][*id]; ok {
+			status := "HEALTHY"
+			if v, ok := attributes["AWS_INIT_HEALTH_STATUS"]; ok {
+				status = *v
+			}
+			ret[*id] = aws.String(status)
+		}
+	}
+	return &servicediscovery.GetInstancesHealthStatusOutput{
+		Status: ret,
 	}, nil
 }
@@ -1,11 +1,32 @@
 package cage
 
-import "time"
+import (
+	"context"
+	"sync/atomic"
+	"time"
+)
 
 var newTimer = time.NewTimer
 var now = time.Now
 
+// wait for the duration. returns error if ctx is done before that
+func sleep(ctx context.Context, d time.Duration) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-newTimer(d).C:
+		return nil
+	}
+}
+
+// total duration of timers created by fakeTimer
+var fakeElapsed int64
+
 func fakeTimer(d time.Duration) *time.Timer {
+	atomic.AddInt64(&fakeElapsed, int64(d))
 	ch := make(chan time.Time)
 	go func() {
 		ch <- time.Now()
@@ -15,6 +36,13 @@ func fakeTimer(d time.Duration) *time.Timer {
 	}
 }
 
+// current time advanced by fakeTimer
+func fakeNow() time.Time {
+	return time.Now().Add(time.Duration(atomic.LoadInt64(&fakeElapsed)))
+}
+
 func recoverTimer() {
 	newTimer = time.NewTimer
+	now = time.Now
+	atomic.StoreInt64(&fakeElapsed, 0)
 }
@@ -0,0 +1,353 @@
+package cage
+
+import (
+	"context"
+	"fmt"
+	"github.com/apex/log"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ecs"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// listener's default actions or listener rule that forwards requests to the service's target group
+type forwardingRule struct {
+	listenerArn *string
+	ruleArn     *string
+	// original actions, used for resetting weights
+	actions []*elbv2.Action
+}
+
+func ParseTrafficShiftSteps(str string) ([]int64, error) {
+	var ret []int64
+	for _, v := range strings.Split(str, ",") {
+		if v = strings.TrimSpace(v); v == "" {
+			continue
+		}
+		step, err := strconv.ParseInt(strings.TrimSuffix(v, "%"), 10, 64)
+		if err != nil {
+			return nil, NewErrorf("--trafficShiftSteps [%s] has invalid step '%s': %s", TrafficShiftStepsKey, v, err)
+		}
+		ret = append(ret, step)
+	}
+	return ret, nil
+}
+
+// Shift traffic from the service's target group to another target group in steps with next task definition,
+// and then update the service while no traffic is forwarded to it.
+//
+//  1. start tasks with next task definition as many as the service's desired count and register them to canary target group
+//  2. add canary target group to listeners forwarding to the service's target group with weight 0
+//  3. increase weight of canary target group step by step, ensuring canary tasks stay healthy for bake time
+//  4. update the service to next task definition and wait for it to be stable
+//  5. reset weights of listeners, which switches all traffic back to the service's target group at once
+//  6. stop canary tasks after deregistering them from canary target group, and delete it if cage created it
+//
+// Weights are reset even if any step fails. If resetting fails, canary tasks and canary target group are
+// left as they are because listeners may still forward traffic to them.
+func (c *cage) RollOutWithTrafficShifting(
+	ctx context.Context,
+	service *ecs.Service,
+	nextTaskDefinition *ecs.TaskDefinition,
+	previousTaskDefinitionArn *string,
+	result *RollOutResult,
+) (err error) {
+	if len(service.LoadBalancers) == 0 {
+		return fmt.Errorf("traffic shifting requires load balancer attached to service '%s'", c.env.Service)
+	}
+	targetGroupArn := service.LoadBalancers[0].TargetGroupArn
+	if tg, err := c.DescribeTargetGroup(targetGroupArn); err != nil {
+		return err
+	} else if tg.isNetwork() {
+		return fmt.Errorf("traffic shifting requires application load balancer but target group '%s' is %s", *targetGroupArn, *tg.targetGroup.Protocol)
+	}
+	rules, err := c.FindForwardingRules(targetGroupArn)
+	if err != nil {
+		return err
+	} else if len(rules) == 0 {
+		return fmt.Errorf("no listener forwards requests to target group '%s'", *targetGroupArn)
+	}
+	// canary tasks must keep serving if listeners failed to be reset
+	var resetErr error
+	var canaryTargetGroupArn *string
+	if c.env.CanaryTargetGroupArn != "" {
+		canaryTargetGroupArn = &c.env.CanaryTargetGroupArn
+	} else if o, err := c.CreateCanaryTargetGroup(targetGroupArn); err != nil {
+		return err
+	} else {
+		canaryTargetGroupArn = o
+		defer func() {
+			if resetErr != nil {
+				log.Warnf("canary target group '%s' is left as listeners may forward traffic to it", *canaryTargetGroupArn)
+				return
+			}
+			log.Infof("deleting canary target group '%s'...", *canaryTargetGroupArn)
+			if _, deleteErr := c.alb.DeleteTargetGroup(&elbv2.DeleteTargetGroupInput{
+				TargetGroupArn: canaryTargetGroupArn,
+			}); deleteErr != nil {
+				log.Errorf("failed to delete canary target group '%s': %s", *canaryTargetGroupArn, deleteErr)
+				if err == nil {
+					err = deleteErr
+				}
+			}
+		}()
+	}
+	// register canary tasks only to canary target group
+	canaryService := *service
+	lb := *service.LoadBalancers[0]
+	lb.TargetGroupArn = canaryTargetGroupArn
+	canaryService.LoadBalancers = []*ecs.LoadBalancer{&lb}
+	log.Infof("starting %d tasks for target group '%s'...", *service.DesiredCount, *canaryTargetGroupArn)
+	tasks, err := c.StartCanaryTasks(ctx, nextTaskDefinition, &canaryService, *service.DesiredCount)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		if resetErr != nil {
+			log.Warnf("%d canary tasks are left running as listeners may forward traffic to them", len(tasks))
+			return
+		}
+		for _, task := range tasks {
+			log.Infof("stopping canary task '%s'...", *task.task.TaskArn)
+			if stopErr := c.StopCanaryTask(task); stopErr != nil {
+				log.Errorf("failed to stop canary task '%s': %s", *task.task.TaskArn, stopErr)
+				if err == nil {
+					err = stopErr
+				}
+			}
+		}
+	}()
+	// some of listeners may have been modified even if shifting failed
+	defer func() {
+		log.Infof("⏪ resetting weights of listeners...")
+		if resetErr = c.ResetTraffic(rules); resetErr != nil {
+			log.Errorf("😱 failed to reset weights of listeners: %s", resetErr)
+			if err != nil {
+				err = fmt.Errorf("failed to reset weights of listeners: %s (%s)", resetErr, err)
+			} else {
+				err = fmt.Errorf("failed to reset weights of listeners: %s", resetErr)
+			}
+		}
+	}()
+	if err := c.ShiftTraffic(rules, targetGroupArn, canaryTargetGroupArn, 0); err != nil {
+		return err
+	}
+	for _, task := range tasks {
+		if err := c.EnsureCanaryTaskHealthy(ctx, task); err != nil {
+			return err
+		}
+	}
+	steps := c.env.TrafficShiftSteps
+	if steps[len(steps)-1] != 100 {
+		steps = append(steps, 100)
+	}
+	for _, weight := range steps {
+		log.Infof("🚦 shifting %d%% of traffic to target group '%s'...", weight, *canaryTargetGroupArn)
+		if err := c.ShiftTraffic(rules, targetGroupArn, canaryTargetGroupArn, weight); err != nil {
+			return err
+		}
+		log.Infof("baking for %s...", c.env.TrafficShiftBakeTime)
+		if err := c.SoakCanaryTasks(ctx, tasks, c.env.TrafficShiftBakeTime); err != nil {
+			return err
+		}
+	}
+	log.Infof("all traffic has been shifted to target group '%s'", *canaryTargetGroupArn)
+	return c.UpdateServiceTaskDefinition(ctx, nextTaskDefinition, previousTaskDefinitionArn, result)
+}
+
+// find listener default actions and listener rules that forward requests to the target group
+func (c *cage) FindForwardingRules(targetGroupArn *string) ([]*forwardingRule, error) {
+	var loadBalancerArns []*string
+	if o, err := c.alb.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{
+		TargetGroupArns: []*string{targetGroupArn},
+	}); err != nil {
+		return nil, err
+	} else {
+		loadBalancerArns = o.TargetGroups[0].LoadBalancerArns
+	}
+	var ret []*forwardingRule
+	for _, lb := range loadBalancerArns {
+		listeners, err := c.alb.DescribeListeners(&elbv2.DescribeListenersInput{
+			LoadBalancerArn: lb,
+		})
+		if err != nil {
+			return nil, err
+		}
+		for _, listener := range listeners.Listeners {
+			if forwardsTo(listener.DefaultActions, targetGroupArn) {
+				ret = append(ret, &forwardingRule{
+					listenerArn: listener.ListenerArn,
+					actions:     listener.DefaultActions,
+				})
+			}
+			rules, err := c.alb.DescribeRules(&elbv2.DescribeRulesInput{
+				ListenerArn: listener.ListenerArn,
+			})
+			if err != nil {
+				return nil, err
+			}
+			for _, rule := range rules.Rules {
+				// default rule is same as listener's default actions
+				if aws.BoolValue(rule.IsDefault) {
+					continue
+				}
+				if forwardsTo(rule.Actions, targetGroupArn) {
+					ret = append(ret, &forwardingRule{
+						ruleArn: rule.RuleArn,
+						actions: rule.Actions,
+					})
+				}
+			}
+		}
+	}
+	return ret, nil
+}
+
+func forwardsTo(actions []*elbv2.Action, targetGroupArn *string) bool {
+	for _, action := range actions {
+		if *action.Type != elbv2.ActionTypeEnumForward {
+			continue
+		}
+		if aws.StringValue(action.TargetGroupArn) == *targetGroupArn {
+			return true
+		}
+		if action.ForwardConfig != nil {
+			for _, tg := range action.ForwardConfig.TargetGroups {
+				if *tg.TargetGroupArn == *targetGroupArn {
+					return true
+				}
+			}
+		}
+	}
+	return false
+}
+
+// forward requests to canary target group with the weight (0-100) and the rest to the service's target group
+func (c *cage) ShiftTraffic(rules []*forwardingRule, targetGroupArn *string, canaryTargetGroupArn *string, weight int64) error {
+	for _, rule := range rules {
+		var actions []*elbv2.Action
+		for _, action := range rule.actions {
+			if !forwardsTo([]*elbv2.Action{action}, targetGroupArn) {
+				actions = append(actions, action)
+				continue
+			}
+			forward := &elbv2.ForwardActionConfig{
+				TargetGroups: shiftWeights(action, targetGroupArn, canaryTargetGroupArn, weight),
+			}
+			if action.ForwardConfig != nil {
+				forward.TargetGroupStickinessConfig = action.ForwardConfig.TargetGroupStickinessConfig
+			}
+			actions = append(actions, &elbv2.Action{
+				Type:          action.Type,
+				Order:         action.Order,
+				ForwardConfig: forward,
+			})
+		}
+		if err := c.modifyForwardingRule(rule, actions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// split the weight of the service's target group into it and canary target group.
+// other target groups keep their weights. weights are rounded as they must be integers
+func shiftWeights(action *elbv2.Action, targetGroupArn *string, canaryTargetGroupArn *string, weight int64) []*elbv2.TargetGroupTuple {
+	if action.ForwardConfig == nil || len(action.ForwardConfig.TargetGroups) <= 1 {
+		return []*elbv2.TargetGroupTuple{
+			{TargetGroupArn: targetGroupArn, Weight: aws.Int64(100 - weight)},
+			{TargetGroupArn: canaryTargetGroupArn, Weight: aws.Int64(weight)},
+		}
+	}
+	var tuples []*elbv2.TargetGroupTuple
+	for _, tg := range action.ForwardConfig.TargetGroups {
+		if *tg.TargetGroupArn != *targetGroupArn {
+			tuples = append(tuples, tg)
+			continue
+		}
+		base := int64(1)
+		if tg.Weight != nil {
+			base = *tg.Weight
+		}
+		canary := (base*weight + 50) / 100
+		tuples = append(tuples,
+			&elbv2.TargetGroupTuple{TargetGroupArn: targetGroupArn, Weight: aws.Int64(base - canary)},
+			&elbv2.TargetGroupTuple{TargetGroupArn: canaryTargetGroupArn, Weight: aws.Int64(canary)},
+		)
+	}
+	return tuples
+}
+
+// restore original actions of listeners and rules
+func (c *cage) ResetTraffic(rules []*forwardingRule) error {
+	for _, rule := range rules {
+		if err := c.modifyForwardingRule(rule, rule.actions); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (c *cage) modifyForwardingRule(rule *forwardingRule, actions []*elbv2.Action) error {
+	if rule.listenerArn != nil {
+		_, err := c.alb.ModifyListener(&elbv2.ModifyListenerInput{
+			ListenerArn:    rule.listenerArn,
+			DefaultActions: actions,
+		})
+		return err
+	}
+	_, err := c.alb.ModifyRule(&elbv2.ModifyRuleInput{
+		RuleArn: rule.ruleArn,
+		Actions: actions,
+	})
+	return err
+}
+
+// create target group with identical configurations to the service's target group
+func (c *cage) CreateCanaryTargetGroup(targetGroupArn *string) (*string, error) {
+	var tg *elbv2.TargetGroup
+	if o, err := c.alb.DescribeTargetGroups(&elbv2.DescribeTargetGroupsInput{
+		TargetGroupArns: []*string{targetGroupArn},
+	}); err != nil {
+		return nil, err
+	} else {
+		tg = o.TargetGroups[0]
+	}
+	name := CanaryTargetGroupName(c.env.Service)
+	log.Infof("creating canary target group '%s'...", name)
+	o, err := c.alb.CreateTargetGroup(&elbv2.CreateTargetGroupInput{
+		Name:                       &name,
+		Protocol:                   tg.Protocol,
+		ProtocolVersion:            tg.ProtocolVersion,
+		Port:                       tg.Port,
+		VpcId:                      tg.VpcId,
+		TargetType:                 tg.TargetType,
+		IpAddressType:              tg.IpAddressType,
+		HealthCheckEnabled:         tg.HealthCheckEnabled,
+		HealthCheckProtocol:        tg.HealthCheckProtocol,
+		HealthCheckPort:            tg.HealthCheckPort,
+		HealthCheckPath:            tg.HealthCheckPath,
+		HealthCheckIntervalSeconds: tg.HealthCheckIntervalSeconds,
+		HealthCheckTimeoutSeconds:  tg.HealthCheckTimeoutSeconds,
+		HealthyThresholdCount:      tg.HealthyThresholdCount,
+		UnhealthyThresholdCount:    tg.UnhealthyThresholdCount,
+		Matcher:                    tg.Matcher,
+	})
+	if err != nil {
+		return nil, err
+	}
+	return o.TargetGroups[0].TargetGroupArn, nil
+}
+
+var invalidTargetGroupNameChars = regexp.MustCompile("[^a-zA-Z0-9-]")
+
+// name of target group must be up to 32 alphanumeric characters or hyphens
+func CanaryTargetGroupName(service string) string {
+	name := "cage-" + invalidTargetGroupNameChars.ReplaceAllString(service, "-")
+	if len(name) > 32 {
+		name = name[:32]
+	}
+	return strings.TrimRight(name, "-")
+}
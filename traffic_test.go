@@ -0,0 +1,189 @@
+package cage
+
+import (
+	"context"
+	"errors"
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/elbv2"
+	"github.com/golang/mock/gomock"
+	"github.com/loilo-inc/canarycage/mocks/github.com/aws/aws-sdk-go/service/elbv2/elbv2iface"
+	"github.com/stretchr/testify/assert"
+	"testing"
+	"time"
+)
+
+func TestParseTrafficShiftSteps(t *testing.T) {
+	steps, err := ParseTrafficShiftSteps("5, 25%,50,100")
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.Equal(t, []int64{5, 25, 50, 100}, steps)
+	steps, err = ParseTrafficShiftSteps("")
+	assert.Nil(t, err)
+	assert.Nil(t, steps)
+	_, err = ParseTrafficShiftSteps("5,a")
+	assert.Equal(t, ErrorKindInvalidInput, KindOf(err))
+}
+
+func TestCanaryTargetGroupName(t *testing.T) {
+	assert.Equal(t, "cage-service", CanaryTargetGroupName("service"))
+	assert.Equal(t, "cage-my-service", CanaryTargetGroupName("my_service"))
+	assert.Equal(t, "cage-very-long-service-name-for", CanaryTargetGroupName("very-long-service-name-for-test"))
+}
+
+// expect listener forwarding to the service's target group and record weights of canary target group
+func setupListener(albMock *mock_elbv2iface.MockELBV2API, targetGroupArn *string, modifyErr error, resetErr error) *[]int64 {
+	var weights []int64
+	albMock.EXPECT().DescribeListeners(gomock.Any()).Return(&elbv2.DescribeListenersOutput{
+		Listeners: []*elbv2.Listener{{
+			ListenerArn: aws.String("arn://listener"),
+			DefaultActions: []*elbv2.Action{{
+				Type:           aws.String("forward"),
+				TargetGroupArn: targetGroupArn,
+			}},
+		}},
+	}, nil)
+	albMock.EXPECT().DescribeRules(gomock.Any()).Return(&elbv2.DescribeRulesOutput{
+		Rules: []*elbv2.Rule{{
+			RuleArn:   aws.String("arn://rule/default"),
+			IsDefault: aws.Bool(true),
+			Actions: []*elbv2.Action{{
+				Type:           aws.String("forward"),
+				TargetGroupArn: targetGroupArn,
+			}},
+		}},
+	}, nil)
+	albMock.EXPECT().CreateTargetGroup(gomock.Any()).Return(&elbv2.CreateTargetGroupOutput{
+		TargetGroups: []*elbv2.TargetGroup{{TargetGroupArn: aws.String("arn://canary-tg")}},
+	}, nil)
+	deleted := 1
+	if resetErr != nil {
+		deleted = 0
+	}
+	albMock.EXPECT().DeleteTargetGroup(gomock.Any()).Return(&elbv2.DeleteTargetGroupOutput{}, nil).Times(deleted)
+	albMock.EXPECT().ModifyListener(gomock.Any()).DoAndReturn(func(input *elbv2.ModifyListenerInput) (*elbv2.ModifyListenerOutput, error) {
+		action := input.DefaultActions[0]
+		if action.ForwardConfig == nil {
+			// reset
+			if resetErr != nil {
+				return nil, resetErr
+			}
+			weights = append(weights, -1)
+			return &elbv2.ModifyListenerOutput{}, nil
+		}
+		weight := *action.ForwardConfig.TargetGroups[1].Weight
+		if modifyErr != nil && weight > 5 {
+			return nil, modifyErr
+		}
+		weights = append(weights, weight)
+		return &elbv2.ModifyListenerOutput{}, nil
+	}).AnyTimes()
+	return &weights
+}
+
+func TestCage_ShiftTraffic(t *testing.T) {
+	// 他のターゲットグループの重みは変えない
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	albMock := mock_elbv2iface.NewMockELBV2API(ctrl)
+	var tuples []*elbv2.TargetGroupTuple
+	albMock.EXPECT().ModifyListener(gomock.Any()).DoAndReturn(func(input *elbv2.ModifyListenerInput) (*elbv2.ModifyListenerOutput, error) {
+		tuples = input.DefaultActions[0].ForwardConfig.TargetGroups
+		return &elbv2.ModifyListenerOutput{}, nil
+	})
+	cagecli := &cage{env: DefaultEnvars(), alb: albMock}
+	rules := []*forwardingRule{{
+		listenerArn: aws.String("arn://listener"),
+		actions: []*elbv2.Action{{
+			Type: aws.String("forward"),
+			ForwardConfig: &elbv2.ForwardActionConfig{
+				TargetGroups: []*elbv2.TargetGroupTuple{
+					{TargetGroupArn: aws.String("arn://other-tg"), Weight: aws.Int64(100)},
+					{TargetGroupArn: aws.String("arn://tg"), Weight: aws.Int64(300)},
+				},
+			},
+		}},
+	}}
+	err := cagecli.ShiftTraffic(rules, aws.String("arn://tg"), aws.String("arn://canary-tg"), 5)
+	assert.Nil(t, err)
+	assert.Equal(t, []*elbv2.TargetGroupTuple{
+		{TargetGroupArn: aws.String("arn://other-tg"), Weight: aws.Int64(100)},
+		{TargetGroupArn: aws.String("arn://tg"), Weight: aws.Int64(285)},
+		{TargetGroupArn: aws.String("arn://canary-tg"), Weight: aws.Int64(15)},
+	}, tuples)
+}
+
+func TestCage_RollOut_TrafficShifting(t *testing.T) {
+	newTimer = fakeTimer
+	now = fakeNow
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.TrafficShiftSteps = []int64{5, 50}
+	envars.TrafficShiftBakeTime = time.Duration(1) * time.Minute
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	weights := setupListener(albMock, envars.ServiceDefinitionInput.LoadBalancers[0].TargetGroupArn, nil, nil)
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	if err != nil {
+		t.Fatalf(err.Error())
+	}
+	assert.False(t, result.ServiceIntact)
+	assert.Equal(t, []int64{0, 5, 50, 100, -1}, *weights)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
+
+func TestCage_RollOut_TrafficShiftingFailed(t *testing.T) {
+	// 途中で失敗した場合は重みを元に戻す
+	newTimer = fakeTimer
+	now = fakeNow
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.TrafficShiftSteps = []int64{5, 50}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	weights := setupListener(albMock, envars.ServiceDefinitionInput.LoadBalancers[0].TargetGroupArn, errors.New("failed"), nil)
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+	})
+	result, err := cagecli.RollOut(context.Background())
+	assert.NotNil(t, err)
+	assert.True(t, result.ServiceIntact)
+	// サービスは変わっていないのでcanaryとして扱う
+	assert.Equal(t, ErrorKindCanary, KindOf(err))
+	assert.Equal(t, []int64{0, 5, -1}, *weights)
+	assert.Equal(t, int64(2), mctx.TaskSize())
+}
+
+func TestCage_RollOut_TrafficShiftingResetFailed(t *testing.T) {
+	// 重みを戻せなかった場合はcanaryを止めずにエラーにする
+	newTimer = fakeTimer
+	now = fakeNow
+	defer recoverTimer()
+	envars := DefaultEnvars()
+	envars.TrafficShiftSteps = []int64{5, 50}
+	ctrl := gomock.NewController(t)
+	defer ctrl.Finish()
+	mctx, ecsMock, albMock, ec2Mock := Setup(ctrl, envars, 2, "FARGATE")
+	setupListener(albMock, envars.ServiceDefinitionInput.LoadBalancers[0].TargetGroupArn, nil, errors.New("throttled"))
+	cagecli := NewCage(&Input{
+		Env: envars,
+		ECS: ecsMock,
+		ALB: albMock,
+		EC2: ec2Mock,
+	})
+	_, err := cagecli.RollOut(context.Background())
+	assert.NotNil(t, err)
+	assert.Contains(t, err.Error(), "failed to reset weights of listeners")
+	assert.Equal(t, int64(4), mctx.TaskSize())
+}
@@ -4,31 +4,55 @@ import (
 	"context"
 	"github.com/apex/log"
 	"github.com/aws/aws-sdk-go/service/ecs"
+	"time"
 )
 
 type UpResult struct {
-	TaskDefinition *ecs.TaskDefinition
-	Service        *ecs.Service
+	StartTime      time.Time           `json:"startTime"`
+	EndTime        time.Time           `json:"endTime"`
+	TaskDefinition *ecs.TaskDefinition `json:"taskDefinition"`
+	Service        *ecs.Service        `json:"service"`
+	Phases         []*PhaseResult      `json:"phases"`
+	// phase where creating the service failed. empty if succeeded
+	FailedPhase Phase `json:"failedPhase,omitempty"`
 }
 
+// returned error is always *Error. result is returned even if it failed
 func (c *cage) Up(ctx context.Context) (*UpResult, error) {
+	ret := &UpResult{
+		StartTime: now(),
+	}
+	throw := func(err *Error) (*UpResult, error) {
+		if current := currentPhase(ret.Phases); current != nil {
+			ret.FailedPhase = current.Name
+		}
+		endPhase(ret.Phases)
+		ret.EndTime = now()
+		return ret, err
+	}
+	beginPhase(&ret.Phases, PhasePreflight)
 	td, err := c.CreateNextTaskDefinition()
 	if err != nil {
-		return nil, err
+		return throw(newError(ErrorKindPreflight, true, err))
 	}
+	ret.TaskDefinition = td
+	beginPhase(&ret.Phases, PhaseCreateService)
 	c.env.ServiceDefinitionInput.TaskDefinition = td.TaskDefinitionArn
-	log.Infof("creating service '%s' with task-definition '%s'...", c.env.Service)
+	log.Infof("creating service '%s' with task-definition '%s'...", c.env.Service, *td.TaskDefinitionArn)
 	if o, err := c.ecs.CreateService(c.env.ServiceDefinitionInput); err != nil {
-		log.Fatalf("failed to create service '%s': %s", c.env.Service, err.Error())
+		log.Errorf("failed to create service '%s': %s", c.env.Service, err.Error())
+		// nothing was created
+		return throw(newError(ErrorKindPreflight, true, err))
 	} else {
 		log.Infof("service created: '%s'", *o.Service.ServiceArn)
 	}
 	log.Infof("waiting for service '%s' to be STABLE", c.env.Service)
-	if err := c.ecs.WaitUntilServicesStable(&ecs.DescribeServicesInput{
+	if err := c.ecs.WaitUntilServicesStableWithContext(ctx, &ecs.DescribeServicesInput{
 		Cluster:  &c.env.Cluster,
 		Services: []*string{&c.env.Service},
 	}); err != nil {
-		log.Fatalf(err.Error())
+		log.Errorf("service '%s' didn't become stable: %s", c.env.Service, err)
+		return throw(newError(ErrorKindServiceUpdate, false, err))
 	} else {
 		log.Infof("become: STABLE")
 	}
@@ -37,10 +61,10 @@ func (c *cage) Up(ctx context.Context) (*UpResult, error) {
 		Services: []*string{&c.env.Service},
 	})
 	if err != nil {
-		return nil, err
+		return throw(newError(ErrorKindServiceUpdate, false, err))
 	}
-	return &UpResult{
-		TaskDefinition: td,
-		Service:        svc.Services[0],
-	}, nil
+	ret.Service = svc.Services[0]
+	endPhase(ret.Phases)
+	ret.EndTime = now()
+	return ret, nil
 }
@@ -3,7 +3,6 @@ package cage
 import (
 	"errors"
 	"fmt"
-	"github.com/apex/log"
 	"io/ioutil"
 	"os"
 	"regexp"
@@ -21,13 +20,14 @@ func ReadFileAndApplyEnvars(path string) ([]byte, error) {
 			if envar, ok := os.LookupEnv(m[1]); ok {
 				str = strings.Replace(str, m[0], envar, -1)
 			} else {
-				log.Fatalf("envar literal '%s' found in %s but was not defined", m[0], path)
+				return nil, NewErrorf("envar literal '%s' found in %s but was not defined", m[0], path)
 			}
 		}
 		return []byte(str), nil
 	}
 }
 
+// error of invalid input
 func NewErrorf(f string, args ...interface{}) error {
-	return errors.New(fmt.Sprintf(f, args...))
+	return &Error{Kind: ErrorKindInvalidInput, ServiceIntact: true, Err: errors.New(fmt.Sprintf(f, args...))}
 }
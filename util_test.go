@@ -2,6 +2,7 @@ package cage
 
 import (
 	"github.com/stretchr/testify/assert"
+	"io/ioutil"
 	"log"
 	"os"
 	"testing"
@@ -31,3 +32,14 @@ fugafuga=hogehoge`
 		log.Fatalf("e: %s, a: %s", e, s)
 	}
 }
+
+func TestReadFileAndApplyEnvars_Undefined(t *testing.T) {
+	// 未定義の環境変数はエラーにする
+	f, _ := ioutil.TempFile("", "template")
+	defer os.Remove(f.Name())
+	f.WriteString("HOGE=${CAGE_UNDEFINED_ENVAR}")
+	f.Close()
+	_, err := ReadFileAndApplyEnvars(f.Name())
+	assert.NotNil(t, err)
+	assert.Equal(t, ErrorKindInvalidInput, KindOf(err))
+}